@@ -0,0 +1,79 @@
+package final_socks
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// AcceptStats are the accept loop counters of a Server, one acceptor per
+// served listener.
+type AcceptStats struct {
+	Acceptors    int
+	Accepted     uint64
+	AcceptErrors uint64
+	// AcceptRate is the number of connections accepted in the last full
+	// second.
+	AcceptRate uint64
+	// PerAcceptor is Accepted of each acceptor, an even spread shows the
+	// kernel balancing SO_REUSEPORT sockets.
+	PerAcceptor []uint64
+}
+
+// acceptCounter is written by a single accept loop only.
+type acceptCounter struct {
+	accepted atomic.Uint64
+	errors   atomic.Uint64
+	second   atomic.Int64
+	current  atomic.Uint64
+	previous atomic.Uint64
+}
+
+func (c *acceptCounter) accept(now int64) {
+	c.accepted.Add(1)
+
+	if second := c.second.Load(); second != now {
+		previous := uint64(0)
+
+		if second == now-1 {
+			previous = c.current.Load()
+		}
+
+		c.previous.Store(previous)
+		c.current.Store(0)
+		c.second.Store(now)
+	}
+
+	c.current.Add(1)
+}
+
+func (c *acceptCounter) rate(now int64) uint64 {
+	switch c.second.Load() {
+	case now:
+		return c.previous.Load()
+	case now - 1:
+		return c.current.Load()
+	}
+
+	return 0
+}
+
+// AcceptStats returns the counters of the listeners being served.
+func (s *Server) AcceptStats() AcceptStats {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	now := time.Now().Unix()
+	stats := AcceptStats{Acceptors: len(s.state.listeners)}
+
+	for _, listener := range s.state.listenerOrder {
+		counter := s.state.listeners[listener]
+		accepted := counter.accepted.Load()
+
+		stats.Accepted += accepted
+		stats.AcceptErrors += counter.errors.Load()
+		stats.AcceptRate += counter.rate(now)
+		stats.PerAcceptor = append(stats.PerAcceptor, accepted)
+	}
+
+	return stats
+}
@@ -0,0 +1,105 @@
+package final_socks
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAcceptCounterRate(t *testing.T) {
+	counter := &acceptCounter{}
+
+	steps := []struct {
+		name    string
+		accepts []int64
+		now     int64
+		rate    uint64
+	}{
+		{name: "current second not over", accepts: []int64{100, 100, 100}, now: 100, rate: 0},
+		{name: "last full second", now: 101, rate: 3},
+		{name: "last second idle", now: 102, rate: 0},
+		{name: "rolled over", accepts: []int64{101, 101}, now: 101, rate: 3},
+		{name: "rolled over last second", now: 102, rate: 2},
+		{name: "idle second between", accepts: []int64{104}, now: 104, rate: 0},
+		{name: "after idle second", now: 105, rate: 1},
+		{name: "clock before last accept", now: 90, rate: 0},
+	}
+
+	for _, step := range steps {
+		for _, now := range step.accepts {
+			counter.accept(now)
+		}
+
+		if rate := counter.rate(step.now); rate != step.rate {
+			t.Fatalf("%s: rate(%d) = %d, want %d", step.name, step.now, rate, step.rate)
+		}
+	}
+
+	if accepted := counter.accepted.Load(); accepted != 6 {
+		t.Fatalf("accepted = %d, want 6", accepted)
+	}
+}
+
+func TestServerAcceptStats(t *testing.T) {
+	server := NewServer("", func(w ResponseWriter, r *Request) {
+		_ = w.SendSucceeded(r.DestAddr)
+	})
+
+	if err := server.SetOption(NoAuthOption()); err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	var addrs []string
+
+	for i := 0; i < 2; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			_ = server.Serve(listener)
+		}()
+
+		// keep the listener order, it is the PerAcceptor order
+		waitAcceptors(t, server, i+1)
+		addrs = append(addrs, listener.Addr().String())
+	}
+
+	for i, n := range []int{3, 2} {
+		for j := 0; j < n; j++ {
+			_ = connectTest(t, addrs[i]).Close()
+		}
+	}
+
+	stats := server.AcceptStats()
+	want := AcceptStats{
+		Acceptors:   2,
+		Accepted:    5,
+		PerAcceptor: []uint64{3, 2},
+	}
+
+	// the test may run across a second boundary
+	stats.AcceptRate = 0
+
+	if !reflect.DeepEqual(stats, want) {
+		t.Fatalf("AcceptStats = %+v, want %+v", stats, want)
+	}
+}
+
+// waitAcceptors waits until server serves n listeners.
+func waitAcceptors(t *testing.T, server *Server, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for server.AcceptStats().Acceptors != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("server serves %d listeners, want %d", server.AcceptStats().Acceptors, n)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 )
 
 type AddrSpec struct {
@@ -35,3 +36,43 @@ func (a *AddrSpec) Host() string {
 
 	return a.FQDN
 }
+
+// Matches reports whether a matches pattern, "host" or "host:port" where
+// host is an IP, a CIDR, a domain, "*.domain" for its subdomains or "*" for
+// any host, and port may be "*".
+func (a *AddrSpec) Matches(pattern string) bool {
+	host, port, err := net.SplitHostPort(pattern)
+
+	if err != nil {
+		host, port = pattern, ""
+	}
+
+	if port != "" && port != "*" && port != strconv.Itoa(a.Port) {
+		return false
+	}
+
+	if host == "*" {
+		return true
+	}
+
+	if _, network, err := net.ParseCIDR(host); err == nil {
+		return a.IP != nil && network.Contains(a.IP)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.Equal(a.IP)
+	}
+
+	fqdn := strings.ToLower(strings.TrimSuffix(a.FQDN, "."))
+	host = strings.ToLower(host)
+
+	if fqdn == "" {
+		return false
+	}
+
+	if strings.HasPrefix(host, "*.") {
+		return strings.HasSuffix(fqdn, host[1:])
+	}
+
+	return fqdn == host
+}
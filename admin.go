@@ -0,0 +1,159 @@
+package final_socks
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// AdminHandler exposes runtime management of the server state over HTTP.
+//
+//	GET    /users                     list users
+//	POST   /users                     {"username": "", "password": ""}
+//	PUT    /users/{name}/password     {"password": ""}
+//	POST   /users/{name}/disable
+//	POST   /users/{name}/enable
+//	DELETE /users/{name}?close_sessions=true
+//	GET    /lockouts                  list tracked failures and lockouts
+//	DELETE /lockouts                  clear all lockouts
+//	DELETE /lockouts/{key}            clear one key, e.g. ip:10.0.0.1 or user:alice
+//
+// Every request must carry the Token as "Authorization: Bearer <token>", a
+// handler without a Token refuses all requests.
+type AdminHandler struct {
+	Users    *UserStore
+	Lockouts *FailureTracker
+	Token    string
+}
+
+func NewAdminHandler(users *UserStore, token string) *AdminHandler {
+	return &AdminHandler{
+		Users: users,
+		Token: token,
+	}
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAdminError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case parts[0] == "users" && h.Users != nil:
+		h.serveUsers(w, r, parts[1:])
+	case parts[0] == "lockouts" && h.Lockouts != nil:
+		h.serveLockouts(w, r, parts[1:])
+	default:
+		writeAdminError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (h *AdminHandler) authorized(r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+
+	if h.Token == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+
+	token := strings.TrimPrefix(header, "Bearer ")
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.Token)) == 1
+}
+
+func (h *AdminHandler) serveUsers(w http.ResponseWriter, r *http.Request, parts []string) {
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			writeAdminError(w, http.StatusBadRequest, errors.Wrap(err, "invalid body"))
+
+			return
+		}
+	}
+
+	var err error
+
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, h.Users.Users())
+
+		return
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		if body.Username == "" {
+			writeAdminError(w, http.StatusBadRequest, errors.New("username is required"))
+
+			return
+		}
+
+		err = h.Users.Add(body.Username, body.Password)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		closeSessions, _ := strconv.ParseBool(r.URL.Query().Get("close_sessions"))
+		err = h.Users.Remove(parts[0], closeSessions)
+	case len(parts) == 2 && parts[1] == "password" && r.Method == http.MethodPut:
+		err = h.Users.SetPassword(parts[0], body.Password)
+	case len(parts) == 2 && parts[1] == "disable" && r.Method == http.MethodPost:
+		err = h.Users.Disable(parts[0])
+	case len(parts) == 2 && parts[1] == "enable" && r.Method == http.MethodPost:
+		err = h.Users.Enable(parts[0])
+	default:
+		writeAdminError(w, http.StatusNotFound, errors.New("not found"))
+
+		return
+	}
+
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case ErrUserNotFound:
+		writeAdminError(w, http.StatusNotFound, err)
+	case ErrUserExists:
+		writeAdminError(w, http.StatusConflict, err)
+	case ErrEmptyPassword:
+		writeAdminError(w, http.StatusBadRequest, err)
+	default:
+		writeAdminError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func (h *AdminHandler) serveLockouts(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, h.Lockouts.Lockouts())
+	case len(parts) == 0 && r.Method == http.MethodDelete:
+		h.Lockouts.Clear("")
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if !h.Lockouts.Clear(parts[0]) {
+			writeAdminError(w, http.StatusNotFound, errors.New("lockout not found"))
+
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAdminError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
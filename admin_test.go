@@ -0,0 +1,127 @@
+package final_socks
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, handler http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestAdminHandlerToken(t *testing.T) {
+	handler := NewAdminHandler(NewUserStore(), "token")
+
+	for _, token := range []string{"", "wrong"} {
+		if rec := adminRequest(t, handler, http.MethodGet, "/users", token, ""); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("token %q: got status %d, want %d", token, rec.Code, http.StatusUnauthorized)
+		}
+	}
+
+	if rec := adminRequest(t, handler, http.MethodGet, "/users", "token", ""); rec.Code != http.StatusOK {
+		t.Fatalf("valid token: got status %d", rec.Code)
+	}
+
+	// without a configured token nothing is accepted
+	open := NewAdminHandler(NewUserStore(), "")
+
+	if rec := adminRequest(t, open, http.MethodGet, "/users", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("no token configured: got status %d", rec.Code)
+	}
+}
+
+func TestAdminHandlerUsers(t *testing.T) {
+	store := NewUserStore()
+	handler := NewAdminHandler(store, "token")
+
+	steps := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodPost, "/users", `{"username": "alice", "password": "secret"}`, http.StatusNoContent},
+		{http.MethodPost, "/users", `{"username": "alice", "password": "secret"}`, http.StatusConflict},
+		{http.MethodPost, "/users", `{"username": "bob", "password": ""}`, http.StatusBadRequest},
+		{http.MethodPost, "/users", `{"password": "secret"}`, http.StatusBadRequest},
+		{http.MethodPost, "/users", `{`, http.StatusBadRequest},
+		{http.MethodPut, "/users/alice/password", `{"password": "changed"}`, http.StatusNoContent},
+		{http.MethodPut, "/users/alice/password", `{"password": ""}`, http.StatusBadRequest},
+		{http.MethodPut, "/users/bob/password", `{"password": "changed"}`, http.StatusNotFound},
+		{http.MethodPost, "/users/alice/disable", "", http.StatusNoContent},
+		{http.MethodPost, "/users/alice/enable", "", http.StatusNoContent},
+		{http.MethodPost, "/users/bob/enable", "", http.StatusNotFound},
+		{http.MethodPatch, "/users/alice", "", http.StatusNotFound},
+	}
+
+	for _, step := range steps {
+		if rec := adminRequest(t, handler, step.method, step.path, "token", step.body); rec.Code != step.status {
+			t.Fatalf("%s %s %s: got status %d, want %d: %s", step.method, step.path, step.body, rec.Code, step.status, rec.Body)
+		}
+	}
+
+	rec := adminRequest(t, handler, http.MethodGet, "/users", "token", "")
+
+	var users []UserInfo
+
+	if err := json.NewDecoder(rec.Body).Decode(&users); err != nil {
+		t.Fatalf("decode users: %v", err)
+	}
+
+	if len(users) != 1 || users[0].Username != "alice" || users[0].Disabled {
+		t.Fatalf("unexpected users: %+v", users)
+	}
+
+	if _, err := store.Verify(nil, "alice", "changed"); err != nil {
+		t.Fatalf("Verify after password change: %v", err)
+	}
+
+	if rec := adminRequest(t, handler, http.MethodDelete, "/users/alice", "token", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: got status %d", rec.Code)
+	}
+
+	if rec := adminRequest(t, handler, http.MethodDelete, "/users/alice", "token", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("delete twice: got status %d", rec.Code)
+	}
+}
+
+func TestAdminHandlerCloseSessions(t *testing.T) {
+	store := NewUserStore()
+	handler := NewAdminHandler(store, "token")
+
+	if err := store.Add("alice", "secret"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	if _, err := store.Verify(server, "alice", "secret"); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	if rec := adminRequest(t, handler, http.MethodDelete, "/users/alice?close_sessions=true", "token", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: got status %d", rec.Code)
+	}
+
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("session not closed: %v", err)
+	}
+}
@@ -3,8 +3,24 @@ package final_socks
 import (
 	"bufio"
 	"net"
+
+	"github.com/pkg/errors"
 )
 
+var ErrAuthFailed = errors.New("authentication failed")
+
 type AuthHandler interface {
 	Authenticate(conn net.Conn, bufConn *bufio.Reader, rw ResponseWriter) (interface{}, error)
 }
+
+// AuthReleaser is implemented by auth handlers that keep per connection state
+// and need to know when an authenticated connection is finished.
+type AuthReleaser interface {
+	Release(conn net.Conn)
+}
+
+// CredentialVerifier checks RFC 1929 username/password credentials.
+// The returned value becomes Request.User.
+type CredentialVerifier interface {
+	Verify(conn net.Conn, username, password string) (interface{}, error)
+}
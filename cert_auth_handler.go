@@ -0,0 +1,58 @@
+package final_socks
+
+import (
+	"bufio"
+	"crypto/x509"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// CertAuthHandler accepts the no auth method on mutual TLS connections and
+// uses the verified client certificate as identity.
+type CertAuthHandler struct {
+}
+
+func NewCertAuthHandler() *CertAuthHandler {
+	return &CertAuthHandler{}
+}
+
+func (h *CertAuthHandler) Authenticate(conn net.Conn, bufConn *bufio.Reader, rw ResponseWriter) (interface{}, error) {
+	state, ok := tlsConnectionState(conn)
+
+	if !ok || len(state.VerifiedChains) == 0 {
+		if err := rw.SendNoAcceptableAuth(); err != nil {
+			return nil, err
+		}
+
+		return nil, errors.New("no verified client certificate")
+	}
+
+	if err := rw.SendNoAuth(); err != nil {
+		return nil, err
+	}
+
+	return CertificateIdentity(state.VerifiedChains[0][0]), nil
+}
+
+// CertificateIdentity names the identity after the subject common name, or
+// the first URI, DNS or email SAN if there is none. All SANs become tags.
+func CertificateIdentity(certificate *x509.Certificate) *Identity {
+	identity := &Identity{
+		Name:      certificate.Subject.CommonName,
+		ExpiresAt: certificate.NotAfter,
+	}
+
+	for _, uri := range certificate.URIs {
+		identity.Tags = append(identity.Tags, uri.String())
+	}
+
+	identity.Tags = append(identity.Tags, certificate.DNSNames...)
+	identity.Tags = append(identity.Tags, certificate.EmailAddresses...)
+
+	if identity.Name == "" && len(identity.Tags) > 0 {
+		identity.Name = identity.Tags[0]
+	}
+
+	return identity
+}
@@ -0,0 +1,73 @@
+package final_socks
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestCertAuthHandler(t *testing.T) {
+	serverCA := newTestCA(t, "server-ca")
+	clientCA := newTestCA(t, "client-ca")
+	otherCA := newTestCA(t, "other-ca")
+	certFile, keyFile := serverCA.issue(t, "proxy", 2, false)
+	store := NewUserStore()
+
+	if err := store.Add("bob", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, users := serveTLSTest(t,
+		UserStoreAuth(store),
+		MutualTLSAuth(TLSConfig{
+			CertFile:     certFile,
+			KeyFile:      keyFile,
+			ClientCAFile: clientCA.file,
+		}),
+	)
+
+	dial := func(dialer *Dialer) error {
+		dialer.ProxyAddr = addr
+		dialer.TLSConfig.RootCAs = serverCA.pool()
+
+		conn, err := dialer.Dial("tcp", "127.0.0.1:80")
+
+		if err == nil {
+			_ = conn.Close()
+		}
+
+		return err
+	}
+
+	// the certificate becomes the identity of a no auth client
+	alice := clientCA.clientCertificate(t, "alice", 10)
+
+	if err := dial(&Dialer{TLSConfig: &tls.Config{Certificates: []tls.Certificate{alice}}}); err != nil {
+		t.Fatalf("client certificate refused: %v", err)
+	}
+
+	identity, ok := (<-users).(*Identity)
+
+	if !ok || identity.Name != "alice" || len(identity.Tags) != 1 || identity.Tags[0] != "spiffe://example.org/alice" {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+
+	// a certificate of another CA fails the TLS handshake
+	mallory := otherCA.clientCertificate(t, "mallory", 10)
+
+	if err := dial(&Dialer{TLSConfig: &tls.Config{Certificates: []tls.Certificate{mallory}}}); err == nil {
+		t.Fatal("certificate of another ca accepted")
+	}
+
+	// without a certificate no auth is refused, the other methods still work
+	if err := dial(&Dialer{TLSConfig: &tls.Config{}}); err == nil {
+		t.Fatal("no auth accepted without a client certificate")
+	}
+
+	if err := dial(&Dialer{Username: "bob", Password: "secret", TLSConfig: &tls.Config{}}); err != nil {
+		t.Fatalf("user/pass without a client certificate: %v", err)
+	}
+
+	if identity, ok := (<-users).(*Identity); !ok || identity.Name != "bob" {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+}
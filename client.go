@@ -0,0 +1,183 @@
+package final_socks
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Dialer connects to destinations through a SOCKS5 proxy using CONNECT.
+type Dialer struct {
+	ProxyAddr string
+	Username  string
+	Password  string
+	// TLSConfig connects to the proxy over TLS when set.
+	TLSConfig *tls.Config
+	// DialProxy opens the connection to the proxy, net.Dialer when nil.
+	DialProxy func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("unsupported network: %v", network)
+	}
+
+	dest, err := parseAddrSpec(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.dialProxy(ctx)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to proxy")
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	bufConn := bufio.NewReader(conn)
+
+	if err := d.handshake(conn, bufConn, dest); err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return &clientConn{Conn: conn, reader: bufConn}, nil
+}
+
+func (d *Dialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	dial := d.DialProxy
+
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	conn, err := dial(ctx, "tcp", d.ProxyAddr)
+
+	if err != nil || d.TLSConfig == nil {
+		return conn, err
+	}
+
+	config := d.TLSConfig
+
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(d.ProxyAddr)
+	}
+
+	tlsConn := tls.Client(conn, config)
+
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+func (d *Dialer) handshake(conn net.Conn, bufConn *bufio.Reader, dest *AddrSpec) error {
+	method := AuthNoAuth
+
+	if d.Username != "" || d.Password != "" {
+		method = AuthUserPass
+	}
+
+	if _, err := conn.Write([]byte{VersionSocks5, 1, method}); err != nil {
+		return err
+	}
+
+	reply := []byte{0, 0}
+
+	if _, err := io.ReadFull(bufConn, reply); err != nil {
+		return errors.Wrap(err, "failed to read auth method")
+	}
+
+	if reply[0] != VersionSocks5 || reply[1] != method {
+		return fmt.Errorf("proxy refused auth method: %v", reply[1])
+	}
+
+	if method == AuthUserPass {
+		if len(d.Username) > 255 || len(d.Password) > 255 {
+			return errors.New("username or password too long")
+		}
+
+		msg := append([]byte{AuthVersion, byte(len(d.Username))}, d.Username...)
+		msg = append(append(msg, byte(len(d.Password))), d.Password...)
+
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(bufConn, reply); err != nil {
+			return errors.Wrap(err, "failed to read auth status")
+		}
+
+		if reply[1] != AuthSuccess {
+			return ErrAuthFailed
+		}
+	}
+
+	if err := WriteRequest(conn, CommandConnect, dest); err != nil {
+		return err
+	}
+
+	resp, err := ReadResponse(bufConn)
+
+	if err != nil {
+		return errors.Wrap(err, "failed to read reply")
+	}
+
+	if resp.Reply != ReplySucceeded {
+		return fmt.Errorf("proxy replied %d", resp.Reply)
+	}
+
+	return nil
+}
+
+func parseAddrSpec(addr string) (*AddrSpec, error) {
+	host, port, err := net.SplitHostPort(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	portNum, err := strconv.Atoi(port)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %v", port)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return &AddrSpec{IP: ip, Port: portNum}, nil
+	}
+
+	return &AddrSpec{FQDN: host, Port: portNum}, nil
+}
+
+// clientConn reads through the buffer used for the handshake.
+type clientConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
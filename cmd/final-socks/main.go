@@ -1,19 +1,71 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"time"
 
 	finalsocks "github.com/lunelabs/final-socks"
 )
 
+// drainTimeout bounds how long tunnels may keep running after a shutdown or
+// upgrade before they are closed.
+const drainTimeout = 5 * time.Minute
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "mint-token" {
+		if err := mintToken(os.Args[2:]); err != nil {
+			fmt.Println(err)
+
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	//noAuth := finalsocks.NoAuthOption()
 	passAuth := finalsocks.UserPassAuth("user", "pass")
 
-	if err := finalsocks.ListenAndServe(":8888", nil, passAuth); err != nil {
+	s := finalsocks.NewServer(":8888", finalsocks.DefaultHandler)
+
+	if err := s.SetOption(passAuth); err != nil {
 		fmt.Println(err)
 
 		os.Exit(1)
 	}
+
+	// systemd socket activation or an upgrade from a previous process
+	listeners, err := finalsocks.InheritedListeners()
+
+	if err != nil {
+		fmt.Println(err)
+
+		os.Exit(1)
+	}
+
+	for _, listener := range listeners {
+		s.AddNetListener(listener)
+	}
+
+	go func() {
+		if err := s.ListenAndServe(); err != nil && err != finalsocks.ErrServerClosed {
+			fmt.Println(err)
+
+			os.Exit(1)
+		}
+	}()
+
+	handleSignals(s)
+}
+
+// drain shuts s down, giving tunnels drainTimeout to finish.
+func drain(s *finalsocks.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	err := s.Shutdown(ctx)
+	cancel()
+
+	if err != nil {
+		fmt.Println(time.Now().Unix(), "drain timed out", err)
+	}
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	finalsocks "github.com/lunelabs/final-socks"
+)
+
+// mintToken prints a token for TokenAuth, e.g.
+//
+//	final-socks mint-token -key-id ci -key ci.pem -user job-42 -ttl 1h -dst '*.example.com:443'
+func mintToken(args []string) error {
+	flags := flag.NewFlagSet("mint-token", flag.ContinueOnError)
+	keyID := flags.String("key-id", "", "key id embedded in the token")
+	keyFile := flags.String("key", "", "hmac secret or ed25519 PKCS#8 private key PEM file")
+	user := flags.String("user", "", "user the token is issued to")
+	ttl := flags.Duration("ttl", time.Hour, "token lifetime")
+	dst := flags.String("dst", "", "comma separated allowed destinations")
+	bw := flags.Int64("bw", 0, "bandwidth cap in bytes per second")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *keyID == "" || *keyFile == "" || *user == "" {
+		return errors.New("-key-id, -key and -user are required")
+	}
+
+	data, err := os.ReadFile(*keyFile)
+
+	if err != nil {
+		return err
+	}
+
+	key, err := finalsocks.ParseTokenKey(*keyID, data)
+
+	if err != nil {
+		return err
+	}
+
+	claims := finalsocks.TokenClaims{
+		User:           *user,
+		ExpiresAt:      time.Now().Add(*ttl).Unix(),
+		BandwidthLimit: *bw,
+	}
+
+	if *dst != "" {
+		claims.Destinations = strings.Split(*dst, ",")
+	}
+
+	token, err := finalsocks.MintToken(key, claims)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(token)
+
+	return nil
+}
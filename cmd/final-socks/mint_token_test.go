@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	finalsocks "github.com/lunelabs/final-socks"
+)
+
+// runMintToken returns what mint-token prints.
+func runMintToken(t *testing.T, args ...string) string {
+	reader, writer, err := os.Pipe()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = writer
+
+	err = mintToken(args)
+
+	os.Stdout = stdout
+	_ = writer.Close()
+
+	if err != nil {
+		t.Fatalf("mint-token: %v", err)
+	}
+
+	out, err := io.ReadAll(reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+func writeKeyFile(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestMintTokenRoundTrip(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// signing is the file mint-token reads, verifying the one the server
+		// loads
+		signing   []byte
+		verifying []byte
+	}{
+		{
+			name:      "hmac",
+			signing:   []byte("secret\n"),
+			verifying: []byte("secret\n"),
+		},
+		{
+			name:      "ed25519",
+			signing:   pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}),
+			verifying: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := runMintToken(t,
+				"-key-id", "ci",
+				"-key", writeKeyFile(t, "key", test.signing),
+				"-user", "job-42",
+				"-dst", "*.example.com:443,10.0.0.0/8",
+				"-bw", "2048",
+			)
+
+			key, err := finalsocks.ParseTokenKey("ci", test.verifying)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			claims, err := finalsocks.NewTokenAuth(key).ParseToken(token)
+
+			if err != nil {
+				t.Fatalf("ParseToken: %v", err)
+			}
+
+			if claims.User != "job-42" || claims.BandwidthLimit != 2048 || len(claims.Destinations) != 2 || claims.Destinations[1] != "10.0.0.0/8" {
+				t.Fatalf("unexpected claims: %+v", claims)
+			}
+		})
+	}
+}
+
+func TestMintTokenRequiredFlags(t *testing.T) {
+	if err := mintToken([]string{"-key-id", "ci", "-user", "job-42"}); err == nil {
+		t.Fatal("mint-token ran without -key")
+	}
+}
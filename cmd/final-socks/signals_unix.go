@@ -0,0 +1,38 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	finalsocks "github.com/lunelabs/final-socks"
+)
+
+// handleSignals drains on SIGINT and SIGTERM and hands the listeners to a
+// new binary on SIGUSR2 before draining.
+func handleSignals(s *finalsocks.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+
+	for sig := range signals {
+		if sig == syscall.SIGUSR2 {
+			process, err := s.Upgrade()
+
+			if err != nil {
+				fmt.Println(time.Now().Unix(), "upgrade failed", err)
+
+				continue
+			}
+
+			fmt.Println(time.Now().Unix(), "upgraded", "pid", process.Pid)
+		}
+
+		drain(s)
+
+		return
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	finalsocks "github.com/lunelabs/final-socks"
+)
+
+// handleSignals drains on an interrupt or a termination, there is no
+// upgrade signal on windows.
+func handleSignals(s *finalsocks.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	<-signals
+	drain(s)
+}
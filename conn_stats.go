@@ -0,0 +1,55 @@
+package final_socks
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// ConnStats reports the bytes transferred on a client connection, it is
+// implemented by the net.Conn handed to auth handlers.
+type ConnStats interface {
+	BytesRead() int64
+	BytesWritten() int64
+}
+
+type statsConn struct {
+	net.Conn
+	read    int64
+	written int64
+}
+
+func newStatsConn(conn net.Conn) *statsConn {
+	return &statsConn{
+		Conn: conn,
+	}
+}
+
+func (c *statsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+
+	return n, err
+}
+
+func (c *statsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+
+	return n, err
+}
+
+func (c *statsConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
+
+func (c *statsConn) BytesRead() int64 {
+	return atomic.LoadInt64(&c.read)
+}
+
+func (c *statsConn) BytesWritten() int64 {
+	return atomic.LoadInt64(&c.written)
+}
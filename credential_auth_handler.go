@@ -0,0 +1,54 @@
+package final_socks
+
+import (
+	"bufio"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+type CredentialAuthHandler struct {
+	verifier CredentialVerifier
+}
+
+func NewCredentialAuthHandler(verifier CredentialVerifier) *CredentialAuthHandler {
+	return &CredentialAuthHandler{
+		verifier: verifier,
+	}
+}
+
+func (h *CredentialAuthHandler) Authenticate(conn net.Conn, bufConn *bufio.Reader, rw ResponseWriter) (interface{}, error) {
+	if err := rw.SendUserPassAuth(); err != nil {
+		return nil, err
+	}
+
+	user, pass, err := ReadUserPass(bufConn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := h.verifier.Verify(conn, user, pass)
+
+	if err != nil {
+		if err := rw.SendAuthFailure(); err != nil {
+			return nil, err
+		}
+
+		return nil, errors.Wrap(ErrAuthFailed, err.Error())
+	}
+
+	if err := rw.SendAuthSuccess(); err != nil {
+		h.Release(conn)
+
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (h *CredentialAuthHandler) Release(conn net.Conn) {
+	if releaser, ok := h.verifier.(AuthReleaser); ok {
+		releaser.Release(conn)
+	}
+}
@@ -0,0 +1,78 @@
+package final_socks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+type credentialCacheEntry struct {
+	identity  *Identity
+	expiresAt time.Time
+}
+
+// credentialCache remembers auth decisions of remote backends keyed by a
+// hash of the credentials, so plaintext passwords are never kept.
+type credentialCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]credentialCacheEntry
+}
+
+func newCredentialCache(ttl time.Duration) *credentialCache {
+	return &credentialCache{
+		ttl:     ttl,
+		entries: map[string]credentialCacheEntry{},
+	}
+}
+
+func (c *credentialCache) get(key string) (*Identity, bool) {
+	if c.ttl <= 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+
+	return entry.identity, true
+}
+
+func (c *credentialCache) put(key string, identity *Identity) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	for k, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = credentialCacheEntry{
+		identity:  identity,
+		expiresAt: now.Add(c.ttl),
+	}
+}
+
+func credentialCacheKey(parts ...string) string {
+	h := sha256.New()
+
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -6,8 +6,6 @@ import (
 	"io"
 	"net"
 	"time"
-
-	"github.com/lunelabs/final-socks/pool"
 )
 
 var DefaultHandler Handler = func(w ResponseWriter, r *Request) {
@@ -23,8 +21,30 @@ var DefaultHandler Handler = func(w ResponseWriter, r *Request) {
 		return
 	}
 
+	identity, _ := r.User.(*Identity)
+
+	// outbound connections of the user leave from its egress address
+	var egressIP net.IP
+
+	if identity != nil {
+		egressIP = identity.EgressIP
+	}
+
 	if r.Command == CommandConnect {
-		target, err := net.Dial("tcp", r.DestAddr.Address())
+		// the destinations of an association are checked per datagram
+		if identity != nil && !identity.AllowsDestination(r.DestAddr) {
+			_ = w.SendNotAllowed()
+
+			return
+		}
+
+		dialer := net.Dialer{}
+
+		if egressIP != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: egressIP}
+		}
+
+		target, err := dialer.Dial("tcp", r.DestAddr.Address())
 
 		if err != nil {
 			_ = w.SendNetworkError(err.Error())
@@ -34,19 +54,37 @@ var DefaultHandler Handler = func(w ResponseWriter, r *Request) {
 
 		defer target.Close()
 
+		if err := r.WriteProxyHeader(target); err != nil {
+			_ = w.SendNetworkError(err.Error())
+
+			return
+		}
+
 		addr := target.LocalAddr().(*net.TCPAddr)
 
 		if err := w.SendSucceeded(&AddrSpec{IP: addr.IP, Port: addr.Port}); err != nil {
 			return
 		}
 
-		if err := w.Proxy(target, r.BufConn); err != nil {
+		var upstream net.Conn = target
+
+		if identity != nil && identity.RateLimit > 0 {
+			upstream = newRateLimitedConn(target, identity.RateLimit)
+		}
+
+		if err := w.Proxy(upstream, r.BufConn); err != nil {
 			fmt.Println(err)
 		}
 
 		return
 	}
 
+	if !r.udpClientKnown() {
+		_ = w.SendNotAllowed()
+
+		return
+	}
+
 	udpListener, err := net.ListenPacket("udp", net.JoinHostPort(r.LocalAddr.IP.String(), "0"))
 
 	if err != nil {
@@ -69,36 +107,40 @@ var DefaultHandler Handler = func(w ResponseWriter, r *Request) {
 		return
 	}
 
-	errChan := make(chan error)
+	// the association lasts as long as the control connection
+	errChan := make(chan error, 1)
 	ctx, cancel := context.WithCancel(context.Background())
+	relay := newUDPRelay(udpListener, egressIP)
+	relay.restrictClient(r)
+	relay.restrictUser(identity)
+	relay.natMode = r.udpNATMode()
+	relay.enableFragmentation(r.udpFragment)
 
 	go func() {
-		c := NewPktConn(udpListener, nil, nil, nil)
-		buf := pool.GetBuffer(UDPBufSize)
-
-		n, srcAddr, dstAddr, err := c.ReadFrom2(buf)
-
-		if err != nil {
-			errChan <- err
-
-			return
-		}
-
-		sessionKey := srcAddr.String()
-		session := NewSession(sessionKey, srcAddr, dstAddr, c, nil)
-
-		go session.Serve(ctx, errChan)
-
-		session.ProcessMessage(Message{dstAddr, buf[:n]})
+		errChan <- relay.serve(ctx)
 	}()
 
+	// r.BufConn is pooled once the handler returns, wait for the reader
+	// to stop after closing the connection
+	readDone := make(chan struct{})
+
 	go func() {
 		_, _ = io.Copy(io.Discard, r.BufConn)
 
-		errChan <- nil
+		close(readDone)
 	}()
 
-	<-errChan
+	select {
+	case <-errChan:
+	case <-readDone:
+	}
 
 	cancel()
+	_ = udpListener.Close()
+
+	if closer, ok := w.GetConnection().(io.Closer); ok {
+		_ = closer.Close()
+	}
+
+	<-readDone
 }
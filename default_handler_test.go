@@ -0,0 +1,69 @@
+package final_socks
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestDefaultHandlerEgressIP(t *testing.T) {
+	egressIP := net.IPv4(127, 0, 0, 2)
+
+	if probe, err := net.Listen("tcp", "127.0.0.2:0"); err != nil {
+		t.Skipf("no second loopback address: %v", err)
+	} else {
+		_ = probe.Close()
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		DefaultHandler(NewResponseWriter(conn), &Request{
+			Command:  CommandConnect,
+			DestAddr: &AddrSpec{IP: addr.IP, Port: addr.Port},
+			User:     &Identity{Name: "alice", EgressIP: egressIP},
+			BufConn:  bufio.NewReader(conn),
+		})
+
+		_ = conn.Close()
+	}()
+
+	reply := make([]byte, 10)
+
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply[1] != ReplySucceeded {
+		t.Fatalf("reply %d, want %d", reply[1], ReplySucceeded)
+	}
+
+	target, err := listener.Accept()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip := target.RemoteAddr().(*net.TCPAddr).IP; !ip.Equal(egressIP) {
+		t.Fatalf("target saw %v, want %v", ip, egressIP)
+	}
+
+	_ = target.Close()
+	_ = client.Close()
+	<-done
+}
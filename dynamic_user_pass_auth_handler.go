@@ -2,8 +2,6 @@ package final_socks
 
 import (
 	"bufio"
-	"fmt"
-	"io"
 	"net"
 )
 
@@ -20,51 +18,9 @@ func NewDynamicUserPassAuthHandler(authFunction AuthFunction) *DynamicUserPassAu
 }
 
 func (h *DynamicUserPassAuthHandler) Authenticate(conn net.Conn, bufConn *bufio.Reader, rw ResponseWriter) (interface{}, error) {
-	if err := rw.SendUserPassAuth(); err != nil {
-		return nil, err
-	}
-
-	header := []byte{0, 0}
-
-	if _, err := io.ReadAtLeast(bufConn, header, 2); err != nil {
-		return nil, err
-	}
-
-	if header[0] != AuthVersion {
-		return nil, fmt.Errorf("unsupported auth version: %v", header[0])
-	}
-
-	userLen := int(header[1])
-	user := make([]byte, userLen)
-
-	if _, err := io.ReadAtLeast(bufConn, user, userLen); err != nil {
-		return nil, err
-	}
-
-	if _, err := bufConn.Read(header[:1]); err != nil {
-		return nil, err
-	}
-
-	passLen := int(header[0])
-	pass := make([]byte, passLen)
-
-	if _, err := io.ReadAtLeast(bufConn, pass, passLen); err != nil {
-		return nil, err
-	}
-
-	data, err := h.authFunction(string(user), string(pass))
-
-	if err == nil {
-		if err := rw.SendAuthSuccess(); err != nil {
-			return nil, err
-		}
-
-		return data, nil
-	}
-
-	if err := rw.SendAuthFailure(); err != nil {
-		return nil, err
-	}
+	return NewCredentialAuthHandler(h).Authenticate(conn, bufConn, rw)
+}
 
-	return nil, nil
+func (h *DynamicUserPassAuthHandler) Verify(conn net.Conn, username, password string) (interface{}, error) {
+	return h.authFunction(username, password)
 }
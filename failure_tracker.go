@@ -0,0 +1,271 @@
+package final_socks
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrLockedOut = errors.New("too many authentication failures")
+
+type FailureTrackerConfig struct {
+	// MaxFailures within Window locks the key out for LockoutDuration.
+	MaxFailures     int
+	Window          time.Duration
+	LockoutDuration time.Duration
+	// BaseDelay is doubled on every consecutive failure up to MaxDelay before
+	// the failure is reported to the client.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Log receives one fail2ban friendly line per failure and lockout.
+	Log io.Writer
+}
+
+var DefaultFailureTrackerConfig = FailureTrackerConfig{
+	MaxFailures:     5,
+	Window:          5 * time.Minute,
+	LockoutDuration: 15 * time.Minute,
+	BaseDelay:       250 * time.Millisecond,
+	MaxDelay:        5 * time.Second,
+}
+
+// Lockout is the state of a tracked key, "ip:<addr>" or "user:<name>".
+type Lockout struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+type failureEntry struct {
+	failures    int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+// FailureTracker counts authentication failures per client IP and per
+// username, slowing down and locking out brute force attempts.
+type FailureTracker struct {
+	config    FailureTrackerConfig
+	mu        sync.Mutex
+	entries   map[string]*failureEntry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewFailureTracker(config FailureTrackerConfig) *FailureTracker {
+	return &FailureTracker{
+		config:  config,
+		entries: map[string]*failureEntry{},
+		now:     time.Now,
+	}
+}
+
+// Wrap returns a CredentialVerifier that consults the tracker before and
+// records the outcome after calling verifier.
+func (t *FailureTracker) Wrap(verifier CredentialVerifier) CredentialVerifier {
+	return &trackedVerifier{
+		tracker:  t,
+		verifier: verifier,
+	}
+}
+
+// Check returns ErrLockedOut if the IP or the username is locked out.
+func (t *FailureTracker) Check(ip net.IP, username string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+
+	for _, key := range failureKeys(ip, username) {
+		if entry, ok := t.entries[key]; ok && now.Before(entry.lockedUntil) {
+			return ErrLockedOut
+		}
+	}
+
+	return nil
+}
+
+// Failure records a failed attempt and returns how long to delay the reply.
+func (t *FailureTracker) Failure(ip net.IP, username string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.sweep(now)
+
+	t.log("authentication failure for user=%q rhost=%s", username, ip)
+
+	failures := 0
+
+	for _, key := range failureKeys(ip, username) {
+		entry, ok := t.entries[key]
+
+		if !ok || (now.Sub(entry.first) > t.config.Window && now.After(entry.lockedUntil)) {
+			entry = &failureEntry{first: now}
+			t.entries[key] = entry
+		}
+
+		entry.failures++
+
+		if t.config.MaxFailures > 0 && entry.failures >= t.config.MaxFailures && now.After(entry.lockedUntil) {
+			entry.lockedUntil = now.Add(t.config.LockoutDuration)
+
+			t.log("locked out %s rhost=%s until %s", key, ip, entry.lockedUntil.Format(time.RFC3339))
+		}
+
+		if entry.failures > failures {
+			failures = entry.failures
+		}
+	}
+
+	return t.delay(failures)
+}
+
+// Success clears the failure history of the username. The IP keeps its
+// history, one valid account must not reset a guessing run against others.
+func (t *FailureTracker) Success(ip net.IP, username string) {
+	if username == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.entries, "user:"+username)
+}
+
+func (t *FailureTracker) Lockouts() []Lockout {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sweep(t.now())
+
+	lockouts := make([]Lockout, 0, len(t.entries))
+
+	for key, entry := range t.entries {
+		lockouts = append(lockouts, Lockout{
+			Key:         key,
+			Failures:    entry.failures,
+			LockedUntil: entry.lockedUntil,
+		})
+	}
+
+	sort.Slice(lockouts, func(i, j int) bool { return lockouts[i].Key < lockouts[j].Key })
+
+	return lockouts
+}
+
+// Clear removes the key, or every key if key is empty. It reports whether
+// anything was removed.
+func (t *FailureTracker) Clear(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if key == "" {
+		cleared := len(t.entries) > 0
+		t.entries = map[string]*failureEntry{}
+
+		return cleared
+	}
+
+	_, ok := t.entries[key]
+	delete(t.entries, key)
+
+	return ok
+}
+
+func (t *FailureTracker) delay(failures int) time.Duration {
+	if t.config.BaseDelay <= 0 || failures <= 0 {
+		return 0
+	}
+
+	delay := t.config.BaseDelay
+
+	for i := 1; i < failures; i++ {
+		delay *= 2
+
+		if t.config.MaxDelay > 0 && delay >= t.config.MaxDelay {
+			return t.config.MaxDelay
+		}
+	}
+
+	return delay
+}
+
+func (t *FailureTracker) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.config.Window {
+		return
+	}
+
+	t.lastSweep = now
+
+	for key, entry := range t.entries {
+		if now.Sub(entry.first) > t.config.Window && now.After(entry.lockedUntil) {
+			delete(t.entries, key)
+		}
+	}
+}
+
+func (t *FailureTracker) log(format string, args ...interface{}) {
+	if t.config.Log == nil {
+		return
+	}
+
+	fmt.Fprintf(t.config.Log, "%s final-socks: %s\n", time.Now().Format(time.RFC3339), fmt.Sprintf(format, args...))
+}
+
+func failureKeys(ip net.IP, username string) []string {
+	keys := make([]string, 0, 2)
+
+	if ip != nil {
+		keys = append(keys, "ip:"+ip.String())
+	}
+
+	if username != "" {
+		keys = append(keys, "user:"+username)
+	}
+
+	return keys
+}
+
+type trackedVerifier struct {
+	tracker  *FailureTracker
+	verifier CredentialVerifier
+}
+
+func (v *trackedVerifier) Verify(conn net.Conn, username, password string) (interface{}, error) {
+	var ip net.IP
+
+	if conn != nil {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			ip = addr.IP
+		}
+	}
+
+	if err := v.tracker.Check(ip, username); err != nil {
+		return nil, err
+	}
+
+	user, err := v.verifier.Verify(conn, username, password)
+
+	if err != nil {
+		time.Sleep(v.tracker.Failure(ip, username))
+
+		return nil, err
+	}
+
+	v.tracker.Success(ip, username)
+
+	return user, nil
+}
+
+func (v *trackedVerifier) Release(conn net.Conn) {
+	if releaser, ok := v.verifier.(AuthReleaser); ok {
+		releaser.Release(conn)
+	}
+}
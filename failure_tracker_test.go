@@ -0,0 +1,164 @@
+package final_socks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestFailureTracker(config FailureTrackerConfig) (*FailureTracker, *time.Time) {
+	now := time.Unix(1700000000, 0)
+	tracker := NewFailureTracker(config)
+	tracker.now = func() time.Time { return now }
+
+	return tracker, &now
+}
+
+func TestFailureTrackerBackoff(t *testing.T) {
+	tracker, _ := newTestFailureTracker(FailureTrackerConfig{
+		Window:    time.Minute,
+		BaseDelay: 100 * time.Millisecond,
+		MaxDelay:  time.Second,
+	})
+
+	ip := net.IPv4(192, 0, 2, 1)
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+
+	for i, delay := range want {
+		if got := tracker.Failure(ip, "alice"); got != delay*time.Millisecond {
+			t.Fatalf("failure %d: got delay %v, want %v", i+1, got, delay*time.Millisecond)
+		}
+	}
+}
+
+func TestFailureTrackerLockout(t *testing.T) {
+	tracker, now := newTestFailureTracker(FailureTrackerConfig{
+		MaxFailures:     3,
+		Window:          time.Minute,
+		LockoutDuration: 10 * time.Minute,
+	})
+
+	ip := net.IPv4(192, 0, 2, 1)
+
+	for i := 0; i < 3; i++ {
+		if err := tracker.Check(ip, "alice"); err != nil {
+			t.Fatalf("attempt %d: %v", i+1, err)
+		}
+
+		tracker.Failure(ip, "alice")
+	}
+
+	if err := tracker.Check(ip, "alice"); err != ErrLockedOut {
+		t.Fatalf("got %v, want %v", err, ErrLockedOut)
+	}
+
+	// both the IP and the username are locked out on their own
+	if err := tracker.Check(ip, "bob"); err != ErrLockedOut {
+		t.Fatalf("same IP: got %v, want %v", err, ErrLockedOut)
+	}
+
+	if err := tracker.Check(net.IPv4(192, 0, 2, 2), "alice"); err != ErrLockedOut {
+		t.Fatalf("same user: got %v, want %v", err, ErrLockedOut)
+	}
+
+	*now = now.Add(10*time.Minute + time.Second)
+
+	if err := tracker.Check(ip, "alice"); err != nil {
+		t.Fatalf("after lockout: %v", err)
+	}
+}
+
+func TestFailureTrackerWindow(t *testing.T) {
+	tracker, now := newTestFailureTracker(FailureTrackerConfig{
+		MaxFailures:     3,
+		Window:          time.Minute,
+		LockoutDuration: 10 * time.Minute,
+	})
+
+	ip := net.IPv4(192, 0, 2, 1)
+
+	tracker.Failure(ip, "alice")
+	tracker.Failure(ip, "alice")
+
+	// failures older than the window start a new count
+	*now = now.Add(time.Minute + time.Second)
+	tracker.Failure(ip, "alice")
+
+	if err := tracker.Check(ip, "alice"); err != nil {
+		t.Fatalf("failures outside the window locked out: %v", err)
+	}
+
+	for _, lockout := range tracker.Lockouts() {
+		if lockout.Failures != 1 {
+			t.Fatalf("%s: got %d failures, want 1", lockout.Key, lockout.Failures)
+		}
+	}
+
+	// the sweep drops expired entries
+	*now = now.Add(2 * time.Minute)
+
+	if lockouts := tracker.Lockouts(); len(lockouts) != 0 {
+		t.Fatalf("expired entries kept: %+v", lockouts)
+	}
+}
+
+func TestFailureTrackerSuccess(t *testing.T) {
+	tracker, _ := newTestFailureTracker(FailureTrackerConfig{Window: time.Minute})
+	ip := net.IPv4(192, 0, 2, 1)
+
+	tracker.Failure(ip, "alice")
+	tracker.Failure(ip, "bob")
+	tracker.Success(ip, "alice")
+
+	lockouts := tracker.Lockouts()
+
+	if len(lockouts) != 2 || lockouts[0].Key != "ip:192.0.2.1" || lockouts[0].Failures != 2 || lockouts[1].Key != "user:bob" {
+		t.Fatalf("unexpected lockouts: %+v", lockouts)
+	}
+}
+
+func TestFailureTrackerClear(t *testing.T) {
+	tracker, _ := newTestFailureTracker(FailureTrackerConfig{Window: time.Minute})
+	ip := net.IPv4(192, 0, 2, 1)
+
+	tracker.Failure(ip, "alice")
+
+	if !tracker.Clear("user:alice") {
+		t.Fatal("Clear did not find user:alice")
+	}
+
+	if tracker.Clear("user:alice") {
+		t.Fatal("Clear removed user:alice twice")
+	}
+
+	if lockouts := tracker.Lockouts(); len(lockouts) != 1 || lockouts[0].Key != "ip:192.0.2.1" {
+		t.Fatalf("unexpected lockouts: %+v", lockouts)
+	}
+
+	if !tracker.Clear("") || tracker.Clear("") {
+		t.Fatal("Clear all did not report removal once")
+	}
+
+	if lockouts := tracker.Lockouts(); len(lockouts) != 0 {
+		t.Fatalf("unexpected lockouts: %+v", lockouts)
+	}
+}
+
+func TestAuthLockoutOrder(t *testing.T) {
+	tracker := NewFailureTracker(DefaultFailureTrackerConfig)
+	server := NewServer("", nil)
+
+	if err := server.SetOption(AuthLockout(tracker)); err == nil {
+		t.Fatal("AuthLockout accepted a server without username/password auth")
+	}
+
+	store := NewUserStore()
+
+	if err := server.SetOption(UserStoreAuth(store)); err != nil {
+		t.Fatalf("UserStoreAuth: %v", err)
+	}
+
+	if err := server.SetOption(AuthLockout(tracker)); err != nil {
+		t.Fatalf("AuthLockout after the auth option: %v", err)
+	}
+}
@@ -2,4 +2,14 @@ module github.com/lunelabs/final-socks
 
 go 1.19
 
-require github.com/pkg/errors v0.9.1 // indirect
+require (
+	github.com/go-asn1-ber/asn1-ber v1.5.4
+	github.com/go-ldap/ldap/v3 v3.4.4
+	github.com/gorilla/websocket v1.5.3
+	github.com/pkg/errors v0.9.1
+	golang.org/x/crypto v0.11.0
+	golang.org/x/net v0.12.0
+	golang.org/x/sys v0.10.0
+)
+
+require github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
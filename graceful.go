@@ -0,0 +1,436 @@
+package final_socks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrServerClosed is returned by Serve after Shutdown or Close.
+var ErrServerClosed = errors.New("server closed")
+
+const (
+	// UpgradeListenFDsEnv is the number of listeners handed to an upgraded
+	// process, starting at fd 3 like systemd LISTEN_FDS.
+	UpgradeListenFDsEnv = "FINAL_SOCKS_LISTEN_FDS"
+	// UpgradeReadyFDEnv is the pipe the upgraded process reports on once its
+	// listeners are serving.
+	UpgradeReadyFDEnv = "FINAL_SOCKS_READY_FD"
+)
+
+var UpgradeTimeout = 30 * time.Second
+
+// serverState is shared by the listener copies of a Server.
+type serverState struct {
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]*acceptCounter
+	// listenerOrder keeps AcceptStats and ListenerFiles stable.
+	listenerOrder []net.Listener
+	conns         map[net.Conn]struct{}
+	connsWG       sync.WaitGroup
+	udp           udpCounters
+	// closers are background resources started by options, e.g. file
+	// watchers, stopped once the server shuts down.
+	closers []io.Closer
+}
+
+func newServerState() *serverState {
+	return &serverState{
+		listeners: map[net.Listener]*acceptCounter{},
+		conns:     map[net.Conn]struct{}{},
+	}
+}
+
+func (st *serverState) addListener(listener net.Listener) (*acceptCounter, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.closed {
+		return nil, false
+	}
+
+	counter := &acceptCounter{}
+	st.listeners[listener] = counter
+	st.listenerOrder = append(st.listenerOrder, listener)
+
+	return counter, true
+}
+
+func (st *serverState) removeListener(listener net.Listener) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	delete(st.listeners, listener)
+
+	for i, l := range st.listenerOrder {
+		if l == listener {
+			st.listenerOrder = append(st.listenerOrder[:i], st.listenerOrder[i+1:]...)
+
+			break
+		}
+	}
+}
+
+func (st *serverState) addConn(conn net.Conn) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.closed {
+		return false
+	}
+
+	st.conns[conn] = struct{}{}
+	st.connsWG.Add(1)
+
+	return true
+}
+
+func (st *serverState) removeConn(conn net.Conn) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.conns[conn]; ok {
+		delete(st.conns, conn)
+		st.connsWG.Done()
+	}
+}
+
+func (st *serverState) isClosed() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return st.closed
+}
+
+func (st *serverState) closeListeners() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.closed = true
+
+	for _, listener := range st.listenerOrder {
+		_ = listener.Close()
+	}
+}
+
+func (st *serverState) addCloser(closer io.Closer) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.closers = append(st.closers, closer)
+}
+
+func (st *serverState) closeClosers() {
+	st.mu.Lock()
+	closers := st.closers
+	st.closers = nil
+	st.mu.Unlock()
+
+	for _, closer := range closers {
+		_ = closer.Close()
+	}
+}
+
+func (st *serverState) closeConns() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for conn := range st.conns {
+		_ = conn.Close()
+	}
+}
+
+// Shutdown stops accepting and waits for the active connections to finish,
+// the ones still open when ctx is done are closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.state.closeListeners()
+	s.state.closeClosers()
+
+	done := make(chan struct{})
+
+	go func() {
+		s.state.connsWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.state.closeConns()
+
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting and closes the active connections.
+func (s *Server) Close() error {
+	s.state.closeListeners()
+	s.state.closeClosers()
+	s.state.closeConns()
+
+	return nil
+}
+
+// ListenerFiles duplicates the sockets of the serving listeners for a new
+// process. Unix sockets are no longer removed when closed here.
+func (s *Server) ListenerFiles() ([]*os.File, error) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	files := make([]*os.File, 0, len(s.state.listeners))
+
+	for _, listener := range s.state.listenerOrder {
+		var file *os.File
+		var err error
+
+		switch l := listener.(type) {
+		case *net.TCPListener:
+			file, err = l.File()
+		case *net.UnixListener:
+			l.SetUnlinkOnClose(false)
+			file, err = l.File()
+		default:
+			err = fmt.Errorf("unsupported listener: %T", listener)
+		}
+
+		if err != nil {
+			for _, f := range files {
+				_ = f.Close()
+			}
+
+			return nil, errors.Wrap(err, "failed to get listener file")
+		}
+
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// Upgrade starts the current executable with the same arguments and the
+// serving listeners, and returns once it is serving them too. The caller
+// then drains this process with Shutdown.
+func (s *Server) Upgrade() (*os.Process, error) {
+	executable, err := os.Executable()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find executable")
+	}
+
+	files, err := s.ListenerFiles()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}()
+
+	readyReader, readyWriter, err := os.Pipe()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create ready pipe")
+	}
+
+	defer readyReader.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(
+		os.Environ(),
+		UpgradeListenFDsEnv+"="+strconv.Itoa(len(files)),
+		UpgradeReadyFDEnv+"="+strconv.Itoa(3+len(files)),
+	)
+
+	err = cmd.Start()
+	_ = readyWriter.Close()
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start upgraded process")
+	}
+
+	_ = readyReader.SetReadDeadline(time.Now().Add(UpgradeTimeout))
+
+	if _, err := readyReader.Read(make([]byte, 1)); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+
+		return nil, errors.Wrap(err, "upgraded process did not become ready")
+	}
+
+	go func() {
+		_ = cmd.Wait()
+	}()
+
+	return cmd.Process, nil
+}
+
+var inherited struct {
+	once      sync.Once
+	mu        sync.Mutex
+	listeners []net.Listener
+	err       error
+}
+
+// InheritedListeners returns the listeners passed by systemd socket
+// activation or by the process being upgraded. Listeners matching the
+// address of AddListener or the server address are used instead of new
+// sockets, the ones no listener uses are closed once a server serves.
+func InheritedListeners() ([]net.Listener, error) {
+	inherited.once.Do(func() {
+		inherited.listeners, inherited.err = inheritListeners()
+	})
+
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+
+	return append([]net.Listener{}, inherited.listeners...), inherited.err
+}
+
+func inheritListeners() ([]net.Listener, error) {
+	count := os.Getenv(UpgradeListenFDsEnv)
+
+	if count == "" && os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) {
+		count = os.Getenv("LISTEN_FDS")
+	}
+
+	for _, env := range []string{UpgradeListenFDsEnv, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		_ = os.Unsetenv(env)
+	}
+
+	if count == "" {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(count)
+
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid listen fds: %q", count)
+	}
+
+	listeners := make([]net.Listener, 0, n)
+
+	for fd := 3; fd < 3+n; fd++ {
+		file := os.NewFile(uintptr(fd), "listener"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		_ = file.Close()
+
+		if err != nil {
+			return listeners, errors.Wrapf(err, "failed to inherit listener fd %d", fd)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+// takeInheritedListeners removes and returns the inherited listeners bound
+// to address, more than one when they were SO_REUSEPORT acceptors.
+func takeInheritedListeners(network, address string) []net.Listener {
+	_, _ = InheritedListeners()
+
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+
+	var taken []net.Listener
+	rest := inherited.listeners[:0]
+
+	for _, listener := range inherited.listeners {
+		if listenerMatches(listener, network, address) {
+			taken = append(taken, listener)
+		} else {
+			rest = append(rest, listener)
+		}
+	}
+
+	inherited.listeners = rest
+
+	return taken
+}
+
+// takeInheritedListener removes listener from the inherited ones, it was
+// added with AddNetListener.
+func takeInheritedListener(listener net.Listener) {
+	inherited.mu.Lock()
+	defer inherited.mu.Unlock()
+
+	for i, l := range inherited.listeners {
+		if l == listener {
+			inherited.listeners = append(inherited.listeners[:i], inherited.listeners[i+1:]...)
+
+			return
+		}
+	}
+}
+
+// closeUnusedInheritedListeners closes the inherited listeners no listener
+// of the serving server took, nothing would accept on them otherwise.
+func closeUnusedInheritedListeners() {
+	inherited.mu.Lock()
+	unused := inherited.listeners
+	inherited.listeners = nil
+	inherited.mu.Unlock()
+
+	for _, listener := range unused {
+		fmt.Println(time.Now().Unix(), "closing unused inherited listener", listener.Addr().Network(), listener.Addr())
+
+		_ = listener.Close()
+	}
+}
+
+func listenerMatches(listener net.Listener, network, address string) bool {
+	switch addr := listener.Addr().(type) {
+	case *net.UnixAddr:
+		return network == "unix" && addr.Name == address
+	case *net.TCPAddr:
+		want, err := net.ResolveTCPAddr(network, address)
+
+		if err != nil || want.Port != addr.Port {
+			return false
+		}
+
+		if want.IP == nil || want.IP.IsUnspecified() {
+			return addr.IP.IsUnspecified()
+		}
+
+		return want.IP.Equal(addr.IP)
+	}
+
+	return false
+}
+
+var readyOnce sync.Once
+
+// notifyUpgradeReady tells the process that started this one through
+// Upgrade that the listeners are serving.
+func notifyUpgradeReady() {
+	readyOnce.Do(func() {
+		fd, err := strconv.Atoi(os.Getenv(UpgradeReadyFDEnv))
+		_ = os.Unsetenv(UpgradeReadyFDEnv)
+
+		if err != nil {
+			return
+		}
+
+		file := os.NewFile(uintptr(fd), "ready")
+		_, _ = file.Write([]byte{1})
+		_ = file.Close()
+	})
+}
@@ -0,0 +1,295 @@
+package final_socks
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveGracefulTest serves a handler that replies and then holds the
+// connection until release is closed.
+func serveGracefulTest(t *testing.T) (server *Server, addr string, release chan struct{}, serveErr chan error) {
+	release = make(chan struct{})
+	server = NewServer("", func(w ResponseWriter, r *Request) {
+		_ = w.SendSucceeded(r.DestAddr)
+		<-release
+	})
+
+	if err := server.SetOption(NoAuthOption()); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serveErr = make(chan error, 1)
+
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	return server, listener.Addr().String(), release, serveErr
+}
+
+// connectTest opens a tunnel through the no auth server at addr.
+func connectTest(t *testing.T, addr string) net.Conn {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte{VersionSocks5, 1, AuthNoAuth, VersionSocks5, CommandConnect, 0, AddressIpv4, 127, 0, 0, 1, 0, 80}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(conn, make([]byte, 2+10)); err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+func TestShutdownDrainsConnections(t *testing.T) {
+	server, addr, release, serveErr := serveGracefulTest(t)
+	conn := connectTest(t, addr)
+	defer conn.Close()
+
+	shutdownErr := make(chan error, 1)
+
+	go func() {
+		shutdownErr <- server.Shutdown(context.Background())
+	}()
+
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Fatalf("Serve = %v, want ErrServerClosed", err)
+	}
+
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Shutdown returned %v with an active connection", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if c, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		_ = c.Close()
+
+		t.Fatal("listener still accepts after Shutdown")
+	}
+
+	close(release)
+
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf("Shutdown = %v", err)
+	}
+}
+
+func TestShutdownDeadlineClosesConnections(t *testing.T) {
+	server, addr, release, _ := serveGracefulTest(t)
+	defer close(release)
+
+	conn := connectTest(t, addr)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown = %v, want context.DeadlineExceeded", err)
+	}
+
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after Shutdown deadline = %v, want io.EOF", err)
+	}
+}
+
+func TestCloseClosesConnections(t *testing.T) {
+	server, addr, release, serveErr := serveGracefulTest(t)
+	defer close(release)
+
+	conn := connectTest(t, addr)
+	defer conn.Close()
+
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-serveErr; err != ErrServerClosed {
+		t.Fatalf("Serve = %v, want ErrServerClosed", err)
+	}
+
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after Close = %v, want io.EOF", err)
+	}
+
+	// closed servers refuse connections handed to them directly
+	client, other := net.Pipe()
+	defer client.Close()
+
+	if err := server.ServeConn(other); err != ErrServerClosed {
+		t.Fatalf("ServeConn = %v, want ErrServerClosed", err)
+	}
+}
+
+// inheritHelperEnv makes TestInheritListenFDsHelper serve, it is the
+// address of the listener it should take from LISTEN_FDS.
+const inheritHelperEnv = "FINAL_SOCKS_TEST_INHERIT_ADDR"
+
+// TestInheritListenFDsHelper is the socket activated process of
+// TestInheritListenFDs.
+func TestInheritListenFDsHelper(t *testing.T) {
+	addr := os.Getenv(inheritHelperEnv)
+
+	if addr == "" {
+		t.Skip("started by TestInheritListenFDs")
+	}
+
+	// systemd sets LISTEN_PID after forking, the parent cannot know it
+	if os.Getenv("LISTEN_PID") == "self" {
+		_ = os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	}
+
+	listeners, err := InheritedListeners()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Printf("inherited %d %q\n", len(listeners), os.Getenv("LISTEN_FDS"))
+
+	if len(listeners) == 0 {
+		return
+	}
+
+	server := NewServer(addr, func(w ResponseWriter, r *Request) {
+		_ = w.SendSucceeded(r.DestAddr)
+	})
+
+	if err := server.SetOption(NoAuthOption()); err != nil {
+		t.Fatal(err)
+	}
+
+	// runs until the parent kills it
+	t.Fatal(server.ListenAndServe())
+}
+
+func TestInheritListenFDs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no fd inheritance on windows")
+	}
+
+	tests := []struct {
+		name      string
+		listenPID string
+		inherited int
+	}{
+		{name: "own pid", listenPID: "self", inherited: 2},
+		{name: "other pid", listenPID: "1", inherited: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			served, served2 := listenInheritTest(t), listenInheritTest(t)
+
+			cmd := exec.Command(os.Args[0], "-test.run=^TestInheritListenFDsHelper$", "-test.v")
+			cmd.ExtraFiles = []*os.File{served.file, served2.file}
+			cmd.Env = append(os.Environ(),
+				inheritHelperEnv+"="+served.addr,
+				"LISTEN_FDS=2",
+				"LISTEN_PID="+test.listenPID,
+			)
+
+			stdout, err := cmd.StdoutPipe()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			defer func() {
+				_ = cmd.Process.Kill()
+				_ = cmd.Wait()
+			}()
+
+			// only the child holds the sockets from here on
+			served.close()
+			served2.close()
+
+			want := fmt.Sprintf("inherited %d \"\"", test.inherited)
+			scanner := bufio.NewScanner(stdout)
+
+			for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "inherited ") {
+			}
+
+			if scanner.Text() != want {
+				t.Fatalf("helper reported %q, want %q", scanner.Text(), want)
+			}
+
+			go func() {
+				_, _ = io.Copy(io.Discard, stdout)
+			}()
+
+			if test.inherited == 0 {
+				return
+			}
+
+			conn := connectTest(t, served.addr)
+			_ = conn.Close()
+
+			// the listener matching no server listener is closed once serving
+			if c, err := net.DialTimeout("tcp", served2.addr, time.Second); err == nil {
+				_ = c.Close()
+
+				t.Fatal("unused inherited listener still accepts")
+			}
+		})
+	}
+}
+
+type inheritTestListener struct {
+	addr     string
+	file     *os.File
+	listener net.Listener
+}
+
+func listenInheritTest(t *testing.T) *inheritTestListener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := listener.(*net.TCPListener).File()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &inheritTestListener{
+		addr:     listener.Addr().String(),
+		file:     file,
+		listener: listener,
+	}
+}
+
+func (l *inheritTestListener) close() {
+	_ = l.file.Close()
+	_ = l.listener.Close()
+}
@@ -0,0 +1,213 @@
+package final_socks
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var DefaultHtpasswdReloadInterval = 5 * time.Second
+
+// HtpasswdFile is a CredentialVerifier backed by an htpasswd compatible file
+// with one "username:hash" entry per line. The file is polled for changes and
+// swapped in as a whole, a file that fails to parse keeps the previous users.
+type HtpasswdFile struct {
+	path    string
+	mu      sync.RWMutex
+	users   map[string]string
+	skipped []string
+	modTime time.Time
+	size    int64
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewHtpasswdFile loads path and reloads it every interval when it changes.
+// A zero interval disables watching, Reload can still be called manually,
+// e.g. on SIGHUP.
+func NewHtpasswdFile(path string, interval time.Duration) (*HtpasswdFile, error) {
+	f := &HtpasswdFile{
+		path:  path,
+		users: map[string]string{},
+		done:  make(chan struct{}),
+	}
+
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+
+	if interval > 0 {
+		go f.watch(interval)
+	}
+
+	return f, nil
+}
+
+func (f *HtpasswdFile) Reload() error {
+	info, err := os.Stat(f.path)
+
+	if err != nil {
+		return errors.Wrap(err, "failed to stat htpasswd file")
+	}
+
+	data, err := os.ReadFile(f.path)
+
+	if err != nil {
+		return errors.Wrap(err, "failed to read htpasswd file")
+	}
+
+	users, skipped, err := ParseHtpasswd(data)
+
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.users = users
+	f.skipped = skipped
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	f.mu.Unlock()
+
+	return nil
+}
+
+// Skipped returns the users whose entries were skipped on the last reload
+// because of an unsupported hash.
+func (f *HtpasswdFile) Skipped() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return append([]string(nil), f.skipped...)
+}
+
+func (f *HtpasswdFile) Close() error {
+	f.once.Do(func() {
+		close(f.done)
+	})
+
+	return nil
+}
+
+func (f *HtpasswdFile) Verify(conn net.Conn, username, password string) (interface{}, error) {
+	f.mu.RLock()
+	hashed, ok := f.users[username]
+	f.mu.RUnlock()
+
+	if !ok {
+		// spend the same time as for a wrong password so response timing
+		// does not tell which usernames exist
+		_, _ = CheckPasswordHash(dummyPasswordHash(), password)
+
+		return nil, ErrUserNotFound
+	}
+
+	match, err := CheckPasswordHash(hashed, password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !match {
+		return nil, errors.New("invalid password")
+	}
+
+	return &Identity{Name: username}, nil
+}
+
+func (f *HtpasswdFile) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !f.changed() {
+				continue
+			}
+
+			if err := f.Reload(); err != nil {
+				fmt.Println(time.Now().Unix(), "htpasswd reload failed", err)
+			}
+		case <-f.done:
+			return
+		}
+	}
+}
+
+func (f *HtpasswdFile) changed() bool {
+	info, err := os.Stat(f.path)
+
+	if err != nil {
+		return false
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return !info.ModTime().Equal(f.modTime) || info.Size() != f.size
+}
+
+// ParseHtpasswd parses htpasswd file contents. Blank lines and lines starting
+// with # are ignored, entries with unsupported hashes, e.g. $apr1$ or {SHA},
+// are left out of users and their usernames returned in skipped.
+func ParseHtpasswd(data []byte) (users map[string]string, skipped []string, err error) {
+	users = map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		username, hashed, ok := strings.Cut(text, ":")
+
+		if !ok || username == "" {
+			return nil, nil, fmt.Errorf("malformed htpasswd entry on line %d", line)
+		}
+
+		if !isSupportedHash(hashed) {
+			skipped = append(skipped, username)
+
+			continue
+		}
+
+		users[username] = hashed
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse htpasswd file")
+	}
+
+	return users, skipped, nil
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// dummyPasswordHash is compared against for unknown users.
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		hashed, err := bcrypt.GenerateFromPassword([]byte("final-socks"), bcrypt.DefaultCost)
+
+		if err == nil {
+			dummyHash = string(hashed)
+		}
+	})
+
+	return dummyHash
+}
@@ -0,0 +1,104 @@
+package final_socks
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const htpasswdAlice = "alice:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5\n" // Hello world!
+
+func TestParseHtpasswd(t *testing.T) {
+	data := "# comment\n\n" + htpasswdAlice +
+		"bob:$apr1$salt$hash\n" +
+		"carol:{SHA}hash\n"
+
+	users, skipped, err := ParseHtpasswd([]byte(data))
+
+	if err != nil {
+		t.Fatalf("ParseHtpasswd: %v", err)
+	}
+
+	if len(users) != 1 || users["alice"] == "" {
+		t.Fatalf("unexpected users: %v", users)
+	}
+
+	if !reflect.DeepEqual(skipped, []string{"bob", "carol"}) {
+		t.Fatalf("unexpected skipped: %v", skipped)
+	}
+
+	for _, malformed := range []string{"alice\n", ":$5$salt$hash\n"} {
+		if _, _, err := ParseHtpasswd([]byte(malformed)); err == nil {
+			t.Errorf("%q: accepted a malformed entry", malformed)
+		}
+	}
+}
+
+func writeHtpasswd(t *testing.T, path, data string) {
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("write htpasswd: %v", err)
+	}
+}
+
+func TestHtpasswdFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, htpasswdAlice+"bob:$apr1$salt$hash\n")
+
+	file, err := NewHtpasswdFile(path, 10*time.Millisecond)
+
+	if err != nil {
+		t.Fatalf("NewHtpasswdFile: %v", err)
+	}
+
+	defer file.Close()
+
+	if _, err := file.Verify(nil, "alice", "Hello world!"); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	if _, err := file.Verify(nil, "bob", "secret"); err != ErrUserNotFound {
+		t.Fatalf("Verify skipped user: got %v, want %v", err, ErrUserNotFound)
+	}
+
+	if skipped := file.Skipped(); !reflect.DeepEqual(skipped, []string{"bob"}) {
+		t.Fatalf("unexpected skipped: %v", skipped)
+	}
+
+	// a file that fails to parse keeps the previous users
+	writeHtpasswd(t, path, "malformed\n")
+
+	if err := file.Reload(); err == nil {
+		t.Fatal("Reload accepted a malformed file")
+	}
+
+	if _, err := file.Verify(nil, "alice", "Hello world!"); err != nil {
+		t.Fatalf("Verify after failed reload: %v", err)
+	}
+
+	// the watcher picks up the changed file
+	writeHtpasswd(t, path, "dave:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1\n")
+
+	deadline := time.Now().Add(2 * time.Second)
+
+	for {
+		if _, err := file.Verify(nil, "dave", "Hello world!"); err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("watcher did not reload the file")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := file.Verify(nil, "alice", "Hello world!"); err != ErrUserNotFound {
+		t.Fatalf("Verify removed user: got %v, want %v", err, ErrUserNotFound)
+	}
+
+	if skipped := file.Skipped(); len(skipped) != 0 {
+		t.Fatalf("unexpected skipped: %v", skipped)
+	}
+}
@@ -0,0 +1,41 @@
+package final_socks
+
+import (
+	"net"
+	"time"
+)
+
+// Identity is the authenticated user attached to Request.User by the
+// built-in auth backends. Backends fill in the policy attributes they know.
+type Identity struct {
+	Name string `json:"name"`
+	// RateLimit caps each tunnel and UDP association of the user in bytes
+	// per second, both directions together. Datagrams over the limit are
+	// dropped.
+	RateLimit int64    `json:"rate_limit,omitempty"`
+	EgressIP  net.IP   `json:"egress_ip,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	// AllowedDestinations restricts CONNECT targets and the destinations
+	// of UDP datagrams when not empty, see AddrSpec.Matches for the pattern
+	// syntax.
+	AllowedDestinations []string  `json:"allowed_destinations,omitempty"`
+	ExpiresAt           time.Time `json:"expires_at"`
+	// UDPNAT overrides the NAT mode of the server for the user.
+	UDPNAT UDPNATMode `json:"udp_nat,omitempty"`
+}
+
+// AllowsDestination matches addr against AllowedDestinations, see
+// AddrSpec.Matches for the pattern syntax.
+func (i *Identity) AllowsDestination(addr *AddrSpec) bool {
+	if len(i.AllowedDestinations) == 0 {
+		return true
+	}
+
+	for _, pattern := range i.AllowedDestinations {
+		if addr.Matches(pattern) {
+			return true
+		}
+	}
+
+	return false
+}
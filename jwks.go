@@ -0,0 +1,298 @@
+package final_socks
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// JWKS is a JSON Web Key Set loaded from a file or URL and refreshed in the
+// background.
+type JWKS struct {
+	file        string
+	url         string
+	client      *http.Client
+	mu          sync.RWMutex
+	keys        map[string]crypto.PublicKey
+	lastRefresh time.Time
+	done        chan struct{}
+	once        sync.Once
+}
+
+// NewJWKS loads the key set from file, or from url when file is empty, and
+// reloads it every interval. A zero interval disables periodic reloads.
+func NewJWKS(file, url string, interval time.Duration, client *http.Client) (*JWKS, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	j := &JWKS{
+		file:   file,
+		url:    url,
+		client: client,
+		keys:   map[string]crypto.PublicKey{},
+		done:   make(chan struct{}),
+	}
+
+	if err := j.Refresh(); err != nil {
+		return nil, err
+	}
+
+	if interval > 0 {
+		go j.watch(interval)
+	}
+
+	return j, nil
+}
+
+func (j *JWKS) Refresh() error {
+	var data []byte
+	var err error
+
+	if j.file != "" {
+		data, err = os.ReadFile(j.file)
+	} else {
+		data, err = j.fetch()
+	}
+
+	if err != nil {
+		return errors.Wrap(err, "failed to load jwks")
+	}
+
+	keys, err := ParseJWKS(data)
+
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	j.keys = keys
+	j.lastRefresh = time.Now()
+	j.mu.Unlock()
+
+	return nil
+}
+
+// Key returns the key for kid. An unknown kid triggers a refresh, at most
+// once a minute, to pick up rotated keys early.
+func (j *JWKS) Key(kid string) (crypto.PublicKey, error) {
+	j.mu.Lock()
+	key, ok := j.keys[kid]
+	stale := !ok && time.Since(j.lastRefresh) > time.Minute
+
+	if stale {
+		j.lastRefresh = time.Now()
+	}
+
+	j.mu.Unlock()
+
+	if ok {
+		return key, nil
+	}
+
+	if stale {
+		if err := j.Refresh(); err != nil {
+			return nil, err
+		}
+
+		j.mu.RLock()
+		key, ok = j.keys[kid]
+		j.mu.RUnlock()
+
+		if ok {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown jwt key: %q", kid)
+}
+
+func (j *JWKS) Close() error {
+	j.once.Do(func() {
+		close(j.done)
+	})
+
+	return nil
+}
+
+func (j *JWKS) fetch() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := j.client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks url returned status %d", resp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+func (j *JWKS) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := j.Refresh(); err != nil {
+				fmt.Println(time.Now().Unix(), "jwks refresh failed", err)
+			}
+		case <-j.done:
+			return
+		}
+	}
+}
+
+// ParseJWKS parses the RSA, EC and Ed25519 signing keys of a key set. Keys
+// of other types or curves are skipped, so one new key the server can not
+// use does not break the others, only a set without any usable key fails.
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, errors.Wrap(err, "failed to parse jwks")
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	var skipped error
+
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+
+		if err != nil {
+			skipped = errors.Wrapf(err, "invalid jwk %q", jwk.Kid)
+
+			continue
+		}
+
+		keys[jwk.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		if skipped != nil {
+			return nil, errors.Wrap(skipped, "no usable key in jwks")
+		}
+
+		return nil, errors.New("no usable key in jwks")
+	}
+
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeJWKInt(k.E)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %v", k.Crv)
+		}
+
+		x, err := decodeJWKInt(k.X)
+
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeJWKInt(k.Y)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("ec point not on curve")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve: %v", k.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key")
+		}
+
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type: %v", k.Kty)
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid jwk integer")
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
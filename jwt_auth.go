@@ -0,0 +1,318 @@
+package final_socks
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type JWTAuthConfig struct {
+	// JWKSFile or JWKSURL holds the signing keys, the file wins if both are set.
+	JWKSFile        string
+	JWKSURL         string
+	RefreshInterval time.Duration
+	Issuer          string
+	Audience        string
+	Leeway          time.Duration
+	// MatchUsername requires the SOCKS username to equal the identity name,
+	// otherwise the username is ignored.
+	MatchUsername bool
+	// Claims mapped onto the Identity, UsernameClaim defaults to "sub".
+	UsernameClaim     string
+	TagsClaim         string
+	RateLimitClaim    string
+	EgressIPClaim     string
+	DestinationsClaim string
+}
+
+// JWTAuth is a CredentialVerifier accepting a JWT as password. Note that
+// RFC 1929 limits the password to 255 bytes, which only fits compact
+// tokens, e.g. ES256 or EdDSA signed with few claims.
+type JWTAuth struct {
+	config JWTAuthConfig
+	keys   *JWKS
+}
+
+func NewJWTAuth(config JWTAuthConfig) (*JWTAuth, error) {
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "sub"
+	}
+
+	if config.RefreshInterval == 0 && config.JWKSFile == "" {
+		config.RefreshInterval = time.Hour
+	}
+
+	keys, err := NewJWKS(config.JWKSFile, config.JWKSURL, config.RefreshInterval, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &JWTAuth{
+		config: config,
+		keys:   keys,
+	}, nil
+}
+
+// Close stops refreshing the key set.
+func (a *JWTAuth) Close() error {
+	return a.keys.Close()
+}
+
+func (a *JWTAuth) Verify(conn net.Conn, username, password string) (interface{}, error) {
+	claims, err := a.ParseToken(password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := a.identity(claims)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if a.config.MatchUsername && identity.Name != username {
+		return nil, errors.New("jwt subject does not match username")
+	}
+
+	return identity, nil
+}
+
+// ParseToken verifies the signature, exp, nbf, iss and aud of token and
+// returns its claims.
+func (a *JWTAuth) ParseToken(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 3 {
+		return nil, errors.New("malformed jwt")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, errors.Wrap(err, "malformed jwt header")
+	}
+
+	key, err := a.keys.Key(header.Kid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed jwt signature")
+	}
+
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{}
+
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, errors.Wrap(err, "malformed jwt claims")
+	}
+
+	if err := a.validateClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (a *JWTAuth) validateClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+
+	if !ok {
+		return errors.New("jwt has no exp")
+	}
+
+	if now.After(time.Unix(int64(exp), 0).Add(a.config.Leeway)) {
+		return errors.New("jwt expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.config.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("jwt not valid yet")
+	}
+
+	if a.config.Issuer != "" && claims["iss"] != a.config.Issuer {
+		return fmt.Errorf("unexpected jwt issuer: %v", claims["iss"])
+	}
+
+	if a.config.Audience != "" && !containsString(claimStrings(claims["aud"]), a.config.Audience) {
+		return fmt.Errorf("unexpected jwt audience: %v", claims["aud"])
+	}
+
+	return nil
+}
+
+func (a *JWTAuth) identity(claims map[string]interface{}) (*Identity, error) {
+	name, _ := claims[a.config.UsernameClaim].(string)
+
+	if name == "" {
+		return nil, fmt.Errorf("jwt has no %v claim", a.config.UsernameClaim)
+	}
+
+	identity := &Identity{Name: name}
+
+	if exp, ok := claims["exp"].(float64); ok {
+		identity.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+
+	if a.config.TagsClaim != "" {
+		identity.Tags = claimStrings(claims[a.config.TagsClaim])
+	}
+
+	if a.config.DestinationsClaim != "" {
+		identity.AllowedDestinations = claimStrings(claims[a.config.DestinationsClaim])
+	}
+
+	if a.config.RateLimitClaim != "" {
+		if limit, ok := claims[a.config.RateLimitClaim].(float64); ok {
+			identity.RateLimit = int64(limit)
+		}
+	}
+
+	if a.config.EgressIPClaim != "" {
+		if ip, ok := claims[a.config.EgressIPClaim].(string); ok {
+			identity.EgressIP = net.ParseIP(ip)
+		}
+	}
+
+	return identity, nil
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		if pub, ok := key.(ed25519.PublicKey); ok && ed25519.Verify(pub, signed, sig) {
+			return nil
+		}
+
+		return errors.New("invalid jwt signature")
+	default:
+		return fmt.Errorf("unsupported jwt algorithm: %q", alg)
+	}
+
+	digest := jwtDigest(hash, signed)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+
+		if alg[0] == 'P' {
+			err = rsa.VerifyPSS(pub, hash, digest, sig, nil)
+		} else if alg[0] == 'R' {
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		} else {
+			err = errors.New("key type mismatch")
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "invalid jwt signature")
+		}
+
+		return nil
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+
+		if alg[0] != 'E' || len(sig) != 2*size {
+			return errors.New("invalid jwt signature")
+		}
+
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid jwt signature")
+		}
+
+		return nil
+	}
+
+	return errors.New("key type mismatch")
+}
+
+func jwtDigest(hash crypto.Hash, data []byte) []byte {
+	switch hash {
+	case crypto.SHA384:
+		sum := sha512.Sum384(data)
+
+		return sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(data)
+
+		return sum[:]
+	}
+
+	sum := sha256.Sum256(data)
+
+	return sum[:]
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// claimStrings reads a claim that is either a string or a list of strings.
+func claimStrings(v interface{}) []string {
+	switch value := v.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		out := make([]string, 0, len(value))
+
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+
+		return out
+	}
+
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,276 @@
+package final_socks
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type jwtTestKeys struct {
+	rsa      *rsa.PrivateKey
+	ec       *ecdsa.PrivateKey
+	otherRSA *rsa.PrivateKey
+	otherEC  *ecdsa.PrivateKey
+}
+
+func newJWTTestKeys(t *testing.T) *jwtTestKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherRSA, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherEC, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &jwtTestKeys{rsa: rsaKey, ec: ecKey, otherRSA: otherRSA, otherEC: otherEC}
+}
+
+// writeJWKS writes the public rsa and ec keys as "rsa-1" and "ec-1".
+func (k *jwtTestKeys) writeJWKS(t *testing.T) string {
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	size := (k.ec.Curve.Params().BitSize + 7) / 8
+
+	set := map[string][]jsonWebKey{
+		"keys": {
+			{
+				Kty: "RSA",
+				Kid: "rsa-1",
+				Use: "sig",
+				N:   b64(k.rsa.N.Bytes()),
+				E:   b64(big.NewInt(int64(k.rsa.E)).Bytes()),
+			},
+			{
+				Kty: "EC",
+				Kid: "ec-1",
+				Crv: "P-256",
+				X:   b64(k.ec.X.FillBytes(make([]byte, size))),
+				Y:   b64(k.ec.Y.FillBytes(make([]byte, size))),
+			},
+		},
+	}
+
+	data, err := json.Marshal(set)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTAuth(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	auth, err := NewJWTAuth(JWTAuthConfig{
+		JWKSFile:       keys.writeJWKS(t),
+		Issuer:         "https://issuer.example",
+		Audience:       "socks",
+		RateLimitClaim: "bw",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer auth.Close()
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "alice",
+			"iss": "https://issuer.example",
+			"aud": []string{"other", "socks"},
+			"exp": time.Now().Add(time.Minute).Unix(),
+			"bw":  2048,
+		}
+
+		for k, v := range overrides {
+			c[k] = v
+		}
+
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		allowed bool
+	}{
+		{name: "rsa", token: signJWT(t, "RS256", "rsa-1", keys.rsa, claims(nil)), allowed: true},
+		{name: "ec", token: signJWT(t, "ES256", "ec-1", keys.ec, claims(nil)), allowed: true},
+		{name: "expired", token: signJWT(t, "RS256", "rsa-1", keys.rsa, claims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()}))},
+		{name: "no exp", token: signJWT(t, "RS256", "rsa-1", keys.rsa, claims(map[string]interface{}{"exp": nil}))},
+		{name: "wrong audience", token: signJWT(t, "ES256", "ec-1", keys.ec, claims(map[string]interface{}{"aud": "other"}))},
+		{name: "wrong issuer", token: signJWT(t, "ES256", "ec-1", keys.ec, claims(map[string]interface{}{"iss": "https://evil.example"}))},
+		{name: "unknown kid", token: signJWT(t, "RS256", "rsa-2", keys.rsa, claims(nil))},
+		{name: "bad rsa signature", token: signJWT(t, "RS256", "rsa-1", keys.otherRSA, claims(nil))},
+		{name: "bad ec signature", token: signJWT(t, "ES256", "ec-1", keys.otherEC, claims(nil))},
+		{name: "algorithm mismatch", token: signJWT(t, "ES256", "rsa-1", keys.ec, claims(nil))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, err := auth.Verify(nil, "ignored", test.token)
+
+			if allowed := err == nil; allowed != test.allowed {
+				t.Fatalf("allowed = %v, want %v (err %v)", allowed, test.allowed, err)
+			}
+
+			if !test.allowed {
+				return
+			}
+
+			identity := user.(*Identity)
+
+			if identity.Name != "alice" || identity.RateLimit != 2048 {
+				t.Fatalf("unexpected identity: %+v", identity)
+			}
+		})
+	}
+}
+
+func TestJWTAuthTamperedClaims(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	auth, err := NewJWTAuth(JWTAuthConfig{JWKSFile: keys.writeJWKS(t)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer auth.Close()
+
+	token := signJWT(t, "RS256", "rsa-1", keys.rsa, map[string]interface{}{
+		"sub": "alice",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+
+	forged, _ := json.Marshal(map[string]interface{}{"sub": "root", "exp": time.Now().Add(time.Minute).Unix()})
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2]
+
+	if _, err := auth.Verify(nil, "root", tampered); err == nil {
+		t.Fatal("expected tampered claims to be refused")
+	}
+}
+
+func TestParseJWKSSkipsUnusableKeys(t *testing.T) {
+	ed := base64.RawURLEncoding.EncodeToString(make([]byte, 32))
+
+	tests := []struct {
+		name string
+		set  string
+		kids []string
+	}{
+		{
+			name: "unsupported kty",
+			set:  `{"keys": [{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"}, {"kty": "OKP", "kid": "ed-1", "crv": "Ed25519", "x": "` + ed + `"}]}`,
+			kids: []string{"ed-1"},
+		},
+		{
+			name: "unsupported curve",
+			set:  `{"keys": [{"kty": "OKP", "kid": "x-1", "crv": "X25519", "x": "` + ed + `"}, {"kty": "EC", "kid": "ec-1", "crv": "secp256k1", "x": "AQ", "y": "AQ"}, {"kty": "OKP", "kid": "ed-1", "crv": "Ed25519", "x": "` + ed + `"}]}`,
+			kids: []string{"ed-1"},
+		},
+		{
+			name: "encryption key",
+			set:  `{"keys": [{"kty": "OKP", "kid": "ed-enc", "use": "enc", "crv": "Ed25519", "x": "` + ed + `"}, {"kty": "OKP", "kid": "ed-1", "crv": "Ed25519", "x": "` + ed + `"}]}`,
+			kids: []string{"ed-1"},
+		},
+		{
+			name: "no usable key",
+			set:  `{"keys": [{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"}]}`,
+		},
+		{
+			name: "empty set",
+			set:  `{"keys": []}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys, err := ParseJWKS([]byte(test.set))
+
+			if len(test.kids) == 0 {
+				if err == nil {
+					t.Fatalf("accepted a set without usable keys: %v", keys)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ParseJWKS: %v", err)
+			}
+
+			if len(keys) != len(test.kids) {
+				t.Fatalf("got %d keys, want %v", len(keys), test.kids)
+			}
+
+			for _, kid := range test.kids {
+				if keys[kid] == nil {
+					t.Fatalf("missing key %q", kid)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package final_socks
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/pkg/errors"
+)
+
+type LDAPAuthConfig struct {
+	// URL of the directory, ldap://host:389 or ldaps://host:636.
+	URL       string
+	StartTLS  bool
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+	// UserDNTemplate binds directly as the user, e.g.
+	// "uid=%s,ou=people,dc=example,dc=com". When empty the user DN is looked
+	// up under BaseDN with UserFilter, bound as BindDN if set.
+	UserDNTemplate string
+	BindDN         string
+	BindPassword   string
+	BaseDN         string
+	UserFilter     string
+	// RequiredGroup is the DN of a group the user has to be a member of,
+	// checked with GroupFilter against the user DN.
+	RequiredGroup string
+	GroupFilter   string
+	// CacheTTL keeps successful binds, zero disables caching.
+	CacheTTL time.Duration
+}
+
+// LDAPAuth is a CredentialVerifier that performs an LDAP simple bind with
+// the client credentials.
+type LDAPAuth struct {
+	config LDAPAuthConfig
+	cache  *credentialCache
+}
+
+func NewLDAPAuth(config LDAPAuthConfig) *LDAPAuth {
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	if config.UserFilter == "" {
+		config.UserFilter = "(uid=%s)"
+	}
+
+	if config.GroupFilter == "" {
+		config.GroupFilter = "(|(member=%s)(uniqueMember=%s))"
+	}
+
+	return &LDAPAuth{
+		config: config,
+		cache:  newCredentialCache(config.CacheTTL),
+	}
+}
+
+func (a *LDAPAuth) Verify(conn net.Conn, username, password string) (interface{}, error) {
+	// an empty password would be an unauthenticated bind, which succeeds
+	if username == "" || password == "" {
+		return nil, errors.New("empty username or password")
+	}
+
+	key := credentialCacheKey(username, password)
+
+	if identity, ok := a.cache.get(key); ok {
+		return identity, nil
+	}
+
+	l, err := a.dial()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer l.Close()
+
+	userDN, err := a.userDN(l, username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.Bind(userDN, password); err != nil {
+		return nil, errors.Wrap(err, "ldap bind failed")
+	}
+
+	identity := &Identity{Name: username}
+
+	if a.config.RequiredGroup != "" {
+		if err := a.checkGroup(l, userDN); err != nil {
+			return nil, err
+		}
+
+		identity.Tags = []string{a.config.RequiredGroup}
+	}
+
+	a.cache.put(key, identity)
+
+	return identity, nil
+}
+
+func (a *LDAPAuth) dial() (*ldap.Conn, error) {
+	l, err := ldap.DialURL(
+		a.config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.config.Timeout}),
+		ldap.DialWithTLSConfig(a.config.TLSConfig),
+	)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to ldap")
+	}
+
+	l.SetTimeout(a.config.Timeout)
+
+	if a.config.StartTLS {
+		tlsConfig := a.config.TLSConfig
+
+		if tlsConfig == nil {
+			u, err := url.Parse(a.config.URL)
+
+			if err != nil {
+				l.Close()
+
+				return nil, errors.Wrap(err, "invalid ldap url")
+			}
+
+			tlsConfig = &tls.Config{ServerName: u.Hostname()}
+		}
+
+		if err := l.StartTLS(tlsConfig); err != nil {
+			l.Close()
+
+			return nil, errors.Wrap(err, "ldap starttls failed")
+		}
+	}
+
+	return l, nil
+}
+
+func (a *LDAPAuth) userDN(l *ldap.Conn, username string) (string, error) {
+	if a.config.UserDNTemplate != "" {
+		return fmt.Sprintf(a.config.UserDNTemplate, escapeLDAPDN(username)), nil
+	}
+
+	if a.config.BindDN != "" {
+		if err := l.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+			return "", errors.Wrap(err, "ldap service bind failed")
+		}
+	}
+
+	result, err := l.Search(ldap.NewSearchRequest(
+		a.config.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		int(a.config.Timeout.Seconds()),
+		false,
+		strings.ReplaceAll(a.config.UserFilter, "%s", ldap.EscapeFilter(username)),
+		[]string{"dn"},
+		nil,
+	))
+
+	if err != nil {
+		return "", errors.Wrap(err, "ldap user search failed")
+	}
+
+	if len(result.Entries) != 1 {
+		return "", fmt.Errorf("ldap user search returned %d entries", len(result.Entries))
+	}
+
+	return result.Entries[0].DN, nil
+}
+
+func (a *LDAPAuth) checkGroup(l *ldap.Conn, userDN string) error {
+	result, err := l.Search(ldap.NewSearchRequest(
+		a.config.RequiredGroup,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		1,
+		int(a.config.Timeout.Seconds()),
+		false,
+		strings.ReplaceAll(a.config.GroupFilter, "%s", ldap.EscapeFilter(userDN)),
+		[]string{"dn"},
+		nil,
+	))
+
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return errors.Wrap(err, "ldap group search failed")
+	}
+
+	if result == nil || len(result.Entries) == 0 {
+		return errors.New("user is not a member of the required group")
+	}
+
+	return nil
+}
+
+// escapeLDAPDN escapes an attribute value for use in a DN, RFC 4514 2.4.
+func escapeLDAPDN(value string) string {
+	var out strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+
+		switch {
+		case c == 0:
+			out.WriteString("\\00")
+			continue
+		case strings.IndexByte(",+\"\\<>;=", c) >= 0,
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(value)-1 && c == ' ':
+			out.WriteByte('\\')
+		}
+
+		out.WriteByte(c)
+	}
+
+	return out.String()
+}
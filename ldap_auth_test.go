@@ -0,0 +1,246 @@
+package final_socks
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	ldapAliceDN   = "uid=alice,ou=people,dc=example,dc=com"
+	ldapBobDN     = "uid=bob,ou=people,dc=example,dc=com"
+	ldapServiceDN = "cn=proxy,dc=example,dc=com"
+	ldapGroupDN   = "cn=socks,ou=groups,dc=example,dc=com"
+)
+
+// ldapStandIn is a minimal in-process directory answering the simple binds
+// and searches LDAPAuth sends.
+type ldapStandIn struct {
+	listener  net.Listener
+	passwords map[string]string
+	members   map[string]bool
+	binds     atomic.Int64
+}
+
+func newLDAPStandIn(t *testing.T) *ldapStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &ldapStandIn{
+		listener: listener,
+		passwords: map[string]string{
+			ldapAliceDN:   "secret",
+			ldapBobDN:     "hunter2",
+			ldapServiceDN: "service",
+		},
+		members: map[string]bool{ldapAliceDN: true},
+	}
+
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go d.serve(conn)
+		}
+	}()
+
+	return d
+}
+
+func (d *ldapStandIn) URL() string {
+	return "ldap://" + d.listener.Addr().String()
+}
+
+func (d *ldapStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			d.binds.Add(1)
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := ldap.LDAPResultInvalidCredentials
+
+			if expected, ok := d.passwords[dn]; ok && password != "" && password == expected {
+				code = ldap.LDAPResultSuccess
+			}
+
+			d.reply(conn, id, ldap.ApplicationBindResponse, code)
+		case ldap.ApplicationSearchRequest:
+			base := op.Children[0].Value.(string)
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+
+			for _, dn := range d.search(base, filter) {
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+				entry.AppendChild(ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, ""))
+				d.write(conn, id, entry)
+			}
+
+			d.reply(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+		default:
+			return
+		}
+	}
+}
+
+func (d *ldapStandIn) search(base, filter string) []string {
+	if base == ldapGroupDN {
+		for dn := range d.members {
+			if strings.Contains(filter, "(member="+dn+")") {
+				return []string{ldapGroupDN}
+			}
+		}
+
+		return nil
+	}
+
+	for dn := range d.passwords {
+		if strings.HasSuffix(dn, ","+base) && "(uid="+strings.TrimPrefix(strings.Split(dn, ",")[0], "uid=")+")" == filter {
+			return []string{dn}
+		}
+	}
+
+	return nil
+}
+
+func (d *ldapStandIn) reply(conn net.Conn, id int64, tag ber.Tag, code int) {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	d.write(conn, id, result)
+}
+
+func (d *ldapStandIn) write(conn net.Conn, id int64, op *ber.Packet) {
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	message.AppendChild(op)
+	_, _ = conn.Write(message.Bytes())
+}
+
+func TestLDAPAuth(t *testing.T) {
+	d := newLDAPStandIn(t)
+
+	tests := []struct {
+		name     string
+		config   LDAPAuthConfig
+		username string
+		password string
+		allowed  bool
+	}{
+		{
+			name:     "template bind",
+			config:   LDAPAuthConfig{UserDNTemplate: "uid=%s,ou=people,dc=example,dc=com"},
+			username: "alice",
+			password: "secret",
+			allowed:  true,
+		},
+		{
+			name:     "template wrong password",
+			config:   LDAPAuthConfig{UserDNTemplate: "uid=%s,ou=people,dc=example,dc=com"},
+			username: "alice",
+			password: "wrong",
+		},
+		{
+			name:     "empty password",
+			config:   LDAPAuthConfig{UserDNTemplate: "uid=%s,ou=people,dc=example,dc=com"},
+			username: "alice",
+		},
+		{
+			name:     "search as service",
+			config:   LDAPAuthConfig{BindDN: ldapServiceDN, BindPassword: "service", BaseDN: "ou=people,dc=example,dc=com"},
+			username: "bob",
+			password: "hunter2",
+			allowed:  true,
+		},
+		{
+			name:     "search unknown user",
+			config:   LDAPAuthConfig{BindDN: ldapServiceDN, BindPassword: "service", BaseDN: "ou=people,dc=example,dc=com"},
+			username: "mallory",
+			password: "secret",
+		},
+		{
+			name:     "group member",
+			config:   LDAPAuthConfig{UserDNTemplate: "uid=%s,ou=people,dc=example,dc=com", RequiredGroup: ldapGroupDN},
+			username: "alice",
+			password: "secret",
+			allowed:  true,
+		},
+		{
+			name:     "not a group member",
+			config:   LDAPAuthConfig{UserDNTemplate: "uid=%s,ou=people,dc=example,dc=com", RequiredGroup: ldapGroupDN},
+			username: "bob",
+			password: "hunter2",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.URL = d.URL()
+			user, err := NewLDAPAuth(test.config).Verify(nil, test.username, test.password)
+
+			if allowed := err == nil; allowed != test.allowed {
+				t.Fatalf("allowed = %v, want %v (err %v)", allowed, test.allowed, err)
+			}
+
+			if test.allowed && user.(*Identity).Name != test.username {
+				t.Fatalf("unexpected identity: %+v", user)
+			}
+		})
+	}
+}
+
+func TestLDAPAuthCache(t *testing.T) {
+	d := newLDAPStandIn(t)
+	auth := NewLDAPAuth(LDAPAuthConfig{
+		URL:            d.URL(),
+		UserDNTemplate: "uid=%s,ou=people,dc=example,dc=com",
+		CacheTTL:       time.Minute,
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := auth.Verify(nil, "alice", "secret"); err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+	}
+
+	if n := d.binds.Load(); n != 1 {
+		t.Fatalf("expected 1 bind with caching, got %d", n)
+	}
+
+	// failed binds are not cached
+	for i := 0; i < 2; i++ {
+		if _, err := auth.Verify(nil, "alice", "wrong"); err == nil {
+			t.Fatal("expected wrong password to be denied")
+		}
+	}
+
+	if n := d.binds.Load(); n != 3 {
+		t.Fatalf("expected failed binds to reach the directory, got %d binds", n)
+	}
+}
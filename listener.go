@@ -0,0 +1,172 @@
+package final_socks
+
+import (
+	"net"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ListenerConfig is an additional listener of a Server. Its Options apply
+// on top of the server settings for this listener only, auth options
+// replace the server auth handlers instead of adding to them.
+type ListenerConfig struct {
+	// Network is "tcp", "tcp4", "tcp6" or "unix".
+	Network string
+	Address string
+	// Listener is used instead of listening on Address when set.
+	Listener net.Listener
+	Options  []Option
+}
+
+// AddListener makes ListenAndServe listen on address too. Once a listener
+// is added the server address is no longer listened on by itself, add it
+// as a listener as well to keep it.
+func (s *Server) AddListener(network, address string, options ...Option) {
+	s.listeners = append(s.listeners, ListenerConfig{
+		Network: network,
+		Address: address,
+		Options: options,
+	})
+}
+
+// AddNetListener makes ListenAndServe serve an already open listener, e.g.
+// one of InheritedListeners.
+func (s *Server) AddNetListener(listener net.Listener, options ...Option) {
+	s.listeners = append(s.listeners, ListenerConfig{
+		Network:  listener.Addr().Network(),
+		Address:  listener.Addr().String(),
+		Listener: listener,
+		Options:  options,
+	})
+}
+
+// forListener returns a copy of s with the listener options applied, the
+// handler and everything behind pointers stays shared.
+func (s *Server) forListener(config ListenerConfig) (*Server, error) {
+	if len(config.Options) == 0 {
+		return s, nil
+	}
+
+	listenerServer := *s
+	listenerServer.listeners = nil
+	listenerServer.AuthHandlers = map[uint8]AuthHandler{}
+
+	for _, option := range config.Options {
+		if err := option(&listenerServer); err != nil {
+			return nil, errors.Wrapf(err, "invalid options for %v listener %v", config.Network, config.Address)
+		}
+	}
+
+	if len(listenerServer.AuthHandlers) == 0 {
+		for method, handler := range s.AuthHandlers {
+			listenerServer.AuthHandlers[method] = handler
+		}
+	}
+
+	return &listenerServer, nil
+}
+
+func (s *Server) serveListeners() error {
+	configs := s.listeners
+
+	if len(configs) == 0 {
+		configs = []ListenerConfig{{Network: "tcp", Address: s.addr}}
+	}
+
+	servers := make([]*Server, 0, len(configs))
+	listeners := make([]net.Listener, 0, len(configs))
+
+	closeAll := func() {
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+	}
+
+	for _, config := range configs {
+		listenerServer, err := s.forListener(config)
+
+		if err != nil {
+			closeAll()
+
+			return err
+		}
+
+		configListeners := []net.Listener{config.Listener}
+
+		if config.Listener == nil {
+			configListeners, err = listen(config.Network, config.Address, listenerServer.reusePortAcceptors)
+		} else {
+			takeInheritedListener(config.Listener)
+		}
+
+		if err != nil {
+			closeAll()
+
+			return err
+		}
+
+		for _, listener := range configListeners {
+			servers = append(servers, listenerServer)
+			listeners = append(listeners, listener)
+		}
+	}
+
+	closeUnusedInheritedListeners()
+	notifyUpgradeReady()
+
+	errChan := make(chan error, len(listeners))
+	wg := sync.WaitGroup{}
+
+	for i := range listeners {
+		wg.Add(1)
+
+		go func(server *Server, listener net.Listener) {
+			defer wg.Done()
+
+			errChan <- server.Serve(listener)
+		}(servers[i], listeners[i])
+	}
+
+	err := <-errChan
+
+	closeAll()
+	wg.Wait()
+
+	return err
+}
+
+// listen takes over the inherited listeners bound to address, otherwise it
+// removes a stale unix socket left behind by a previous run before
+// listening on it. More than one acceptor opens that many SO_REUSEPORT
+// sockets on TCP.
+func listen(network, address string, acceptors int) ([]net.Listener, error) {
+	if listeners := takeInheritedListeners(network, address); len(listeners) > 0 {
+		return listeners, nil
+	}
+
+	if acceptors > 1 && network != "unix" {
+		return listenReusePort(network, address, acceptors)
+	}
+
+	if network == "unix" {
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", address); err == nil {
+				_ = conn.Close()
+
+				return nil, errors.Errorf("unix socket %v is in use", address)
+			}
+
+			_ = os.Remove(address)
+		}
+	}
+
+	listener, err := net.Listen(network, address)
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen on %v %v", network, address)
+	}
+
+	return []net.Listener{listener}, nil
+}
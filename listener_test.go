@@ -0,0 +1,86 @@
+package final_socks
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenerAuthOptions(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unixListener, err := net.Listen("unix", filepath.Join(t.TempDir(), "socks.sock"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer("", func(w ResponseWriter, r *Request) {
+		_ = w.SendSucceeded(r.DestAddr)
+	})
+
+	// the listener auth options replace the server no auth handler
+	if err := server.SetOption(NoAuthOption()); err != nil {
+		t.Fatal(err)
+	}
+
+	server.AddNetListener(tcpListener, UserPassAuth("alice", "secret"))
+	server.AddNetListener(unixListener, UserPassAuth("bob", "secret"))
+
+	serveErr := make(chan error, 1)
+
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	defer func() {
+		_ = server.Close()
+		<-serveErr
+	}()
+
+	dial := func(listener net.Listener, username string) error {
+		dialer := &Dialer{
+			Username: username,
+			Password: "secret",
+			DialProxy: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return net.DialTimeout(listener.Addr().Network(), listener.Addr().String(), time.Second)
+			},
+		}
+
+		conn, err := dialer.Dial("tcp", "127.0.0.1:80")
+
+		if err == nil {
+			_ = conn.Close()
+		}
+
+		return err
+	}
+
+	tests := []struct {
+		name     string
+		listener net.Listener
+		username string
+		accepted bool
+	}{
+		{name: "tcp own user", listener: tcpListener, username: "alice", accepted: true},
+		{name: "tcp other listener user", listener: tcpListener, username: "bob", accepted: false},
+		{name: "tcp no auth", listener: tcpListener, accepted: false},
+		{name: "unix own user", listener: unixListener, username: "bob", accepted: true},
+		{name: "unix other listener user", listener: unixListener, username: "alice", accepted: false},
+		{name: "unix no auth", listener: unixListener, accepted: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := dial(test.listener, test.username); (err == nil) != test.accepted {
+				t.Fatalf("accepted = %v, want %v (err %v)", err == nil, test.accepted, err)
+			}
+		})
+	}
+}
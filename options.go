@@ -1,5 +1,13 @@
 package final_socks
 
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
 type Option func(*Server) error
 
 func NoAuthOption() Option {
@@ -25,3 +33,311 @@ func DynamicUserPassAuth(authFunction AuthFunction) Option {
 		return nil
 	}
 }
+
+func UserStoreAuth(store *UserStore) Option {
+	return func(s *Server) error {
+		s.AuthHandlers[AuthUserPass] = NewCredentialAuthHandler(store)
+
+		return nil
+	}
+}
+
+func HtpasswdAuth(path string) Option {
+	return func(s *Server) error {
+		file, err := NewHtpasswdFile(path, DefaultHtpasswdReloadInterval)
+
+		if err != nil {
+			return err
+		}
+
+		s.state.addCloser(file)
+		s.AuthHandlers[AuthUserPass] = NewCredentialAuthHandler(file)
+
+		return nil
+	}
+}
+
+// AuthLockout wraps the configured username/password auth with tracker, so
+// it has to be set after the auth option.
+func AuthLockout(tracker *FailureTracker) Option {
+	return func(s *Server) error {
+		var verifier CredentialVerifier
+
+		switch h := s.AuthHandlers[AuthUserPass].(type) {
+		case *CredentialAuthHandler:
+			verifier = h.verifier
+		case CredentialVerifier:
+			verifier = h
+		default:
+			return errors.New("auth lockout requires a username/password auth handler")
+		}
+
+		s.AuthHandlers[AuthUserPass] = NewCredentialAuthHandler(tracker.Wrap(verifier))
+
+		return nil
+	}
+}
+
+func WebhookUserPassAuth(config WebhookAuthConfig) Option {
+	return func(s *Server) error {
+		s.AuthHandlers[AuthUserPass] = NewCredentialAuthHandler(NewWebhookAuth(config))
+
+		return nil
+	}
+}
+
+func LDAPUserPassAuth(config LDAPAuthConfig) Option {
+	return func(s *Server) error {
+		s.AuthHandlers[AuthUserPass] = NewCredentialAuthHandler(NewLDAPAuth(config))
+
+		return nil
+	}
+}
+
+func RadiusUserPassAuth(config RadiusAuthConfig) Option {
+	return func(s *Server) error {
+		s.AuthHandlers[AuthUserPass] = NewCredentialAuthHandler(NewRadiusAuth(config))
+
+		return nil
+	}
+}
+
+func TokenUserPassAuth(auth *TokenAuth) Option {
+	return func(s *Server) error {
+		s.AuthHandlers[AuthUserPass] = NewCredentialAuthHandler(auth)
+
+		return nil
+	}
+}
+
+func JWTUserPassAuth(config JWTAuthConfig) Option {
+	return func(s *Server) error {
+		auth, err := NewJWTAuth(config)
+
+		if err != nil {
+			return err
+		}
+
+		s.state.addCloser(auth)
+		s.AuthHandlers[AuthUserPass] = NewCredentialAuthHandler(auth)
+
+		return nil
+	}
+}
+
+// SourceAuth picks the allowed auth methods per client network. The no auth
+// handler is registered when the policy allows it anywhere.
+func SourceAuth(policy *SourceAuthPolicy) Option {
+	return func(s *Server) error {
+		if _, ok := s.AuthHandlers[AuthNoAuth]; !ok && policy.allowsMethod(AuthNoAuth) {
+			s.AuthHandlers[AuthNoAuth] = NewNoAuthHandler()
+		}
+
+		s.sourceAuthPolicy = policy
+
+		return nil
+	}
+}
+
+// AuthMethod registers handler for method, including the private methods
+// 0x80-0xFE.
+func AuthMethod(method uint8, handler AuthHandler) Option {
+	return func(s *Server) error {
+		if err := validateAuthMethod(method); err != nil {
+			return err
+		}
+
+		s.AuthHandlers[method] = handler
+
+		return nil
+	}
+}
+
+// AuthMethodPreference sets the server side auth method order. With require
+// set only the listed methods are accepted.
+func AuthMethodPreference(require bool, methods ...uint8) Option {
+	return func(s *Server) error {
+		for i, method := range methods {
+			if err := validateAuthMethod(method); err != nil {
+				return err
+			}
+
+			if bytes.IndexByte(methods[:i], method) >= 0 {
+				return fmt.Errorf("auth method %#x is listed twice", method)
+			}
+		}
+
+		s.AuthPreference = methods
+		s.RequireAuthPreference = require
+
+		return nil
+	}
+}
+
+// TLSListener serves SOCKS over TLS, see TLSConfig for reloading and client
+// certificates.
+func TLSListener(config TLSConfig) Option {
+	return func(s *Server) error {
+		reloader, err := NewTLSReloader(config)
+
+		if err != nil {
+			return err
+		}
+
+		s.state.addCloser(reloader)
+		s.tlsConfig = reloader.Config()
+
+		return nil
+	}
+}
+
+// MutualTLSAuth serves SOCKS over TLS verifying client certificates against
+// config.ClientCAFile, the certificate is the identity of no auth clients
+// on TLS connections. TLS clients without a certificate fall back to the
+// other auth methods, other connections, e.g. over WebSocket, keep the no
+// auth handler of the server.
+func MutualTLSAuth(config TLSConfig) Option {
+	return func(s *Server) error {
+		if config.ClientCAFile == "" {
+			return errors.New("mutual tls requires a client ca file")
+		}
+
+		reloader, err := NewTLSReloader(config)
+
+		if err != nil {
+			return err
+		}
+
+		s.state.addCloser(reloader)
+		s.tlsConfig = reloader.Config()
+		s.certAuthHandler = NewCertAuthHandler()
+
+		return nil
+	}
+}
+
+// ProxyProtocol accepts PROXY protocol v1 and v2 headers from the trusted
+// networks, e.g. the load balancers in front of the server.
+func ProxyProtocol(trusted ...string) Option {
+	return func(s *Server) error {
+		s.proxyProtocolTrusted = []*net.IPNet{}
+
+		for _, cidr := range trusted {
+			_, network, err := net.ParseCIDR(cidr)
+
+			if err != nil {
+				return errors.Wrap(err, "invalid trusted network")
+			}
+
+			s.proxyProtocolTrusted = append(s.proxyProtocolTrusted, network)
+		}
+
+		return nil
+	}
+}
+
+// UpstreamProxyProtocol sends PROXY protocol headers to the destinations of
+// the rules, the first matching rule wins.
+func UpstreamProxyProtocol(rules ...UpstreamProxyProtocolRule) Option {
+	return func(s *Server) error {
+		for _, rule := range rules {
+			if rule.Version != 0 && rule.Version != 1 && rule.Version != 2 {
+				return fmt.Errorf("unsupported proxy protocol version: %d", rule.Version)
+			}
+
+			if rule.SendUser && rule.Version == 1 {
+				return errors.New("proxy protocol v1 cannot carry the user")
+			}
+		}
+
+		s.upstreamProxyProtocol = append(s.upstreamProxyProtocol, rules...)
+
+		return nil
+	}
+}
+
+// Listen adds a listener, see Server.AddListener.
+func Listen(network, address string, options ...Option) Option {
+	return func(s *Server) error {
+		s.AddListener(network, address, options...)
+
+		return nil
+	}
+}
+
+// ReusePort opens acceptors SO_REUSEPORT sockets per TCP listener, each with
+// its own accept loop. Linux only.
+func ReusePort(acceptors int) Option {
+	return func(s *Server) error {
+		if acceptors < 1 {
+			return fmt.Errorf("invalid acceptor count: %d", acceptors)
+		}
+
+		if acceptors > 1 && !reusePortSupported {
+			return errors.New("SO_REUSEPORT acceptors are only supported on linux")
+		}
+
+		s.reusePortAcceptors = acceptors
+
+		return nil
+	}
+}
+
+// UDPSourceValidation sets which client datagrams a UDP association
+// accepts, UDPSourceStrict by default.
+func UDPSourceValidation(mode UDPSourceMode) Option {
+	return func(s *Server) error {
+		if mode != UDPSourceStrict && mode != UDPSourceRelaxed {
+			return fmt.Errorf("invalid udp source mode: %d", mode)
+		}
+
+		s.udpSourceMode = mode
+
+		return nil
+	}
+}
+
+// UDPNAT sets the NAT behavior of the UDP relay, UDPNATSymmetric by
+// default. Identity.UDPNAT overrides it per user.
+func UDPNAT(mode UDPNATMode) Option {
+	return func(s *Server) error {
+		if !mode.valid() {
+			return fmt.Errorf("invalid udp nat mode: %q", mode)
+		}
+
+		s.udpNAT = mode
+
+		return nil
+	}
+}
+
+// UDPFragmentation enables RFC 1928 fragment reassembly and fragmented
+// replies on the UDP relay.
+func UDPFragmentation(config UDPFragmentConfig) Option {
+	return func(s *Server) error {
+		if config.ReassemblyTimeout != 0 && config.ReassemblyTimeout < MinUDPReassemblyTimeout {
+			return fmt.Errorf("udp reassembly timeout below %v", MinUDPReassemblyTimeout)
+		}
+
+		if config.FragmentSize < 0 || config.FragmentSize > UDPBufSize {
+			return fmt.Errorf("invalid udp fragment size: %d", config.FragmentSize)
+		}
+
+		s.udpFragment = config
+
+		return nil
+	}
+}
+
+// validateAuthMethod accepts the IANA assigned methods and the private
+// range, https://www.iana.org/assignments/socks-methods
+func validateAuthMethod(method uint8) error {
+	switch {
+	case method == AuthNoAcceptable:
+		return errors.New("auth method 0xFF is reserved")
+	case method > AuthAssignedLast && method < AuthPrivateFirst:
+		return fmt.Errorf("auth method %#x is unassigned, private methods are %#x-%#x", method, AuthPrivateFirst, AuthPrivateLast)
+	}
+
+	return nil
+}
@@ -0,0 +1,251 @@
+package final_socks
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnsupportedHash = errors.New("unsupported password hash")
+
+// CheckPasswordHash compares password against a crypt(3) style hash in
+// constant time. Supported formats are bcrypt ($2a$, $2b$, $2y$),
+// SHA-crypt ($5$, $6$) and argon2id.
+func CheckPasswordHash(hashed, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hashed, "$2a$"), strings.HasPrefix(hashed, "$2b$"), strings.HasPrefix(hashed, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
+
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+
+		return err == nil, err
+	case strings.HasPrefix(hashed, "$5$"):
+		return checkShaCrypt(hashed, password, sha256.New, shaCrypt256Order)
+	case strings.HasPrefix(hashed, "$6$"):
+		return checkShaCrypt(hashed, password, sha512.New, shaCrypt512Order)
+	case strings.HasPrefix(hashed, "$argon2id$"):
+		return checkArgon2id(hashed, password)
+	}
+
+	return false, ErrUnsupportedHash
+}
+
+func isSupportedHash(hashed string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$5$", "$6$", "$argon2id$"} {
+		if strings.HasPrefix(hashed, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func checkArgon2id(hashed, password string) (bool, error) {
+	parts := strings.Split(hashed, "$")
+
+	if len(parts) != 6 {
+		return false, errors.New("malformed argon2id hash")
+	}
+
+	var version int
+
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2id version: %v", parts[2])
+	}
+
+	var memory, time uint32
+	var threads uint8
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, errors.Wrap(err, "malformed argon2id params")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+
+	if err != nil {
+		return false, errors.Wrap(err, "malformed argon2id salt")
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+
+	if err != nil {
+		return false, errors.Wrap(err, "malformed argon2id hash")
+	}
+
+	derived := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(key, derived) == 1, nil
+}
+
+const shaCryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+var (
+	shaCrypt256Order = []int{
+		0, 10, 20, 21, 1, 11, 12, 22, 2, 3, 13, 23, 24, 4, 14,
+		15, 25, 5, 6, 16, 26, 27, 7, 17, 18, 28, 8, 9, 19, 29,
+		31, 30,
+	}
+	shaCrypt512Order = []int{
+		0, 21, 42, 22, 43, 1, 44, 2, 23, 3, 24, 45, 25, 46, 4,
+		47, 5, 26, 6, 27, 48, 28, 49, 7, 50, 8, 29, 9, 30, 51,
+		31, 52, 10, 53, 11, 32, 12, 33, 54, 34, 55, 13, 56, 14, 35,
+		15, 36, 57, 37, 58, 16, 59, 17, 38, 18, 39, 60, 40, 61, 19,
+		62, 20, 41, 63,
+	}
+)
+
+// checkShaCrypt implements https://www.akkadia.org/drepper/SHA-crypt.txt
+func checkShaCrypt(hashed, password string, newHash func() hash.Hash, order []int) (bool, error) {
+	parts := strings.Split(hashed, "$")
+
+	if len(parts) != 4 && len(parts) != 5 {
+		return false, errors.New("malformed sha-crypt hash")
+	}
+
+	rounds := 5000
+	prefix := "$" + parts[1] + "$"
+	params := parts[2:]
+
+	if strings.HasPrefix(params[0], "rounds=") {
+		n, err := strconv.Atoi(strings.TrimPrefix(params[0], "rounds="))
+
+		if err != nil {
+			return false, errors.Wrap(err, "malformed sha-crypt rounds")
+		}
+
+		if n < 1000 {
+			n = 1000
+		} else if n > 999999999 {
+			n = 999999999
+		}
+
+		// a clamped count is written back the way crypt(3) writes it
+		rounds = n
+		prefix += fmt.Sprintf("rounds=%d$", n)
+		params = params[1:]
+	}
+
+	if len(params) != 2 {
+		return false, errors.New("malformed sha-crypt hash")
+	}
+
+	salt := params[0]
+
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+
+	expected := prefix + salt + "$" + shaCrypt([]byte(password), []byte(salt), rounds, newHash, order)
+
+	return subtle.ConstantTimeCompare([]byte(hashed), []byte(expected)) == 1, nil
+}
+
+func shaCrypt(password, salt []byte, rounds int, newHash func() hash.Hash, order []int) string {
+	h := newHash()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	b := h.Sum(nil)
+	size := len(b)
+
+	h.Reset()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(repeatBytes(b, len(password)))
+
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(password)
+		}
+	}
+
+	a := h.Sum(nil)
+
+	h.Reset()
+
+	for i := 0; i < len(password); i++ {
+		h.Write(password)
+	}
+
+	p := repeatBytes(h.Sum(nil), len(password))
+
+	h.Reset()
+
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(salt)
+	}
+
+	s := repeatBytes(h.Sum(nil), len(salt))
+	c := a
+
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+
+		if i%3 != 0 {
+			h.Write(s)
+		}
+
+		if i%7 != 0 {
+			h.Write(p)
+		}
+
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+
+		c = h.Sum(nil)
+	}
+
+	var out strings.Builder
+
+	for i := 0; i+2 < len(order); i += 3 {
+		writeShaCrypt64(&out, uint(c[order[i]])<<16|uint(c[order[i+1]])<<8|uint(c[order[i+2]]), 4)
+	}
+
+	if size == sha256.Size {
+		writeShaCrypt64(&out, uint(c[order[30]])<<8|uint(c[order[31]]), 3)
+	} else {
+		writeShaCrypt64(&out, uint(c[order[63]]), 2)
+	}
+
+	return out.String()
+}
+
+func writeShaCrypt64(out *strings.Builder, w uint, n int) {
+	for ; n > 0; n-- {
+		out.WriteByte(shaCryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
+
+func repeatBytes(b []byte, n int) []byte {
+	out := make([]byte, n)
+
+	for i := 0; i < n; i += len(b) {
+		copy(out[i:], b)
+	}
+
+	return out
+}
@@ -0,0 +1,116 @@
+package final_socks
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckPasswordHashShaCrypt(t *testing.T) {
+	// https://www.akkadia.org/drepper/SHA-crypt.txt, same as openssl passwd -5/-6
+	tests := []struct {
+		hashed   string
+		password string
+	}{
+		{"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!"},
+		{"$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA", "Hello world!"},
+		{"$5$rounds=5000$toolongsaltstrin$Un/5jzAHMgOGZ5.mWJpuVolil07guHPvOW8mGRcvxa5", "This is just a test"},
+		{"$5$rounds=1000$roundstoolow$yfvwcWrQ8l/K0DAWyuPMDNHpIVlTQebY9l/gL972bIC", "the minimum number is still observed"},
+		{"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"},
+		{"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.", "Hello world!"},
+		{"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0", "This is just a test"},
+		{"$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX.", "the minimum number is still observed"},
+	}
+
+	for _, test := range tests {
+		match, err := CheckPasswordHash(test.hashed, test.password)
+
+		if err != nil || !match {
+			t.Errorf("%s: match=%v err=%v", test.hashed, match, err)
+		}
+
+		if match, _ := CheckPasswordHash(test.hashed, test.password+"x"); match {
+			t.Errorf("%s: matched a wrong password", test.hashed)
+		}
+	}
+}
+
+func TestCheckPasswordHashShaCryptRounds(t *testing.T) {
+	// crypt(3) clamps rounds=10 to 1000 and writes 1000, so a hash carrying
+	// the raw count is not one it could have produced
+	hashed := "$5$rounds=10$roundstoolow$yfvwcWrQ8l/K0DAWyuPMDNHpIVlTQebY9l/gL972bIC"
+
+	if match, err := CheckPasswordHash(hashed, "the minimum number is still observed"); err != nil || match {
+		t.Fatalf("unclamped rounds: match=%v err=%v", match, err)
+	}
+
+	if _, err := CheckPasswordHash("$5$rounds=x$salt$hash", "secret"); err == nil {
+		t.Fatal("accepted malformed rounds")
+	}
+
+	if _, err := CheckPasswordHash("$5$salt", "secret"); err == nil {
+		t.Fatal("accepted a hash without a salt")
+	}
+}
+
+func TestCheckPasswordHashBcrypt(t *testing.T) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %v", err)
+	}
+
+	// htpasswd -B writes $2y$, which is the same algorithm
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		h := prefix + string(hashed[4:])
+
+		if match, err := CheckPasswordHash(h, "secret"); err != nil || !match {
+			t.Errorf("%s: match=%v err=%v", prefix, match, err)
+		}
+
+		if match, err := CheckPasswordHash(h, "wrong"); err != nil || match {
+			t.Errorf("%s wrong password: match=%v err=%v", prefix, match, err)
+		}
+	}
+
+	if _, err := CheckPasswordHash("$2a$10$short", "secret"); err == nil {
+		t.Fatal("accepted a truncated bcrypt hash")
+	}
+}
+
+func TestCheckPasswordHashArgon2id(t *testing.T) {
+	salt := []byte("somesaltsomesalt")
+	key := argon2.IDKey([]byte("secret"), salt, 2, 1024, 1, 32)
+	hashed := fmt.Sprintf("$argon2id$v=19$m=1024,t=2,p=1$%s$%s",
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	if match, err := CheckPasswordHash(hashed, "secret"); err != nil || !match {
+		t.Fatalf("match=%v err=%v", match, err)
+	}
+
+	if match, err := CheckPasswordHash(hashed, "wrong"); err != nil || match {
+		t.Fatalf("wrong password: match=%v err=%v", match, err)
+	}
+
+	for _, malformed := range []string{
+		"$argon2id$v=19$m=1024,t=2,p=1$salt",
+		"$argon2id$v=16$m=1024,t=2,p=1$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=x$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=1024,t=2,p=1$!!$aGFzaA",
+	} {
+		if _, err := CheckPasswordHash(malformed, "secret"); err == nil {
+			t.Errorf("%s: accepted a malformed hash", malformed)
+		}
+	}
+}
+
+func TestCheckPasswordHashUnsupported(t *testing.T) {
+	for _, hashed := range []string{"$apr1$salt$hash", "{SHA}hash", "plain"} {
+		if _, err := CheckPasswordHash(hashed, "secret"); err != ErrUnsupportedHash {
+			t.Errorf("%s: got %v, want %v", hashed, err, ErrUnsupportedHash)
+		}
+	}
+}
@@ -20,5 +20,6 @@ func GetBufReader(r io.Reader) *bufio.Reader {
 
 // PutBufReader puts a *bufio.Reader into pool.
 func PutBufReader(br *bufio.Reader) {
+	br.Reset(nil)
 	bufReaderPool.Put(br)
 }
@@ -0,0 +1,401 @@
+package final_socks
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	ProxyTLVALPN      = uint8(0x01)
+	ProxyTLVAuthority = uint8(0x02)
+	ProxyTLVUniqueID  = uint8(0x05)
+	ProxyTLVSSL       = uint8(0x20)
+	ProxyTLVNetNS     = uint8(0x30)
+)
+
+var ProxyProtocolHeaderTimeout = 5 * time.Second
+
+// proxyHeaderV2MaxLength caps the address and TLV block of a v2 header, the
+// length field alone would let a peer make every connection buffer 64KB.
+const proxyHeaderV2MaxLength = 4096
+
+type ProxyTLV struct {
+	Type  uint8
+	Value []byte
+}
+
+// ProxyHeader is a parsed PROXY protocol header. Local headers, sent by the
+// load balancer for health checks, carry no addresses.
+type ProxyHeader struct {
+	Version     uint8
+	Local       bool
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+	TLVs        []ProxyTLV
+}
+
+func (h *ProxyHeader) TLV(tlvType uint8) []byte {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == tlvType {
+			return tlv.Value
+		}
+	}
+
+	return nil
+}
+
+// ReadProxyHeader reads a v1 or v2 header from r. It returns nil without
+// consuming anything when r does not start with a header.
+func ReadProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	v1Signature := []byte("PROXY ")
+
+	// peek byte by byte, a client speaking SOCKS right away sends less than
+	// a full signature before waiting for the reply
+	for n := 1; n <= len(proxyProtocolV2Signature); n++ {
+		peek, err := r.Peek(n)
+
+		if err != nil {
+			return nil, err
+		}
+
+		v1 := bytes.HasPrefix(v1Signature, peek)
+		v2 := bytes.HasPrefix(proxyProtocolV2Signature, peek)
+
+		switch {
+		case v1 && n == len(v1Signature):
+			return readProxyHeaderV1(r)
+		case v2 && n == len(proxyProtocolV2Signature):
+			return readProxyHeaderV2(r)
+		case !v1 && !v2:
+			return nil, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read proxy header")
+		}
+
+		line = append(line, b)
+
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxy header too long")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	header := &ProxyHeader{Version: 1}
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		header.Local = true
+
+		return header, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed proxy header: %q", line)
+	}
+
+	var err error
+
+	if header.Source, err = parseProxyAddr(fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+
+	if header.Destination, err = parseProxyAddr(fields[3], fields[5]); err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	portNum, err := strconv.ParseUint(port, 10, 16)
+
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed proxy address: %v %v", host, port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(portNum)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (*ProxyHeader, error) {
+	head := make([]byte, 16)
+
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, errors.Wrap(err, "failed to read proxy header")
+	}
+
+	if head[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported proxy protocol version: %d", head[12]>>4)
+	}
+
+	length := binary.BigEndian.Uint16(head[14:16])
+
+	if length > proxyHeaderV2MaxLength {
+		return nil, fmt.Errorf("proxy header too long: %d bytes", length)
+	}
+
+	body := make([]byte, length)
+
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errors.Wrap(err, "failed to read proxy header")
+	}
+
+	header := &ProxyHeader{Version: 2}
+
+	switch head[12] & 0x0f {
+	case 0:
+		header.Local = true
+	case 1:
+	default:
+		return nil, fmt.Errorf("unsupported proxy command: %d", head[12]&0x0f)
+	}
+
+	var addrLen int
+
+	switch head[13] >> 4 {
+	case 1:
+		addrLen = 2*net.IPv4len + 4
+	case 2:
+		addrLen = 2*net.IPv6len + 4
+	case 3:
+		addrLen = 216
+	}
+
+	if len(body) < addrLen {
+		return nil, errors.New("proxy header too short")
+	}
+
+	if ipLen := (addrLen - 4) / 2; !header.Local && (ipLen == net.IPv4len || ipLen == net.IPv6len) {
+		header.Source = &net.TCPAddr{
+			IP:   net.IP(body[:ipLen]),
+			Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+		}
+		header.Destination = &net.TCPAddr{
+			IP:   net.IP(body[ipLen : 2*ipLen]),
+			Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+		}
+	} else {
+		header.Local = true
+	}
+
+	for tlvs := body[addrLen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 || len(tlvs) < 3+int(binary.BigEndian.Uint16(tlvs[1:3])) {
+			return nil, errors.New("malformed proxy header tlv")
+		}
+
+		end := 3 + int(binary.BigEndian.Uint16(tlvs[1:3]))
+		header.TLVs = append(header.TLVs, ProxyTLV{Type: tlvs[0], Value: tlvs[3:end]})
+		tlvs = tlvs[end:]
+	}
+
+	return header, nil
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+// NewProxyProtocolListener parses PROXY protocol headers on connections
+// from trusted networks, other connections are passed through untouched.
+func NewProxyProtocolListener(listener net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyProtocolListener{
+		Listener: listener,
+		trusted:  trusted,
+	}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+
+	if err != nil {
+		return nil, err
+	}
+
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+
+	if !ok || !containsIP(l.trusted, addr.IP) {
+		return conn, nil
+	}
+
+	return &proxyProtocolConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}, nil
+}
+
+// proxyProtocolConn reads the header lazily on first use so a slow client
+// does not block the accept loop. Only the remote address is replaced, the
+// local address stays bindable for UDP associate.
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+	header *ProxyHeader
+	err    error
+	once   sync.Once
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(ProxyProtocolHeaderTimeout))
+		c.header, c.err = ReadProxyHeader(c.reader)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	if c.readHeader(); c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.readHeader(); c.header != nil && !c.header.Local {
+		return c.header.Source
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
+
+// ProxyHeaderFromConn returns the PROXY protocol header conn was received
+// with, if any.
+func ProxyHeaderFromConn(conn net.Conn) *ProxyHeader {
+	for {
+		switch c := conn.(type) {
+		case *statsConn:
+			conn = c.Conn
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *proxyProtocolConn:
+			c.readHeader()
+
+			return c.header
+		default:
+			return nil
+		}
+	}
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Encode serializes h as a v1 or v2 header. TLVs are only sent with v2,
+// mixed address families are sent as IPv6.
+func (h *ProxyHeader) Encode() ([]byte, error) {
+	if h.Version == 1 {
+		return h.encodeV1(), nil
+	}
+
+	if h.Version != 2 {
+		return nil, fmt.Errorf("unsupported proxy protocol version: %d", h.Version)
+	}
+
+	buf := bytes.NewBuffer(append([]byte{}, proxyProtocolV2Signature...))
+	var addrs []byte
+
+	if h.Local || h.Source == nil || h.Destination == nil {
+		buf.Write([]byte{0x20, 0x00})
+	} else if src, dst := h.Source.IP.To4(), h.Destination.IP.To4(); src != nil && dst != nil {
+		buf.Write([]byte{0x21, 0x11})
+		addrs = append(append(addrs, src...), dst...)
+	} else {
+		buf.Write([]byte{0x21, 0x21})
+		addrs = append(append(addrs, h.Source.IP.To16()...), h.Destination.IP.To16()...)
+	}
+
+	if addrs != nil {
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(h.Source.Port))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(h.Destination.Port))
+	}
+
+	for _, tlv := range h.TLVs {
+		if len(tlv.Value) > 0xffff {
+			return nil, fmt.Errorf("proxy header tlv too long: %d", tlv.Type)
+		}
+
+		addrs = append(addrs, tlv.Type)
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(len(tlv.Value)))
+		addrs = append(addrs, tlv.Value...)
+	}
+
+	if len(addrs) > 0xffff {
+		return nil, errors.New("proxy header too long")
+	}
+
+	_ = binary.Write(buf, binary.BigEndian, uint16(len(addrs)))
+	buf.Write(addrs)
+
+	return buf.Bytes(), nil
+}
+
+func (h *ProxyHeader) encodeV1() []byte {
+	if h.Local || h.Source == nil || h.Destination == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family, src, dst := "TCP4", h.Source.IP.String(), h.Destination.IP.String()
+
+	if h.Source.IP.To4() == nil || h.Destination.IP.To4() == nil {
+		family = "TCP6"
+
+		// net.IP prints mapped addresses dotted, TCP6 needs them in IPv6 form
+		if h.Source.IP.To4() != nil {
+			src = "::ffff:" + src
+		}
+
+		if h.Destination.IP.To4() != nil {
+			dst = "::ffff:" + dst
+		}
+	}
+
+	return []byte(fmt.Sprintf(
+		"PROXY %s %s %s %d %d\r\n",
+		family, src, dst, h.Source.Port, h.Destination.Port,
+	))
+}
@@ -0,0 +1,286 @@
+package final_socks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2 builds a v2 header with command, family and body.
+func proxyV2(command, family byte, body ...[]byte) []byte {
+	joined := bytes.Join(body, nil)
+	header := append(append([]byte{}, proxyProtocolV2Signature...), 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(joined)))
+
+	return append(header, joined...)
+}
+
+func proxyTLVBytes(tlvType uint8, value string) []byte {
+	tlv := binary.BigEndian.AppendUint16([]byte{tlvType}, uint16(len(value)))
+
+	return append(tlv, value...)
+}
+
+// describeProxyHeader prints h for comparison, IPv4 addresses compare the
+// same in their 4 and 16 byte forms.
+func describeProxyHeader(h *ProxyHeader) string {
+	if h == nil {
+		return "none"
+	}
+
+	out := fmt.Sprintf("v%d local=%v %v %v", h.Version, h.Local, h.Source, h.Destination)
+
+	for _, tlv := range h.TLVs {
+		out += fmt.Sprintf(" %#x=%q", tlv.Type, tlv.Value)
+	}
+
+	return out
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x0f, 0xa0, 0x04, 0x38}
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x0f, 0xa0, 0x04, 0x38)
+	unix := make([]byte, 216)
+	copy(unix, "/run/client.sock")
+	copy(unix[108:], "/run/proxy.sock")
+
+	source4 := &net.TCPAddr{IP: net.IP{192, 0, 2, 1}, Port: 4000}
+	destination4 := &net.TCPAddr{IP: net.IP{198, 51, 100, 1}, Port: 1080}
+	source6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4000}
+	destination6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1080}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		header *ProxyHeader
+	}{
+		{
+			name:   "v1 tcp4",
+			data:   []byte("PROXY TCP4 192.0.2.1 198.51.100.1 4000 1080\r\n"),
+			header: &ProxyHeader{Version: 1, Source: source4, Destination: destination4},
+		},
+		{
+			name:   "v1 tcp6",
+			data:   []byte("PROXY TCP6 2001:db8::1 2001:db8::2 4000 1080\r\n"),
+			header: &ProxyHeader{Version: 1, Source: source6, Destination: destination6},
+		},
+		{
+			name:   "v1 unknown",
+			data:   []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"),
+			header: &ProxyHeader{Version: 1, Local: true},
+		},
+		{
+			name:   "v2 proxy ipv4",
+			data:   proxyV2(1, 0x11, ipv4),
+			header: &ProxyHeader{Version: 2, Source: source4, Destination: destination4},
+		},
+		{
+			name:   "v2 proxy ipv6",
+			data:   proxyV2(1, 0x21, ipv6),
+			header: &ProxyHeader{Version: 2, Source: source6, Destination: destination6},
+		},
+		{
+			name:   "v2 proxy unix",
+			data:   proxyV2(1, 0x31, unix),
+			header: &ProxyHeader{Version: 2, Local: true},
+		},
+		{
+			name:   "v2 local",
+			data:   proxyV2(0, 0x00),
+			header: &ProxyHeader{Version: 2, Local: true},
+		},
+		{
+			name:   "v2 local with addresses",
+			data:   proxyV2(0, 0x11, ipv4),
+			header: &ProxyHeader{Version: 2, Local: true},
+		},
+		{
+			name: "v2 tlvs",
+			data: proxyV2(1, 0x11, ipv4, proxyTLVBytes(ProxyTLVALPN, "h2"), proxyTLVBytes(ProxyTLVAuthority, "proxy.example"), proxyTLVBytes(ProxyTLVUniqueID, "")),
+			header: &ProxyHeader{Version: 2, Source: source4, Destination: destination4, TLVs: []ProxyTLV{
+				{Type: ProxyTLVALPN, Value: []byte("h2")},
+				{Type: ProxyTLVAuthority, Value: []byte("proxy.example")},
+				{Type: ProxyTLVUniqueID, Value: []byte{}},
+			}},
+		},
+		{
+			name: "v2 unix tlvs",
+			data: proxyV2(1, 0x31, unix, proxyTLVBytes(ProxyTLVNetNS, "blue")),
+			header: &ProxyHeader{Version: 2, Local: true, TLVs: []ProxyTLV{
+				{Type: ProxyTLVNetNS, Value: []byte("blue")},
+			}},
+		},
+		{
+			name: "socks greeting",
+			data: []byte{VersionSocks5, 1, AuthNoAuth},
+		},
+		{
+			name: "partial signature",
+			data: []byte("PROX\x05"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := bufio.NewReader(io.MultiReader(bytes.NewReader(test.data), strings.NewReader("rest")))
+			header, err := ReadProxyHeader(reader)
+
+			if err != nil {
+				t.Fatalf("ReadProxyHeader: %v", err)
+			}
+
+			if got, want := describeProxyHeader(header), describeProxyHeader(test.header); got != want {
+				t.Fatalf("got %s, want %s", got, want)
+			}
+
+			rest, _ := io.ReadAll(reader)
+			want := "rest"
+
+			// without a header nothing is consumed
+			if test.header == nil {
+				want = string(test.data) + want
+			}
+
+			if string(rest) != want {
+				t.Fatalf("left %q, want %q", rest, want)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderErrors(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x0f, 0xa0, 0x04, 0x38}
+	tooLong := append(append([]byte{}, proxyProtocolV2Signature...), 0x21, 0x11)
+	tooLong = binary.BigEndian.AppendUint16(tooLong, proxyHeaderV2MaxLength+1)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "v1 truncated", data: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 4000")},
+		{name: "v1 without line end", data: []byte("PROXY TCP4 " + strings.Repeat("1", 120))},
+		{name: "v1 missing fields", data: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 4000\r\n")},
+		{name: "v1 bad family", data: []byte("PROXY UDP4 192.0.2.1 198.51.100.1 4000 1080\r\n")},
+		{name: "v1 bad address", data: []byte("PROXY TCP4 192.0.2.x 198.51.100.1 4000 1080\r\n")},
+		{name: "v1 bad port", data: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 4000 70000\r\n")},
+		{name: "v2 truncated signature", data: proxyProtocolV2Signature[:8]},
+		{name: "v2 truncated head", data: proxyV2(1, 0x11, ipv4)[:14]},
+		{name: "v2 truncated body", data: proxyV2(1, 0x11, ipv4)[:20]},
+		{name: "v2 short addresses", data: proxyV2(1, 0x11, ipv4[:8])},
+		{name: "v2 truncated tlv", data: proxyV2(1, 0x11, ipv4, proxyTLVBytes(ProxyTLVALPN, "h2")[:4])},
+		{name: "v2 bad version", data: append(append(append([]byte{}, proxyProtocolV2Signature...), 0x31, 0x11), proxyV2(1, 0x11, ipv4)[14:]...)},
+		{name: "v2 bad command", data: proxyV2(2, 0x11, ipv4)},
+		{name: "v2 length above the limit", data: append(tooLong, make([]byte, proxyHeaderV2MaxLength+1)...)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if header, err := ReadProxyHeader(bufio.NewReader(bytes.NewReader(test.data))); err == nil {
+				t.Fatalf("accepted: %+v", header)
+			}
+		})
+	}
+}
+
+// acceptProxyProtocol sends data to a listener trusting trusted and returns
+// the accepted connection.
+func acceptProxyProtocol(t *testing.T, trusted string, data []byte) net.Conn {
+	_, network, err := net.ParseCIDR(trusted)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := NewProxyProtocolListener(raw, []*net.IPNet{network})
+	t.Cleanup(func() { _ = listener.Close() })
+
+	client, err := net.Dial("tcp", raw.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = client.Close() })
+
+	if _, err := client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := listener.Accept()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	header := []byte("PROXY TCP4 192.0.2.1 198.51.100.1 4000 1080\r\n")
+	greeting := []byte{VersionSocks5, 1, AuthNoAuth}
+
+	tests := []struct {
+		name    string
+		trusted string
+		data    []byte
+		remote  string
+		read    []byte
+		header  bool
+	}{
+		{
+			name:    "trusted header",
+			trusted: "127.0.0.0/8",
+			data:    append(append([]byte{}, header...), greeting...),
+			remote:  "192.0.2.1",
+			read:    greeting,
+			header:  true,
+		},
+		{
+			name:    "untrusted source untouched",
+			trusted: "10.0.0.0/8",
+			data:    append(append([]byte{}, header...), greeting...),
+			remote:  "127.0.0.1",
+			read:    append(append([]byte{}, header...), greeting...),
+		},
+		{
+			name:    "plain socks on a trusted listener",
+			trusted: "127.0.0.0/8",
+			data:    greeting,
+			remote:  "127.0.0.1",
+			read:    greeting,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := acceptProxyProtocol(t, test.trusted, test.data)
+
+			if ip := conn.RemoteAddr().(*net.TCPAddr).IP.String(); ip != test.remote {
+				t.Fatalf("remote %v, want %v", ip, test.remote)
+			}
+
+			read := make([]byte, len(test.read))
+
+			if _, err := io.ReadFull(conn, read); err != nil || !bytes.Equal(read, test.read) {
+				t.Fatalf("read %q, want %q (err %v)", read, test.read, err)
+			}
+
+			if header := ProxyHeaderFromConn(newStatsConn(conn)); (header != nil) != test.header {
+				t.Fatalf("header %+v, want header %v", header, test.header)
+			}
+		})
+	}
+}
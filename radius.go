@@ -0,0 +1,262 @@
+package final_socks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// https://www.rfc-editor.org/rfc/rfc2865 and rfc2866
+const (
+	RadiusAccessRequest      = uint8(1)
+	RadiusAccessAccept       = uint8(2)
+	RadiusAccessReject       = uint8(3)
+	RadiusAccountingRequest  = uint8(4)
+	RadiusAccountingResponse = uint8(5)
+)
+
+const (
+	RadiusAttrUserName             = uint8(1)
+	RadiusAttrUserPassword         = uint8(2)
+	RadiusAttrNASIPAddress         = uint8(4)
+	RadiusAttrClass                = uint8(25)
+	RadiusAttrCallingStationID     = uint8(31)
+	RadiusAttrNASIdentifier        = uint8(32)
+	RadiusAttrAcctStatusType       = uint8(40)
+	RadiusAttrAcctInputOctets      = uint8(42)
+	RadiusAttrAcctOutputOctets     = uint8(43)
+	RadiusAttrAcctSessionID        = uint8(44)
+	RadiusAttrAcctSessionTime      = uint8(46)
+	RadiusAttrAcctInputGigawords   = uint8(52)
+	RadiusAttrAcctOutputGigawords  = uint8(53)
+	RadiusAttrMessageAuthenticator = uint8(80)
+)
+
+const (
+	RadiusAcctStart   = uint32(1)
+	RadiusAcctStop    = uint32(2)
+	RadiusAcctInterim = uint32(3)
+)
+
+type RadiusAttribute struct {
+	Type  uint8
+	Value []byte
+}
+
+type RadiusPacket struct {
+	Code          uint8
+	Identifier    uint8
+	Authenticator [16]byte
+	Attributes    []RadiusAttribute
+}
+
+func (p *RadiusPacket) Add(attrType uint8, value []byte) {
+	p.Attributes = append(p.Attributes, RadiusAttribute{Type: attrType, Value: value})
+}
+
+func (p *RadiusPacket) AddUint32(attrType uint8, value uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, value)
+	p.Add(attrType, b)
+}
+
+func (p *RadiusPacket) Get(attrType uint8) []byte {
+	for _, attr := range p.Attributes {
+		if attr.Type == attrType {
+			return attr.Value
+		}
+	}
+
+	return nil
+}
+
+func (p *RadiusPacket) Encode() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 64))
+	buf.Write([]byte{p.Code, p.Identifier, 0, 0})
+	buf.Write(p.Authenticator[:])
+
+	for _, attr := range p.Attributes {
+		if len(attr.Value) > 253 {
+			return nil, fmt.Errorf("radius attribute %d too long", attr.Type)
+		}
+
+		buf.Write([]byte{attr.Type, byte(2 + len(attr.Value))})
+		buf.Write(attr.Value)
+	}
+
+	if buf.Len() > 4096 {
+		return nil, errors.New("radius packet too long")
+	}
+
+	b := buf.Bytes()
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+
+	return b, nil
+}
+
+func ParseRadiusPacket(b []byte) (*RadiusPacket, error) {
+	if len(b) < 20 {
+		return nil, errors.New("radius packet too short")
+	}
+
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+
+	if length < 20 || length > len(b) {
+		return nil, errors.New("invalid radius packet length")
+	}
+
+	p := &RadiusPacket{
+		Code:       b[0],
+		Identifier: b[1],
+	}
+
+	copy(p.Authenticator[:], b[4:20])
+
+	for attrs := b[20:length]; len(attrs) > 0; {
+		if len(attrs) < 2 || int(attrs[1]) < 2 || int(attrs[1]) > len(attrs) {
+			return nil, errors.New("invalid radius attribute")
+		}
+
+		p.Add(attrs[0], append([]byte(nil), attrs[2:attrs[1]]...))
+		attrs = attrs[attrs[1]:]
+	}
+
+	return p, nil
+}
+
+// NewRadiusAccessRequest builds a PAP Access-Request signed with a
+// Message-Authenticator.
+func NewRadiusAccessRequest(secret, username, password string) (*RadiusPacket, error) {
+	p := &RadiusPacket{Code: RadiusAccessRequest}
+
+	if _, err := rand.Read(p.Authenticator[:]); err != nil {
+		return nil, err
+	}
+
+	p.Add(RadiusAttrUserName, []byte(username))
+	p.Add(RadiusAttrUserPassword, radiusHidePassword(secret, p.Authenticator, password))
+
+	return p, nil
+}
+
+// EncodeRequest encodes a request, filling in the request authenticator of
+// accounting packets and the Message-Authenticator of access requests.
+func (p *RadiusPacket) EncodeRequest(secret string) ([]byte, error) {
+	if p.Code == RadiusAccessRequest {
+		p.Add(RadiusAttrMessageAuthenticator, make([]byte, 16))
+	}
+
+	b, err := p.Encode()
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.Code {
+	case RadiusAccessRequest:
+		mac := hmac.New(md5.New, []byte(secret))
+		mac.Write(b)
+		copy(b[len(b)-16:], mac.Sum(nil))
+	case RadiusAccountingRequest:
+		sum := md5.Sum(append(b, secret...))
+		copy(b[4:20], sum[:])
+		copy(p.Authenticator[:], sum[:])
+	}
+
+	return b, nil
+}
+
+// VerifyRadiusResponse checks the response authenticator of b against the
+// request authenticator it answers.
+func VerifyRadiusResponse(b []byte, requestAuthenticator [16]byte, secret string) bool {
+	if len(b) < 20 {
+		return false
+	}
+
+	h := md5.New()
+	h.Write(b[:4])
+	h.Write(requestAuthenticator[:])
+	h.Write(b[20:])
+	h.Write([]byte(secret))
+
+	return hmac.Equal(h.Sum(nil), b[4:20])
+}
+
+// VerifyRadiusMessageAuthenticator checks the Message-Authenticator of the
+// response b, an HMAC-MD5 over b with the request authenticator in place of
+// the response authenticator, see rfc3579 3.2. found reports whether b
+// carries one at all.
+func VerifyRadiusMessageAuthenticator(b []byte, requestAuthenticator [16]byte, secret string) (found, valid bool) {
+	if len(b) < 20 {
+		return false, false
+	}
+
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+
+	if length < 20 || length > len(b) {
+		return false, false
+	}
+
+	for offset := 20; offset+2 <= length; offset += int(b[offset+1]) {
+		size := int(b[offset+1])
+
+		if size < 2 || offset+size > length {
+			return false, false
+		}
+
+		if b[offset] != RadiusAttrMessageAuthenticator {
+			continue
+		}
+
+		if size != 18 {
+			return true, false
+		}
+
+		signed := append([]byte(nil), b[:length]...)
+		copy(signed[4:20], requestAuthenticator[:])
+
+		for i := offset + 2; i < offset+18; i++ {
+			signed[i] = 0
+		}
+
+		mac := hmac.New(md5.New, []byte(secret))
+		mac.Write(signed)
+
+		return true, hmac.Equal(mac.Sum(nil), b[offset+2:offset+18])
+	}
+
+	return false, false
+}
+
+func radiusHidePassword(secret string, authenticator [16]byte, password string) []byte {
+	size := (len(password) + 15) / 16 * 16
+
+	if size == 0 {
+		size = 16
+	}
+
+	if size > 128 {
+		size = 128
+	}
+
+	out := make([]byte, size)
+	copy(out, password)
+	prev := authenticator[:]
+
+	for i := 0; i < size; i += 16 {
+		sum := md5.Sum(append([]byte(secret), prev...))
+
+		for j := 0; j < 16; j++ {
+			out[i+j] ^= sum[j]
+		}
+
+		prev = out[i : i+16]
+	}
+
+	return out
+}
@@ -0,0 +1,265 @@
+package final_socks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type RadiusAuthConfig struct {
+	// Servers are tried in order until one answers.
+	Servers []string
+	// AccountingServers receive Accounting-Start/Interim/Stop records,
+	// accounting is disabled when empty.
+	AccountingServers []string
+	Secret            string
+	NASIdentifier     string
+	Timeout           time.Duration
+	// Retries is how often a server is retried before failing over to the
+	// next one, zero sends each request once per server.
+	Retries         int
+	InterimInterval time.Duration
+}
+
+type radiusSession struct {
+	id       string
+	username string
+	class    []byte
+	started  time.Time
+	stats    ConnStats
+	done     chan struct{}
+}
+
+// RadiusAuth is a CredentialVerifier sending PAP Access-Requests to RADIUS
+// servers, optionally accounting the authenticated connections.
+type RadiusAuth struct {
+	config   RadiusAuthConfig
+	mu       sync.Mutex
+	sessions map[net.Conn]*radiusSession
+}
+
+func NewRadiusAuth(config RadiusAuthConfig) *RadiusAuth {
+	if config.Timeout == 0 {
+		config.Timeout = 3 * time.Second
+	}
+
+	return &RadiusAuth{
+		config:   config,
+		sessions: map[net.Conn]*radiusSession{},
+	}
+}
+
+func (a *RadiusAuth) Verify(conn net.Conn, username, password string) (interface{}, error) {
+	req, err := NewRadiusAccessRequest(a.config.Secret, username, password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	a.addNASAttributes(req, conn)
+
+	resp, err := a.exchange(a.config.Servers, req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Code != RadiusAccessAccept {
+		return nil, errors.New("rejected by radius")
+	}
+
+	if conn != nil && len(a.config.AccountingServers) > 0 {
+		a.startSession(conn, username, resp.Get(RadiusAttrClass))
+	}
+
+	return &Identity{Name: username}, nil
+}
+
+func (a *RadiusAuth) Release(conn net.Conn) {
+	a.mu.Lock()
+	session, ok := a.sessions[conn]
+	delete(a.sessions, conn)
+	a.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	close(session.done)
+}
+
+func (a *RadiusAuth) startSession(conn net.Conn, username string, class []byte) {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+
+	session := &radiusSession{
+		id:       hex.EncodeToString(id),
+		username: username,
+		class:    class,
+		started:  time.Now(),
+		done:     make(chan struct{}),
+	}
+
+	session.stats, _ = conn.(ConnStats)
+
+	a.mu.Lock()
+	a.sessions[conn] = session
+	a.mu.Unlock()
+
+	go func() {
+		a.account(session, conn, RadiusAcctStart)
+
+		var interim <-chan time.Time
+
+		if a.config.InterimInterval > 0 {
+			ticker := time.NewTicker(a.config.InterimInterval)
+			defer ticker.Stop()
+
+			interim = ticker.C
+		}
+
+		for {
+			select {
+			case <-interim:
+				a.account(session, conn, RadiusAcctInterim)
+			case <-session.done:
+				a.account(session, conn, RadiusAcctStop)
+
+				return
+			}
+		}
+	}()
+}
+
+func (a *RadiusAuth) account(session *radiusSession, conn net.Conn, status uint32) {
+	req := &RadiusPacket{Code: RadiusAccountingRequest}
+	req.AddUint32(RadiusAttrAcctStatusType, status)
+	req.Add(RadiusAttrAcctSessionID, []byte(session.id))
+	req.Add(RadiusAttrUserName, []byte(session.username))
+
+	if session.class != nil {
+		req.Add(RadiusAttrClass, session.class)
+	}
+
+	a.addNASAttributes(req, conn)
+
+	if status != RadiusAcctStart {
+		req.AddUint32(RadiusAttrAcctSessionTime, uint32(time.Since(session.started).Seconds()))
+
+		if session.stats != nil {
+			in, out := session.stats.BytesRead(), session.stats.BytesWritten()
+			req.AddUint32(RadiusAttrAcctInputOctets, uint32(in))
+			req.AddUint32(RadiusAttrAcctInputGigawords, uint32(in>>32))
+			req.AddUint32(RadiusAttrAcctOutputOctets, uint32(out))
+			req.AddUint32(RadiusAttrAcctOutputGigawords, uint32(out>>32))
+		}
+	}
+
+	if _, err := a.exchange(a.config.AccountingServers, req); err != nil {
+		fmt.Println(time.Now().Unix(), "radius accounting failed", session.id, err)
+	}
+}
+
+func (a *RadiusAuth) addNASAttributes(req *RadiusPacket, conn net.Conn) {
+	if a.config.NASIdentifier != "" {
+		req.Add(RadiusAttrNASIdentifier, []byte(a.config.NASIdentifier))
+	}
+
+	if conn == nil {
+		return
+	}
+
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() != nil {
+		req.Add(RadiusAttrNASIPAddress, addr.IP.To4())
+	}
+
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		req.Add(RadiusAttrCallingStationID, []byte(addr.IP.String()))
+	}
+}
+
+// exchange sends req to servers in order, retrying each one before failing
+// over to the next.
+func (a *RadiusAuth) exchange(servers []string, req *RadiusPacket) (*RadiusPacket, error) {
+	id := make([]byte, 1)
+	_, _ = rand.Read(id)
+	req.Identifier = id[0]
+
+	b, err := req.EncodeRequest(a.config.Secret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = errors.New("no radius servers configured")
+
+	for _, server := range servers {
+		var resp *RadiusPacket
+
+		for i := 0; i <= a.config.Retries; i++ {
+			resp, err = a.send(server, b, req)
+
+			if err == nil {
+				return resp, nil
+			}
+		}
+	}
+
+	return nil, errors.Wrap(err, "radius request failed")
+}
+
+func (a *RadiusAuth) send(server string, b []byte, req *RadiusPacket) (*RadiusPacket, error) {
+	conn, err := net.Dial("udp", server)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(a.config.Timeout)); err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4096)
+
+	for {
+		n, err := conn.Read(buf)
+
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := ParseRadiusPacket(buf[:n])
+
+		if err != nil || resp.Identifier != req.Identifier {
+			continue
+		}
+
+		if !VerifyRadiusResponse(buf[:n], req.Authenticator, a.config.Secret) {
+			return nil, fmt.Errorf("invalid response authenticator from %v", server)
+		}
+
+		// a request that carried a Message-Authenticator needs one back
+		found, valid := VerifyRadiusMessageAuthenticator(buf[:n], req.Authenticator, a.config.Secret)
+
+		if found && !valid {
+			return nil, fmt.Errorf("invalid message authenticator from %v", server)
+		}
+
+		if !found && req.Get(RadiusAttrMessageAuthenticator) != nil {
+			return nil, fmt.Errorf("missing message authenticator from %v", server)
+		}
+
+		return resp, nil
+	}
+}
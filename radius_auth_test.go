@@ -0,0 +1,282 @@
+package final_socks
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const radiusTestSecret = "testing123"
+
+// radiusStandIn is a local RADIUS server accepting alice/secret and
+// answering accounting requests.
+type radiusStandIn struct {
+	conn       *net.UDPConn
+	drop       atomic.Int64
+	requests   atomic.Int64
+	accounting chan uint32
+	// messageAuth is how access responses carry a Message-Authenticator
+	messageAuth atomic.Int64
+}
+
+const (
+	radiusMessageAuthValid = iota
+	radiusMessageAuthMissing
+	radiusMessageAuthInvalid
+)
+
+func newRadiusStandIn(t *testing.T) *radiusStandIn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &radiusStandIn{
+		conn:       conn,
+		accounting: make(chan uint32, 16),
+	}
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go r.serve()
+
+	return r
+}
+
+func (r *radiusStandIn) Addr() string {
+	return r.conn.LocalAddr().String()
+}
+
+func (r *radiusStandIn) serve() {
+	buf := make([]byte, 4096)
+
+	for {
+		n, addr, err := r.conn.ReadFromUDP(buf)
+
+		if err != nil {
+			return
+		}
+
+		r.requests.Add(1)
+
+		// simulate lost packets
+		if r.drop.Add(-1) >= 0 {
+			continue
+		}
+
+		req, err := ParseRadiusPacket(buf[:n])
+
+		if err != nil {
+			continue
+		}
+
+		resp := &RadiusPacket{Identifier: req.Identifier, Authenticator: req.Authenticator}
+
+		switch req.Code {
+		case RadiusAccessRequest:
+			password := radiusRevealPassword(req.Authenticator, req.Get(RadiusAttrUserPassword))
+			resp.Code = RadiusAccessReject
+
+			if string(req.Get(RadiusAttrUserName)) == "alice" && password == "secret" {
+				resp.Code = RadiusAccessAccept
+				resp.Add(RadiusAttrClass, []byte("gold"))
+			}
+
+			if r.messageAuth.Load() != radiusMessageAuthMissing {
+				resp.Add(RadiusAttrMessageAuthenticator, make([]byte, 16))
+			}
+		case RadiusAccountingRequest:
+			r.accounting <- binary.BigEndian.Uint32(req.Get(RadiusAttrAcctStatusType))
+			resp.Code = RadiusAccountingResponse
+		default:
+			continue
+		}
+
+		b, err := resp.Encode()
+
+		if err != nil {
+			continue
+		}
+
+		// signed over the packet still holding the request authenticator
+		if resp.Get(RadiusAttrMessageAuthenticator) != nil {
+			mac := hmac.New(md5.New, []byte(radiusTestSecret))
+			mac.Write(b)
+			copy(b[len(b)-16:], mac.Sum(nil))
+
+			if r.messageAuth.Load() == radiusMessageAuthInvalid {
+				b[len(b)-1] ^= 0xff
+			}
+		}
+
+		sum := md5.Sum(append(b, radiusTestSecret...))
+		copy(b[4:20], sum[:])
+
+		_, _ = r.conn.WriteToUDP(b, addr)
+	}
+}
+
+func radiusRevealPassword(authenticator [16]byte, hidden []byte) string {
+	out := make([]byte, len(hidden))
+	prev := authenticator[:]
+
+	for i := 0; i+16 <= len(hidden); i += 16 {
+		sum := md5.Sum(append([]byte(radiusTestSecret), prev...))
+
+		for j := 0; j < 16; j++ {
+			out[i+j] = hidden[i+j] ^ sum[j]
+		}
+
+		prev = hidden[i : i+16]
+	}
+
+	for len(out) > 0 && out[len(out)-1] == 0 {
+		out = out[:len(out)-1]
+	}
+
+	return string(out)
+}
+
+func TestRadiusAuthAcceptReject(t *testing.T) {
+	r := newRadiusStandIn(t)
+	auth := NewRadiusAuth(RadiusAuthConfig{Servers: []string{r.Addr()}, Secret: radiusTestSecret})
+
+	if _, err := auth.Verify(nil, "alice", "secret"); err != nil {
+		t.Fatalf("expected Access-Accept: %v", err)
+	}
+
+	if _, err := auth.Verify(nil, "alice", "wrong"); err == nil {
+		t.Fatal("expected Access-Reject")
+	}
+}
+
+func TestRadiusAuthWrongSecret(t *testing.T) {
+	r := newRadiusStandIn(t)
+	auth := NewRadiusAuth(RadiusAuthConfig{Servers: []string{r.Addr()}, Secret: "other"})
+
+	if _, err := auth.Verify(nil, "alice", "secret"); err == nil {
+		t.Fatal("expected a response signed with another secret to be refused")
+	}
+}
+
+func TestRadiusAuthMessageAuthenticator(t *testing.T) {
+	tests := []struct {
+		name        string
+		messageAuth int64
+		allowed     bool
+	}{
+		{name: "valid", messageAuth: radiusMessageAuthValid, allowed: true},
+		{name: "missing", messageAuth: radiusMessageAuthMissing, allowed: false},
+		{name: "invalid", messageAuth: radiusMessageAuthInvalid, allowed: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newRadiusStandIn(t)
+			r.messageAuth.Store(test.messageAuth)
+
+			auth := NewRadiusAuth(RadiusAuthConfig{
+				Servers: []string{r.Addr()},
+				Secret:  radiusTestSecret,
+				Timeout: 50 * time.Millisecond,
+			})
+
+			_, err := auth.Verify(nil, "alice", "secret")
+
+			if allowed := err == nil; allowed != test.allowed {
+				t.Fatalf("allowed = %v, want %v (err %v)", allowed, test.allowed, err)
+			}
+		})
+	}
+}
+
+func TestRadiusAuthRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		requests int64
+		allowed  bool
+	}{
+		{name: "no retries", retries: 0, requests: 1, allowed: false},
+		{name: "retry after timeout", retries: 1, requests: 2, allowed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newRadiusStandIn(t)
+			r.drop.Store(1)
+
+			auth := NewRadiusAuth(RadiusAuthConfig{
+				Servers: []string{r.Addr()},
+				Secret:  radiusTestSecret,
+				Timeout: 50 * time.Millisecond,
+				Retries: test.retries,
+			})
+
+			_, err := auth.Verify(nil, "alice", "secret")
+
+			if allowed := err == nil; allowed != test.allowed {
+				t.Fatalf("allowed = %v, want %v (err %v)", allowed, test.allowed, err)
+			}
+
+			if n := r.requests.Load(); n != test.requests {
+				t.Fatalf("expected %d requests, got %d", test.requests, n)
+			}
+		})
+	}
+}
+
+func TestRadiusAuthFailover(t *testing.T) {
+	down := newRadiusStandIn(t)
+	down.drop.Store(1 << 30)
+	up := newRadiusStandIn(t)
+
+	auth := NewRadiusAuth(RadiusAuthConfig{
+		Servers: []string{down.Addr(), up.Addr()},
+		Secret:  radiusTestSecret,
+		Timeout: 50 * time.Millisecond,
+	})
+
+	if _, err := auth.Verify(nil, "alice", "secret"); err != nil {
+		t.Fatalf("expected failover to the second server: %v", err)
+	}
+}
+
+func TestRadiusAuthAccounting(t *testing.T) {
+	r := newRadiusStandIn(t)
+	auth := NewRadiusAuth(RadiusAuthConfig{
+		Servers:           []string{r.Addr()},
+		AccountingServers: []string{r.Addr()},
+		Secret:            radiusTestSecret,
+	})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	if _, err := auth.Verify(server, "alice", "secret"); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	expectAccounting(t, r, RadiusAcctStart)
+	auth.Release(server)
+	expectAccounting(t, r, RadiusAcctStop)
+}
+
+func expectAccounting(t *testing.T, r *radiusStandIn, status uint32) {
+	t.Helper()
+
+	select {
+	case got := <-r.accounting:
+		if got != status {
+			t.Fatalf("expected Acct-Status-Type %d, got %d", status, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no Acct-Status-Type %d received", status)
+	}
+}
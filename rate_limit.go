@@ -0,0 +1,132 @@
+package final_socks
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket of bytes per second holding at most one
+// second worth of bytes.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// burst is the largest chunk worth reserving at once.
+func (l *rateLimiter) burst() int {
+	if l.rate < 1 {
+		return 1
+	}
+
+	return int(l.rate)
+}
+
+func (l *rateLimiter) refill() {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	l.last = now
+
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+}
+
+// take reserves n bytes and returns how long to wait before using them.
+func (l *rateLimiter) take(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	l.tokens -= float64(n)
+
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// allow takes n bytes if they are available now, for datagrams which are
+// dropped rather than delayed.
+func (l *rateLimiter) allow(n int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+
+	if l.tokens < float64(n) {
+		return false
+	}
+
+	l.tokens -= float64(n)
+
+	return true
+}
+
+// rateLimitedConn shares one limiter between both directions of conn.
+type rateLimitedConn struct {
+	net.Conn
+	limiter *rateLimiter
+}
+
+func newRateLimitedConn(conn net.Conn, bytesPerSecond int64) *rateLimitedConn {
+	return &rateLimitedConn{
+		Conn:    conn,
+		limiter: newRateLimiter(bytesPerSecond),
+	}
+}
+
+func (c *rateLimitedConn) Read(b []byte) (int, error) {
+	if burst := c.limiter.burst(); len(b) > burst {
+		b = b[:burst]
+	}
+
+	n, err := c.Conn.Read(b)
+	time.Sleep(c.limiter.take(n))
+
+	return n, err
+}
+
+func (c *rateLimitedConn) Write(b []byte) (int, error) {
+	var written int
+
+	for len(b) > 0 {
+		chunk := b
+
+		if burst := c.limiter.burst(); len(chunk) > burst {
+			chunk = chunk[:burst]
+		}
+
+		time.Sleep(c.limiter.take(len(chunk)))
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+func (c *rateLimitedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package final_socks
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// the first second worth of bytes is the burst, 3000 bytes at 1000/s
+	// take about two seconds
+	limited := newRateLimitedConn(server, 1000)
+	start := time.Now()
+
+	go func() {
+		_, _ = limited.Write(make([]byte, 3000))
+		_ = limited.Close()
+	}()
+
+	n, _ := io.Copy(io.Discard, client)
+
+	if n != 3000 {
+		t.Fatalf("expected 3000 bytes, got %d", n)
+	}
+
+	if elapsed := time.Since(start); elapsed < 1800*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("3000 bytes at 1000 bytes/s took %v", elapsed)
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := newRateLimiter(1000)
+
+	if !limiter.allow(600) {
+		t.Fatal("expected the burst to allow 600 bytes")
+	}
+
+	if limiter.allow(600) {
+		t.Fatal("expected 1200 bytes to exceed the burst")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	if !limiter.allow(600) {
+		t.Fatal("expected the bucket to refill")
+	}
+}
@@ -2,6 +2,7 @@ package final_socks
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"net"
 
@@ -16,99 +17,185 @@ type Request struct {
 	Command    uint8
 	BufConn    *bufio.Reader
 	User       interface{}
+	// AuthMethod is the negotiated auth method out of the
+	// OfferedAuthMethods sent by the client.
+	AuthMethod         uint8
+	OfferedAuthMethods []uint8
+	// ProxyHeader is the PROXY protocol header of the connection, the real
+	// client address is already in RemoteAddr.
+	ProxyHeader *ProxyHeader
+
+	upstreamProxyProtocol []UpstreamProxyProtocolRule
+	udpSourceMode         UDPSourceMode
+	udpNAT                UDPNATMode
+	udpFragment           UDPFragmentConfig
+	udpStats              *udpCounters
 }
 
 func ReadSocksVersion(bufConn *bufio.Reader) (uint8, error) {
-	version := []byte{0}
+	version, err := bufConn.ReadByte()
 
-	if _, err := bufConn.Read(version); err != nil {
+	if err != nil {
 		return 0, errors.Wrap(err, "failed to get version byte")
 	}
 
-	return version[0], nil
+	return version, nil
 }
 
 func ReadAuthenticateMethods(bufConn *bufio.Reader) ([]byte, error) {
-	header := []byte{0}
+	return readAuthenticateMethods(bufConn, make([]byte, 0, 255))
+}
+
+// readAuthenticateMethods reads into methods, which has room for 255.
+func readAuthenticateMethods(bufConn *bufio.Reader, methods []byte) ([]byte, error) {
+	numMethods, err := bufConn.ReadByte()
 
-	if _, err := bufConn.Read(header); err != nil {
+	if err != nil {
 		return nil, errors.Wrap(err, "failed to get auth methods")
 	}
 
-	numMethods := int(header[0])
-	methods := make([]byte, numMethods)
-	_, err := io.ReadAtLeast(bufConn, methods, numMethods)
+	methods = methods[:numMethods]
+	_, err = io.ReadFull(bufConn, methods)
 
 	return methods, errors.Wrap(err, "failed to get auth methods")
 }
 
+func ReadUserPass(bufConn *bufio.Reader) (string, string, error) {
+	header, err := readBytes(bufConn, 2)
+
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to read auth header")
+	}
+
+	if header[0] != AuthVersion {
+		return "", "", fmt.Errorf("unsupported auth version: %v", header[0])
+	}
+
+	user, err := readString(bufConn, int(header[1]))
+
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to read username")
+	}
+
+	passLen, err := bufConn.ReadByte()
+
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to read password length")
+	}
+
+	pass, err := readString(bufConn, int(passLen))
+
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to read password")
+	}
+
+	return user, pass, nil
+}
+
 func ReadRequest(bufConn *bufio.Reader) (*Request, error) {
-	header := []byte{0, 0, 0}
+	request := &Request{DestAddr: &AddrSpec{}}
 
-	if _, err := io.ReadAtLeast(bufConn, header, 3); err != nil {
-		return nil, errors.Wrap(err, "failed to read header")
+	if err := readRequest(bufConn, request); err != nil {
+		return nil, err
 	}
 
-	addressType := []byte{0}
+	return request, nil
+}
+
+// readRequest fills request, reusing the IP of request.DestAddr.
+func readRequest(bufConn *bufio.Reader, request *Request) error {
+	header, err := readBytes(bufConn, 4)
 
-	if _, err := bufConn.Read(addressType); err != nil {
-		return nil, errors.Wrap(err, "failed read address type")
+	if err != nil {
+		return errors.Wrap(err, "failed to read header")
 	}
 
-	if addressType[0] != AddressIpv4 && addressType[0] != AddressIpv6 && addressType[0] != AddressFqdn {
-		return nil, errors.New("cant read address type")
+	dest := request.DestAddr
+	*dest = AddrSpec{IP: dest.IP[:0]}
+	*request = Request{
+		Version:  header[0],
+		Command:  header[1],
+		DestAddr: dest,
+		BufConn:  bufConn,
 	}
 
-	dest := &AddrSpec{}
+	return readAddrSpec(bufConn, header[3], dest)
+}
 
-	switch addressType[0] {
-	case AddressIpv4:
-		addr := make([]byte, 4)
+// readAddrSpec reads an address of addrType into dest, reusing its IP.
+func readAddrSpec(bufConn *bufio.Reader, addrType uint8, dest *AddrSpec) error {
+	switch addrType {
+	case AddressIpv4, AddressIpv6:
+		ipLen := net.IPv4len
 
-		if _, err := io.ReadAtLeast(bufConn, addr, len(addr)); err != nil {
-			return nil, err
+		if addrType == AddressIpv6 {
+			ipLen = net.IPv6len
 		}
 
-		dest.IP = addr
+		addr, err := readBytes(bufConn, ipLen)
 
-	case AddressIpv6:
-		addr := make([]byte, 16)
-
-		if _, err := io.ReadAtLeast(bufConn, addr, len(addr)); err != nil {
-			return nil, err
+		if err != nil {
+			return err
 		}
 
-		dest.IP = addr
+		dest.IP = append(dest.IP, addr...)
 
 	case AddressFqdn:
-		if _, err := bufConn.Read(addressType); err != nil {
-			return nil, err
-		}
+		addrLen, err := bufConn.ReadByte()
 
-		addrLen := int(addressType[0])
-		fqdn := make([]byte, addrLen)
+		if err != nil {
+			return err
+		}
 
-		if _, err := io.ReadAtLeast(bufConn, fqdn, addrLen); err != nil {
-			return nil, err
+		if dest.FQDN, err = readString(bufConn, int(addrLen)); err != nil {
+			return err
 		}
 
-		dest.FQDN = string(fqdn)
+	default:
+		return errors.New("cant read address type")
 	}
 
-	port := []byte{0, 0}
+	port, err := readBytes(bufConn, 2)
 
-	if _, err := io.ReadAtLeast(bufConn, port, 2); err != nil {
-		return nil, err
+	if err != nil {
+		return err
 	}
 
 	dest.Port = (int(port[0]) << 8) | int(port[1])
 
-	request := &Request{
-		Version:  header[0],
-		Command:  header[1],
-		DestAddr: dest,
-		BufConn:  bufConn,
+	return nil
+}
+
+// WriteRequest sends a request for command and dest, the client side of
+// ReadRequest.
+func WriteRequest(w io.Writer, command uint8, dest *AddrSpec) error {
+	msg, err := appendAddrSpec([]byte{VersionSocks5, command, 0}, dest)
+
+	if err != nil {
+		return err
 	}
 
-	return request, nil
+	_, err = w.Write(msg)
+
+	return err
+}
+
+// readBytes returns the next n bytes without copying them, they are valid
+// until the next read.
+func readBytes(bufConn *bufio.Reader, n int) ([]byte, error) {
+	b, err := bufConn.Peek(n)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, _ = bufConn.Discard(n)
+
+	return b, nil
+}
+
+func readString(bufConn *bufio.Reader, n int) (string, error) {
+	b, err := readBytes(bufConn, n)
+
+	return string(b), err
 }
@@ -1,4 +1,36 @@
 package final_socks
 
+import (
+	"bufio"
+
+	"github.com/pkg/errors"
+)
+
+// Response is the reply of the proxy to a request, read by the client.
 type Response struct {
+	Version  uint8
+	Reply    uint8
+	BindAddr *AddrSpec
+}
+
+// ReadResponse reads the reply to a request, the client side of
+// ResponseWriter.SendReply.
+func ReadResponse(bufConn *bufio.Reader) (*Response, error) {
+	header, err := readBytes(bufConn, 4)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read header")
+	}
+
+	resp := &Response{
+		Version:  header[0],
+		Reply:    header[1],
+		BindAddr: &AddrSpec{},
+	}
+
+	if err := readAddrSpec(bufConn, header[3], resp.BindAddr); err != nil {
+		return nil, errors.Wrap(err, "failed to read bind address")
+	}
+
+	return resp, nil
 }
@@ -1,14 +1,26 @@
 package final_socks
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/pkg/errors"
 	"io"
+	"net"
 	"strings"
+	"sync/atomic"
+
+	"github.com/lunelabs/final-socks/pool"
 )
 
+// replyBufferSize fits the longest reply, one with a 255 byte domain.
+const replyBufferSize = 6 + 1 + 255
+
 type ResponseWriter struct {
 	conn io.Writer
+	// reader is the buffered reader of conn, see Proxy.
+	reader *bufio.Reader
+	// buf is reused for replies when set, see Server.ServeConn.
+	buf *[replyBufferSize]byte
 }
 
 func NewResponseWriter(conn io.Writer) ResponseWriter {
@@ -17,8 +29,24 @@ func NewResponseWriter(conn io.Writer) ResponseWriter {
 	}
 }
 
+func (rw ResponseWriter) buffer(size int) []byte {
+	if rw.buf == nil {
+		return make([]byte, size)
+	}
+
+	return rw.buf[:size]
+}
+
+func (rw ResponseWriter) send(b0, b1 byte) error {
+	msg := rw.buffer(2)
+	msg[0], msg[1] = b0, b1
+	_, err := rw.conn.Write(msg)
+
+	return err
+}
+
 func (rw ResponseWriter) SendNoAuth() error {
-	_, err := rw.conn.Write([]byte{VersionSocks5, AuthNoAuth})
+	err := rw.send(VersionSocks5, AuthNoAuth)
 
 	if err != nil {
 		return errors.Wrap(err, "sending no auth failed")
@@ -28,7 +56,7 @@ func (rw ResponseWriter) SendNoAuth() error {
 }
 
 func (rw ResponseWriter) SendUserPassAuth() error {
-	_, err := rw.conn.Write([]byte{VersionSocks5, AuthUserPass})
+	err := rw.send(VersionSocks5, AuthUserPass)
 
 	if err != nil {
 		return errors.Wrap(err, "sending no auth failed")
@@ -37,8 +65,20 @@ func (rw ResponseWriter) SendUserPassAuth() error {
 	return nil
 }
 
+// SendAuthMethod selects method, custom auth handlers send it before their
+// sub-negotiation.
+func (rw ResponseWriter) SendAuthMethod(method uint8) error {
+	err := rw.send(VersionSocks5, method)
+
+	if err != nil {
+		return errors.Wrap(err, "sending auth method failed")
+	}
+
+	return nil
+}
+
 func (rw ResponseWriter) SendNoAcceptableAuth() error {
-	_, err := rw.conn.Write([]byte{VersionSocks5, AuthNoAcceptable})
+	err := rw.send(VersionSocks5, AuthNoAcceptable)
 
 	if err != nil {
 		return errors.Wrap(err, "sending no acceptable auth failed")
@@ -48,7 +88,7 @@ func (rw ResponseWriter) SendNoAcceptableAuth() error {
 }
 
 func (rw ResponseWriter) SendAuthSuccess() error {
-	_, err := rw.conn.Write([]byte{UserAuthVersion, AuthSuccess})
+	err := rw.send(UserAuthVersion, AuthSuccess)
 
 	if err != nil {
 		return errors.Wrap(err, "sending no acceptable auth failed")
@@ -58,7 +98,7 @@ func (rw ResponseWriter) SendAuthSuccess() error {
 }
 
 func (rw ResponseWriter) SendAuthFailure() error {
-	_, err := rw.conn.Write([]byte{UserAuthVersion, AuthFailure})
+	err := rw.send(UserAuthVersion, AuthFailure)
 
 	if err != nil {
 		return errors.Wrap(err, "sending no acceptable auth failed")
@@ -75,6 +115,14 @@ func (rw ResponseWriter) SendNotSupportedCommand() error {
 	return nil
 }
 
+func (rw ResponseWriter) SendNotAllowed() error {
+	if err := rw.SendReply(ReplyConnectionNotAllowedByRuleset, nil); err != nil {
+		return errors.Wrap(err, "sending not allowed failed")
+	}
+
+	return nil
+}
+
 func (rw ResponseWriter) SendSucceeded(addr *AddrSpec) error {
 	if err := rw.SendReply(ReplySucceeded, addr); err != nil {
 		return errors.Wrap(err, "sending succeeded failed")
@@ -108,55 +156,65 @@ func (rw ResponseWriter) SendNetworkError(msg string) error {
 }
 
 func (rw ResponseWriter) SendReply(resp uint8, addr *AddrSpec) error {
-	var addrType uint8
-	var addrBody []byte
-	var addrPort uint16
+	msg := rw.buffer(replyBufferSize)[:0]
+	msg = append(msg, VersionSocks5, resp, 0)
+	msg, err := appendAddrSpec(msg, addr)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = rw.conn.Write(msg)
 
+	return err
+}
+
+// appendAddrSpec appends the address type, address and port of addr, a nil
+// addr is 0.0.0.0:0.
+func appendAddrSpec(b []byte, addr *AddrSpec) ([]byte, error) {
 	switch {
 	case addr == nil:
-		addrType = AddressIpv4
-		addrBody = []byte{0, 0, 0, 0}
-		addrPort = 0
-
+		return append(b, AddressIpv4, 0, 0, 0, 0, 0, 0), nil
+	case len(addr.FQDN) > 255:
+		return nil, fmt.Errorf("failed to format address: %v", addr)
 	case addr.FQDN != "":
-		addrType = AddressFqdn
-		addrBody = append([]byte{byte(len(addr.FQDN))}, addr.FQDN...)
-		addrPort = uint16(addr.Port)
-
+		b = append(b, AddressFqdn, byte(len(addr.FQDN)))
+		b = append(b, addr.FQDN...)
 	case addr.IP.To4() != nil:
-		addrType = AddressIpv4
-		addrBody = addr.IP.To4()
-		addrPort = uint16(addr.Port)
-
+		b = append(b, AddressIpv4)
+		b = append(b, addr.IP.To4()...)
 	case addr.IP.To16() != nil:
-		addrType = AddressIpv6
-		addrBody = addr.IP.To16()
-		addrPort = uint16(addr.Port)
-
+		b = append(b, AddressIpv6)
+		b = append(b, addr.IP.To16()...)
 	default:
-		return fmt.Errorf("failed to format address: %v", addr)
+		return nil, fmt.Errorf("failed to format address: %v", addr)
 	}
 
-	// Format the Message
-	msg := make([]byte, 6+len(addrBody))
-	msg[0] = VersionSocks5
-	msg[1] = resp
-	msg[2] = 0 // Reserved
-	msg[3] = addrType
-	copy(msg[4:], addrBody)
-	msg[4+len(addrBody)] = byte(addrPort >> 8)
-	msg[4+len(addrBody)+1] = byte(addrPort & 0xff)
-
-	// Send the Message
-	_, err := rw.conn.Write(msg)
-
-	return err
+	return append(b, byte(addr.Port>>8), byte(addr.Port)), nil
 }
 
+// Proxy copies between the client and target until both directions are
+// done. When bufConn is the request reader of the connection, the bytes it
+// already buffered are sent first, then the client connection is read
+// directly so TCP to TCP tunnels use splice on Linux.
 func (rw ResponseWriter) Proxy(target io.ReadWriter, bufConn io.Reader) error {
 	errCh := make(chan error, 2)
+	src := bufConn
 
-	go rw.proxy(target, bufConn, errCh)
+	if br, ok := bufConn.(*bufio.Reader); ok && br == rw.reader {
+		if client, ok := rw.conn.(io.Reader); ok {
+			buffered, _ := br.Peek(br.Buffered())
+
+			if _, err := target.Write(buffered); err != nil {
+				return err
+			}
+
+			_, _ = br.Discard(len(buffered))
+			src = client
+		}
+	}
+
+	go rw.proxy(target, src, errCh)
 	go rw.proxy(rw.conn, target, errCh)
 
 	for i := 0; i < 2; i++ {
@@ -175,7 +233,7 @@ func (rw ResponseWriter) GetConnection() io.Writer {
 }
 
 func (rw ResponseWriter) proxy(dst io.Writer, src io.Reader, errCh chan error) {
-	_, err := io.Copy(dst, src)
+	_, err := copyConn(dst, src)
 
 	if tcpConn, ok := dst.(closeWriter); ok {
 		tcpConn.CloseWrite()
@@ -183,3 +241,58 @@ func (rw ResponseWriter) proxy(dst io.Writer, src io.Reader, errCh chan error) {
 
 	errCh <- err
 }
+
+const proxyBufferSize = 32 * 1024
+
+// spliceChunkSize bounds a single splice, the statsConn counters are
+// updated after each chunk so interim accounting sees running tunnels.
+const spliceChunkSize = 256 * 1024
+
+// copyConn leaves TCP to TCP copies to the kernel, everything else, e.g.
+// TLS or WebSocket clients, is copied through a pooled buffer instead of
+// the one io.Copy allocates.
+func copyConn(dst io.Writer, src io.Reader) (int64, error) {
+	if dstTCP, srcTCP := tcpConn(dst), tcpConn(src); dstTCP != nil && srcTCP != nil {
+		dstStats, _ := dst.(*statsConn)
+		srcStats, _ := src.(*statsConn)
+
+		// the bare connections, splice does not see through statsConn
+		chunk := &io.LimitedReader{R: srcTCP}
+		var written int64
+
+		for {
+			chunk.N = spliceChunkSize
+			n, err := dstTCP.ReadFrom(chunk)
+			written += n
+
+			if dstStats != nil {
+				atomic.AddInt64(&dstStats.written, n)
+			}
+
+			if srcStats != nil {
+				atomic.AddInt64(&srcStats.read, n)
+			}
+
+			// a short chunk is EOF
+			if err != nil || n < spliceChunkSize {
+				return written, err
+			}
+		}
+	}
+
+	buf := pool.GetBuffer(proxyBufferSize)
+	defer pool.PutBuffer(buf)
+
+	// hide ReadFrom and WriteTo, they would not use buf
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf)
+}
+
+func tcpConn(v interface{}) *net.TCPConn {
+	if c, ok := v.(*statsConn); ok {
+		v = c.Conn
+	}
+
+	c, _ := v.(*net.TCPConn)
+
+	return c
+}
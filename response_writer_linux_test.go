@@ -0,0 +1,101 @@
+package final_socks
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/lunelabs/final-socks/pool"
+)
+
+// TestProxySplice checks both directions of a TCP tunnel are left to
+// splice, a copy in user space allocates a 32KB buffer per direction.
+func TestProxySplice(t *testing.T) {
+	chunk := make([]byte, 64*1024)
+	buf := make([]byte, len(chunk))
+
+	// the first listener reads the backlog limit through a 64KB buffer
+	warm, warmPeer := tcpPair(t)
+	_ = warm.Close()
+	_ = warmPeer.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	client, target, done := proxyTunnel(t)
+	defer client.Close()
+	defer target.Close()
+
+	for _, pair := range [][2]net.Conn{{client, target}, {target, client}} {
+		from, to := pair[0], pair[1]
+
+		go func() {
+			for i := 0; i < 16; i++ {
+				_, _ = from.Write(chunk)
+			}
+		}()
+
+		for i := 0; i < 16; i++ {
+			if _, err := io.ReadFull(to, buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	runtime.ReadMemStats(&after)
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated >= 32*1024 {
+		t.Fatalf("a 1MB tunnel each way allocated %d bytes, not spliced", allocated)
+	}
+
+	_ = client.(*net.TCPConn).CloseWrite()
+	_ = target.(*net.TCPConn).CloseWrite()
+	<-done
+}
+
+// TestProxySpliceStats checks the counters of a spliced tunnel are updated
+// while it runs, not only once it is closed.
+func TestProxySpliceStats(t *testing.T) {
+	client, serverSide := tcpPair(t)
+	targetSide, target := tcpPair(t)
+	defer client.Close()
+	defer target.Close()
+
+	conn := newStatsConn(serverSide)
+	bufConn := pool.GetBufReader(conn)
+	rw := ResponseWriter{conn: conn, reader: bufConn}
+
+	go func() {
+		_ = rw.Proxy(targetSide, bufConn)
+		_ = serverSide.Close()
+		_ = targetSide.Close()
+		pool.PutBufReader(bufConn)
+	}()
+
+	data := make([]byte, 2*spliceChunkSize)
+
+	for _, pair := range [][2]net.Conn{{client, target}, {target, client}} {
+		from, to := pair[0], pair[1]
+
+		go func() {
+			_, _ = from.Write(data)
+		}()
+
+		if _, err := io.ReadFull(to, make([]byte, len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := int64(len(data))
+	deadline := time.Now().Add(5 * time.Second)
+
+	for conn.BytesRead() != want || conn.BytesWritten() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("open tunnel read %d and wrote %d bytes, want %d each", conn.BytesRead(), conn.BytesWritten(), want)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
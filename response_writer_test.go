@@ -0,0 +1,177 @@
+package final_socks
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/lunelabs/final-socks/pool"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted, err := listener.Accept()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+// proxyTunnel runs ResponseWriter.Proxy the way Server.ServeConn does and
+// returns the client and target ends of the tunnel.
+func proxyTunnel(t testing.TB) (client, target net.Conn, done chan error) {
+	client, serverSide := tcpPair(t)
+	targetSide, target := tcpPair(t)
+	conn := newStatsConn(serverSide)
+	bufConn := pool.GetBufReader(conn)
+	rw := ResponseWriter{conn: conn, reader: bufConn}
+	done = make(chan error, 1)
+
+	go func() {
+		err := rw.Proxy(targetSide, bufConn)
+		_ = serverSide.Close()
+		_ = targetSide.Close()
+		pool.PutBufReader(bufConn)
+		done <- err
+	}()
+
+	return client, target, done
+}
+
+func TestProxyBufferedBytes(t *testing.T) {
+	client, serverSide := tcpPair(t)
+	targetSide, target := tcpPair(t)
+	defer client.Close()
+	defer target.Close()
+
+	conn := newStatsConn(serverSide)
+	bufConn := pool.GetBufReader(conn)
+	rw := ResponseWriter{conn: conn, reader: bufConn}
+
+	// the request and the first bytes of the tunnel arrive together
+	if _, err := client.Write([]byte("requesthello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(bufConn, make([]byte, len("request"))); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_ = rw.Proxy(targetSide, bufConn)
+		_ = serverSide.Close()
+		_ = targetSide.Close()
+	}()
+
+	_ = client.CloseWrite()
+	got, err := io.ReadAll(target)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "hello" {
+		t.Fatalf("target read %q, want %q", got, "hello")
+	}
+}
+
+func TestProxyForeignReader(t *testing.T) {
+	client, serverSide := tcpPair(t)
+	targetSide, target := tcpPair(t)
+	defer client.Close()
+	defer target.Close()
+
+	conn := newStatsConn(serverSide)
+	rw := ResponseWriter{conn: conn, reader: pool.GetBufReader(conn)}
+
+	// a reader of the handler's own must be read through, whatever it
+	// wraps
+	foreign := bufio.NewReader(io.MultiReader(strings.NewReader("prefix-"), conn))
+
+	go func() {
+		_ = rw.Proxy(targetSide, foreign)
+		_ = serverSide.Close()
+		_ = targetSide.Close()
+	}()
+
+	_, _ = client.Write([]byte("payload"))
+	_ = client.CloseWrite()
+	got, err := io.ReadAll(target)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "prefix-payload" {
+		t.Fatalf("target read %q, want %q", got, "prefix-payload")
+	}
+}
+
+func BenchmarkProxyThroughput(b *testing.B) {
+	client, target, done := proxyTunnel(b)
+	defer client.Close()
+	defer target.Close()
+
+	chunk := make([]byte, 64*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := target.Write(chunk); err != nil {
+				return
+			}
+		}
+
+		_ = target.(*net.TCPConn).CloseWrite()
+	}()
+
+	buf := make([]byte, len(chunk))
+
+	for i := 0; i < b.N; i++ {
+		if _, err := io.ReadFull(client, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.StopTimer()
+	_ = client.(*net.TCPConn).CloseWrite()
+	<-done
+}
+
+func BenchmarkProxyTunnel(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		client, target, done := proxyTunnel(b)
+		b.StartTimer()
+
+		_, _ = client.Write([]byte("ping"))
+		_ = client.(*net.TCPConn).CloseWrite()
+		_, _ = io.ReadFull(target, make([]byte, 4))
+		_ = target.(*net.TCPConn).CloseWrite()
+		<-done
+		_ = client.Close()
+		_ = target.Close()
+	}
+}
@@ -0,0 +1,55 @@
+package final_socks
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const reusePortSupported = true
+
+// listenReusePort opens acceptors sockets on address sharing the port with
+// SO_REUSEPORT, the kernel balances new connections across them.
+func listenReusePort(network, address string, acceptors int) ([]net.Listener, error) {
+	config := net.ListenConfig{
+		Control: func(network, address string, conn syscall.RawConn) error {
+			var sockErr error
+
+			err := conn.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+
+			if err != nil {
+				return err
+			}
+
+			return sockErr
+		},
+	}
+
+	listeners := make([]net.Listener, 0, acceptors)
+
+	for i := 0; i < acceptors; i++ {
+		// an ephemeral port has to be shared by the following sockets
+		if i == 1 {
+			address = listeners[0].Addr().String()
+		}
+
+		listener, err := config.Listen(context.Background(), network, address)
+
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+
+			return nil, errors.Wrapf(err, "failed to listen on %v %v", network, address)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
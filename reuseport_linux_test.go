@@ -0,0 +1,85 @@
+package final_socks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	listeners, err := listenReusePort("tcp", "127.0.0.1:0", 4)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+	}()
+
+	if len(listeners) != 4 {
+		t.Fatalf("got %d listeners, want 4", len(listeners))
+	}
+
+	port := listeners[0].Addr().(*net.TCPAddr).Port
+
+	for _, listener := range listeners[1:] {
+		if p := listener.Addr().(*net.TCPAddr).Port; p != port {
+			t.Fatalf("acceptor listens on port %d, want %d", p, port)
+		}
+	}
+
+	// a socket without SO_REUSEPORT cannot join them
+	if listener, err := net.Listen("tcp", listeners[0].Addr().String()); err == nil {
+		_ = listener.Close()
+
+		t.Fatal("plain listen on the shared port succeeded")
+	}
+}
+
+func TestServerReusePortAcceptors(t *testing.T) {
+	server := NewServer("127.0.0.1:0", func(w ResponseWriter, r *Request) {
+		_ = w.SendSucceeded(r.DestAddr)
+	})
+
+	for _, option := range []Option{NoAuthOption(), ReusePort(3)} {
+		if err := server.SetOption(option); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serveErr := make(chan error, 1)
+
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	defer func() {
+		_ = server.Close()
+		<-serveErr
+	}()
+
+	waitAcceptors(t, server, 3)
+
+	server.state.mu.Lock()
+	addr := server.state.listenerOrder[0].Addr().String()
+	server.state.mu.Unlock()
+
+	const conns = 30
+
+	for i := 0; i < conns; i++ {
+		_ = connectTest(t, addr).Close()
+	}
+
+	stats := server.AcceptStats()
+	total := uint64(0)
+
+	for _, accepted := range stats.PerAcceptor {
+		total += accepted
+	}
+
+	if len(stats.PerAcceptor) != 3 || stats.Accepted != conns || total != conns {
+		t.Fatalf("AcceptStats = %+v, want %d connections over 3 acceptors", stats, conns)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package final_socks
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+const reusePortSupported = false
+
+func listenReusePort(network, address string, acceptors int) ([]net.Listener, error) {
+	return nil, errors.New("SO_REUSEPORT acceptors are only supported on linux")
+}
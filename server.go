@@ -2,19 +2,43 @@ package final_socks
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
 	"fmt"
 	"net"
-	"sort"
+	"sync"
+	"time"
 
+	"github.com/lunelabs/final-socks/pool"
 	"github.com/pkg/errors"
 )
 
+// Handler serves a request. The Request, its BufConn and the reply buffer
+// of the ResponseWriter are reused for the next connection once it returns,
+// handlers must not keep them or use them from goroutines still running.
 type Handler func(ResponseWriter, *Request)
 
 type Server struct {
 	addr         string
 	handler      Handler
 	AuthHandlers map[uint8]AuthHandler
+	// AuthPreference is the server side order of auth methods, client
+	// offered methods not listed are tried afterwards highest first unless
+	// RequireAuthPreference is set.
+	AuthPreference        []uint8
+	RequireAuthPreference bool
+	sourceAuthPolicy      *SourceAuthPolicy
+	tlsConfig             *tls.Config
+	// certAuthHandler answers the no auth method on TLS connections.
+	certAuthHandler       AuthHandler
+	proxyProtocolTrusted  []*net.IPNet
+	upstreamProxyProtocol []UpstreamProxyProtocolRule
+	listeners             []ListenerConfig
+	reusePortAcceptors    int
+	udpSourceMode         UDPSourceMode
+	udpNAT                UDPNATMode
+	udpFragment           UDPFragmentConfig
+	state                 *serverState
 }
 
 func NewServer(addr string, handler Handler) *Server {
@@ -26,6 +50,7 @@ func NewServer(addr string, handler Handler) *Server {
 		addr:         addr,
 		handler:      handler,
 		AuthHandlers: map[uint8]AuthHandler{},
+		state:        newServerState(),
 	}
 }
 
@@ -33,24 +58,85 @@ func (s *Server) SetOption(option Option) error {
 	return option(s)
 }
 
+// ListenAndServe listens on the server address or, when listeners were
+// added, on all of them until one fails.
 func (s *Server) ListenAndServe() error {
-	listener, err := net.Listen("tcp", s.addr)
+	return s.serveListeners()
+}
 
-	if err != nil {
-		return err
+// ListenAndServeTLS serves SOCKS over TLS with the certificate and key
+// files, reloading them on change or SIGHUP. Empty files use the config of
+// a TLSListener option.
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	if certFile == "" && keyFile == "" && s.tlsConfig == nil {
+		return errors.New("tls listener requires a certificate")
+	}
+
+	if certFile != "" || keyFile != "" {
+		if err := s.SetOption(TLSListener(TLSConfig{
+			CertFile:       certFile,
+			KeyFile:        keyFile,
+			ReloadInterval: DefaultTLSReloadInterval,
+			ReloadOnSIGHUP: true,
+		})); err != nil {
+			return err
+		}
 	}
 
-	return s.Serve(listener)
+	return s.ListenAndServe()
 }
 
 func (s *Server) Serve(listener net.Listener) error {
+	counter, ok := s.state.addListener(listener)
+
+	if !ok {
+		_ = listener.Close()
+
+		return ErrServerClosed
+	}
+
+	defer s.state.removeListener(listener)
+
+	if s.proxyProtocolTrusted != nil {
+		listener = NewProxyProtocolListener(listener, s.proxyProtocolTrusted)
+	}
+
+	if s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+
+	var retryDelay time.Duration
+
 	for {
 		conn, err := listener.Accept()
 
 		if err != nil {
+			if s.state.isClosed() {
+				return ErrServerClosed
+			}
+
+			counter.errors.Add(1)
+
+			// back off on e.g. running out of file descriptors during a
+			// connection storm instead of giving up on the listener
+			if temporary, ok := err.(interface{ Temporary() bool }); ok && temporary.Temporary() {
+				if retryDelay = retryDelay * 2; retryDelay == 0 {
+					retryDelay = 5 * time.Millisecond
+				} else if retryDelay > time.Second {
+					retryDelay = time.Second
+				}
+
+				time.Sleep(retryDelay)
+
+				continue
+			}
+
 			return err
 		}
 
+		retryDelay = 0
+		counter.accept(time.Now().Unix())
+
 		go s.ServeConn(conn)
 	}
 }
@@ -58,7 +144,25 @@ func (s *Server) Serve(listener net.Listener) error {
 func (s *Server) ServeConn(conn net.Conn) error {
 	defer conn.Close()
 
-	bufConn := bufio.NewReader(conn)
+	if !s.state.addConn(conn) {
+		return ErrServerClosed
+	}
+
+	defer s.state.removeConn(conn)
+
+	// not pooled, auth accounting may read the counters after ServeConn
+	// returns
+	conn = newStatsConn(conn)
+
+	bufConn := pool.GetBufReader(conn)
+	buffers := connBuffersPool.Get().(*connBuffers)
+
+	defer func() {
+		buffers.reset()
+		connBuffersPool.Put(buffers)
+		pool.PutBufReader(bufConn)
+	}()
+
 	socksVersion, err := ReadSocksVersion(bufConn)
 
 	if err != nil {
@@ -69,16 +173,20 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		return fmt.Errorf("unsupported socks version: %v", socksVersion)
 	}
 
-	rw := NewResponseWriter(conn)
-	user, err := s.authenticate(conn, bufConn, rw)
+	rw := ResponseWriter{conn: conn, reader: bufConn, buf: &buffers.reply}
+	auth := &buffers.auth
 
-	if err != nil {
+	if err := s.authenticate(conn, bufConn, rw, buffers); err != nil {
 		return errors.Wrap(err, "failed to authenticate")
 	}
 
-	req, err := ReadRequest(bufConn)
+	if releaser, ok := auth.handler.(AuthReleaser); ok {
+		defer releaser.Release(conn)
+	}
+
+	req := &buffers.request
 
-	if err != nil {
+	if err := readRequest(bufConn, req); err != nil {
 		return errors.Wrap(err, "failed to read request")
 	}
 
@@ -86,7 +194,9 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		return fmt.Errorf("unsupported socks version: %v", socksVersion)
 	}
 
-	req.User = user
+	req.User = auth.user
+	req.AuthMethod = auth.method
+	req.OfferedAuthMethods = auth.offered
 	req = s.decorateRequestWithConnectionInfo(req, conn)
 
 	s.handler(rw, req)
@@ -103,29 +213,143 @@ func (s *Server) decorateRequestWithConnectionInfo(req *Request, conn net.Conn)
 		req.RemoteAddr = *val
 	}
 
+	req.ProxyHeader = ProxyHeaderFromConn(conn)
+	req.upstreamProxyProtocol = s.upstreamProxyProtocol
+	req.udpSourceMode = s.udpSourceMode
+	req.udpNAT = s.udpNAT
+	req.udpFragment = s.udpFragment
+	req.udpStats = &s.state.udp
+
 	return req
 }
 
-func (s *Server) authenticate(conn net.Conn, bufConn *bufio.Reader, rw ResponseWriter) (interface{}, error) {
-	authMethods, err := ReadAuthenticateMethods(bufConn)
+type authResult struct {
+	handler AuthHandler
+	user    interface{}
+	method  uint8
+	offered []uint8
+}
+
+// connBuffers is the per connection state of the handshake, pooled so the
+// handshake does not allocate. The request and its BufConn are only valid
+// until the handler returns, see Handler.
+type connBuffers struct {
+	methods [255]byte
+	offered [255]byte
+	order   [255]byte
+	reply   [replyBufferSize]byte
+	ip      [net.IPv6len]byte
+	dest    AddrSpec
+	request Request
+	auth    authResult
+}
+
+var connBuffersPool = sync.Pool{
+	New: func() any {
+		buffers := &connBuffers{}
+		buffers.reset()
+
+		return buffers
+	},
+}
+
+func (b *connBuffers) reset() {
+	b.dest = AddrSpec{IP: b.ip[:0]}
+	b.request = Request{DestAddr: &b.dest}
+	b.auth = authResult{}
+}
+
+func (s *Server) authenticate(conn net.Conn, bufConn *bufio.Reader, rw ResponseWriter, buffers *connBuffers) error {
+	authMethods, err := readAuthenticateMethods(bufConn, buffers.methods[:0])
 
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	var allowed []uint8
+	var identity *Identity
+
+	if s.sourceAuthPolicy != nil {
+		allowed, identity = s.sourceAuthPolicy.Match(connIP(conn))
 	}
 
-	sort.Slice(authMethods, func(i, j int) bool { return authMethods[i] > authMethods[j] })
+	result := &buffers.auth
+	result.offered = append(buffers.offered[:0], authMethods...)
+
+	for _, authMethod := range s.authMethodOrder(authMethods, buffers.order[:0]) {
+		if s.sourceAuthPolicy != nil && bytes.IndexByte(allowed, authMethod) < 0 {
+			continue
+		}
+
+		if handler, ok := s.authHandler(conn, authMethod); ok {
+			result.handler = handler
+			result.method = authMethod
+			result.user, err = handler.Authenticate(conn, bufConn, rw)
+
+			if err == nil && result.user == nil && authMethod == AuthNoAuth && identity != nil {
+				result.user = identity
+			}
 
-	for _, authMethod := range authMethods {
-		if handler, ok := s.AuthHandlers[authMethod]; ok {
-			return handler.Authenticate(conn, bufConn, rw)
+			return err
 		}
 	}
 
 	if err = rw.SendNoAcceptableAuth(); err != nil {
-		return nil, err
+		return err
+	}
+
+	return errors.New("no acceptable auth method")
+}
+
+func (s *Server) authHandler(conn net.Conn, method uint8) (AuthHandler, bool) {
+	if method == AuthNoAuth && s.certAuthHandler != nil {
+		if state, ok := tlsConnectionState(conn); ok {
+			// a TLS client without a certificate has to use another method
+			if len(state.VerifiedChains) == 0 {
+				return nil, false
+			}
+
+			return s.certAuthHandler, true
+		}
+	}
+
+	handler, ok := s.AuthHandlers[method]
+
+	return handler, ok
+}
+
+// authMethodOrder returns the client offered methods in the order they are
+// tried, appended to order. Without a server preference the highest method
+// code wins.
+func (s *Server) authMethodOrder(offered []uint8, order []uint8) []uint8 {
+	// insertion sort, sort.Slice allocates
+	for i := 1; i < len(offered); i++ {
+		for j := i; j > 0 && offered[j] > offered[j-1]; j-- {
+			offered[j], offered[j-1] = offered[j-1], offered[j]
+		}
+	}
+
+	if len(s.AuthPreference) == 0 {
+		return offered
+	}
+
+	for _, method := range s.AuthPreference {
+		if bytes.IndexByte(offered, method) >= 0 {
+			order = append(order, method)
+		}
+	}
+
+	if s.RequireAuthPreference {
+		return order
+	}
+
+	for _, method := range offered {
+		if bytes.IndexByte(order, method) < 0 {
+			order = append(order, method)
+		}
 	}
 
-	return nil, errors.New("authentication failed")
+	return order
 }
 
 func Handle(handler Handler) {
@@ -149,3 +373,21 @@ func ListenAndServe(addr string, handler Handler, options ...Option) error {
 
 	return s.ListenAndServe()
 }
+
+func ListenAndServeTLS(addr, certFile, keyFile string, handler Handler, options ...Option) error {
+	serverHandler := DefaultHandler
+
+	if handler != nil {
+		serverHandler = handler
+	}
+
+	s := NewServer(addr, serverHandler)
+
+	for _, option := range options {
+		if err := s.SetOption(option); err != nil {
+			return err
+		}
+	}
+
+	return s.ListenAndServeTLS(certFile, keyFile)
+}
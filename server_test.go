@@ -0,0 +1,233 @@
+package final_socks
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// BenchmarkHandshake reports the allocations of a no auth CONNECT handshake
+// up to the handler, net.Pipe and the goroutine included.
+func BenchmarkHandshake(b *testing.B) {
+	server := NewServer("", func(w ResponseWriter, r *Request) {
+		_ = w.SendSucceeded(r.DestAddr)
+	})
+
+	if err := server.SetOption(NoAuthOption()); err != nil {
+		b.Fatal(err)
+	}
+
+	msg := []byte{VersionSocks5, 1, AuthNoAuth}
+	msg = append(msg, VersionSocks5, CommandConnect, 0, AddressIpv4, 127, 0, 0, 1, 0, 80)
+	reply := make([]byte, 2+10)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		client, conn := net.Pipe()
+		done := make(chan struct{})
+
+		go func() {
+			_ = server.ServeConn(conn)
+
+			close(done)
+		}()
+
+		go func() {
+			_, _ = client.Write(msg)
+		}()
+
+		if _, err := io.ReadFull(client, reply); err != nil {
+			b.Fatal(err)
+		}
+
+		_ = client.Close()
+		<-done
+	}
+}
+
+func TestServeConnReusesRequest(t *testing.T) {
+	type seen struct {
+		dest    string
+		user    interface{}
+		offered []uint8
+	}
+
+	requests := make(chan seen, 1)
+	server := NewServer("", func(w ResponseWriter, r *Request) {
+		_ = w.SendSucceeded(r.DestAddr)
+
+		// the request is only valid until the handler returns
+		requests <- seen{
+			dest:    r.DestAddr.String(),
+			user:    r.User,
+			offered: append([]uint8(nil), r.OfferedAuthMethods...),
+		}
+	})
+
+	if err := server.SetOption(NoAuthOption()); err != nil {
+		t.Fatal(err)
+	}
+
+	server.AuthHandlers[0x80] = &methodAuthHandler{method: 0x80}
+
+	fqdnRequest := []byte{VersionSocks5, 1, 0x80, VersionSocks5, CommandConnect, 0, AddressFqdn, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 1, 187}
+	ipRequest := []byte{VersionSocks5, 1, AuthNoAuth, VersionSocks5, CommandConnect, 0, AddressIpv4, 10, 0, 0, 2, 0, 80}
+
+	tests := []struct {
+		name    string
+		msg     []byte
+		reply   int
+		dest    string
+		user    bool
+		offered []uint8
+	}{
+		{name: "fqdn with custom method", msg: fqdnRequest, reply: 2 + 4 + 1 + 11 + 2, dest: "example.com (<nil>):443", user: true, offered: []uint8{0x80}},
+		{name: "ip with no auth", msg: ipRequest, reply: 2 + 10, dest: "10.0.0.2:80", offered: []uint8{AuthNoAuth}},
+	}
+
+	// one after the other, so the second connection gets the pooled request
+	// of the first
+	for _, test := range tests {
+		client, conn := net.Pipe()
+
+		go func() {
+			_ = server.ServeConn(conn)
+		}()
+
+		go func() {
+			_, _ = client.Write(test.msg)
+		}()
+
+		if _, err := io.ReadFull(client, make([]byte, test.reply)); err != nil {
+			t.Fatal(err)
+		}
+
+		got := <-requests
+		_ = client.Close()
+
+		if got.dest != test.dest || (got.user != nil) != test.user || !bytes.Equal(got.offered, test.offered) {
+			t.Fatalf("%s: got %+v, want dest %v, user %v, offered %v", test.name, got, test.dest, test.user, test.offered)
+		}
+	}
+}
+
+// negotiate serves conn and offers methods from client, it returns the
+// method the server selected.
+func negotiate(t *testing.T, server *Server, client, conn net.Conn, methods ...uint8) uint8 {
+	go func() {
+		_ = server.ServeConn(conn)
+	}()
+
+	greeting := append([]byte{VersionSocks5, byte(len(methods))}, methods...)
+
+	if _, err := client.Write(greeting); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, 2)
+
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	return reply[1]
+}
+
+// methodAuthHandler selects method and lets the client in as method.
+type methodAuthHandler struct {
+	method uint8
+}
+
+func (h *methodAuthHandler) Authenticate(conn net.Conn, bufConn *bufio.Reader, rw ResponseWriter) (interface{}, error) {
+	if err := rw.SendAuthMethod(h.method); err != nil {
+		return nil, err
+	}
+
+	return h.method, nil
+}
+
+func TestAuthMethodOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		preference []uint8
+		require    bool
+		offered    []uint8
+		selected   uint8
+	}{
+		{
+			name:     "highest code without preference",
+			offered:  []uint8{AuthNoAuth, AuthUserPass, 0x80},
+			selected: 0x80,
+		},
+		{
+			name:       "preference over client order",
+			preference: []uint8{AuthNoAuth, AuthUserPass},
+			offered:    []uint8{AuthUserPass, 0x80, AuthNoAuth},
+			selected:   AuthNoAuth,
+		},
+		{
+			name:       "unlisted methods tried afterwards",
+			preference: []uint8{0x81},
+			offered:    []uint8{AuthNoAuth, AuthUserPass},
+			selected:   AuthUserPass,
+		},
+		{
+			name:       "require refuses unlisted methods",
+			preference: []uint8{0x81},
+			require:    true,
+			offered:    []uint8{AuthNoAuth, AuthUserPass, 0x80},
+			selected:   AuthNoAcceptable,
+		},
+		{
+			name:       "require accepts listed methods",
+			preference: []uint8{0x81, 0x80},
+			require:    true,
+			offered:    []uint8{AuthNoAuth, 0x80},
+			selected:   0x80,
+		},
+		{
+			name:     "custom method dispatched",
+			offered:  []uint8{0x81},
+			selected: 0x81,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := NewServer("", func(w ResponseWriter, r *Request) {})
+
+			for _, method := range []uint8{AuthNoAuth, AuthUserPass, 0x80, 0x81} {
+				if err := server.SetOption(AuthMethod(method, &methodAuthHandler{method: method})); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if test.preference != nil {
+				if err := server.SetOption(AuthMethodPreference(test.require, test.preference...)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			client, conn := net.Pipe()
+			defer client.Close()
+
+			if selected := negotiate(t, server, client, conn, test.offered...); selected != test.selected {
+				t.Fatalf("selected %#x, want %#x", selected, test.selected)
+			}
+		})
+	}
+}
+
+func TestAuthMethodPreferenceInvalid(t *testing.T) {
+	server := NewServer("", nil)
+
+	for _, methods := range [][]uint8{{AuthNoAcceptable}, {0x10}, {AuthNoAuth, AuthNoAuth}} {
+		if err := server.SetOption(AuthMethodPreference(false, methods...)); err == nil {
+			t.Errorf("%v: accepted", methods)
+		}
+	}
+}
@@ -5,23 +5,51 @@ import (
 	"fmt"
 	"github.com/lunelabs/final-socks/pool"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Message struct {
 	Dst net.Addr
 	Msg []byte
+	// buf is the pooled buffer Msg is a part of, if any.
+	buf []byte
+	// target is the destination of a shared session message, resolved by
+	// the session when Dst is nil.
+	target Addr
+}
+
+func (m Message) release() {
+	if m.buf != nil {
+		pool.PutBuffer(m.buf)
+	} else {
+		pool.PutBuffer(m.Msg)
+	}
 }
 
 // Session is udp session
 type Session struct {
-	key    string
-	src    net.Addr
-	dst    net.Addr
-	srcPC  *PktConn
-	exitIP net.IP
-	msgCh  chan Message
-	finCh  chan struct{}
+	key         string
+	src         net.Addr
+	dst         net.Addr
+	srcPC       *PktConn
+	exitIP      net.IP
+	msgCh       chan Message
+	finCh       chan struct{}
+	done        chan struct{}
+	lastActive  atomic.Int64
+	idleTimeout time.Duration
+	filter      *natFilter
+	stats       *udpCounters
+	limiter     *rateLimiter
+	// fragmentSize splits larger replies into fragments when not 0.
+	fragmentSize int
+	// resolved caches the domains of a shared session, pending holds the
+	// messages waiting for a lookup.
+	resolveMu sync.Mutex
+	resolved  map[string]*net.UDPAddr
+	pending   map[string][]Message
 }
 
 func NewSession(
@@ -31,23 +59,92 @@ func NewSession(
 	srcPC *PktConn,
 	exitIP net.IP,
 ) *Session {
-	return &Session{
-		key:    key,
-		src:    src,
-		dst:    dst,
-		srcPC:  srcPC,
-		exitIP: exitIP,
-		msgCh:  make(chan Message, 32),
-		finCh:  make(chan struct{}),
+	s := &Session{
+		key:         key,
+		src:         src,
+		dst:         dst,
+		srcPC:       srcPC,
+		exitIP:      exitIP,
+		msgCh:       make(chan Message, 32),
+		finCh:       make(chan struct{}),
+		done:        make(chan struct{}),
+		idleTimeout: UDPIdleTimeout,
+		filter:      newNATFilter(UDPNATSymmetric),
 	}
+
+	s.touch()
+
+	return s
 }
 
+// ProcessMessage queues message for the destination, it is dropped when
+// the queue is full or the session is over. The session owns the pooled
+// buffer of message either way.
 func (s *Session) ProcessMessage(message Message) {
-	s.msgCh <- message
+	if !s.deliver(message) {
+		message.release()
+	}
+}
+
+// deliver queues message and reports whether the session took it.
+func (s *Session) deliver(message Message) bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+
+	select {
+	case s.msgCh <- message:
+		return true
+	default:
+		// a full queue drops like a full socket buffer would
+		message.release()
+
+		if s.stats != nil {
+			s.stats.queueDropped.Add(1)
+		}
+
+		return true
+	}
+}
+
+func (s *Session) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
 }
 
+// Serve relays messages to the destination and replies back to the client
+// until the session is idle for idleTimeout or ctx is done. A nil dst is
+// resolved from the key first unless the session is shared by all the
+// destinations of its NAT mode.
 func (s *Session) Serve(ctx context.Context, errChan chan error) {
-	dstPC, err := s.dialUDP("udp", s.srcPC.GetTarget())
+	defer func() {
+		close(s.done)
+
+		// drain what was queued before done was closed
+		for {
+			select {
+			case msg := <-s.msgCh:
+				msg.release()
+			default:
+				return
+			}
+		}
+	}()
+
+	if s.dst == nil && !s.filter.mode.shared() {
+		dst, err := net.ResolveUDPAddr("udp", s.key)
+
+		if err != nil {
+			errChan <- err
+
+			return
+		}
+
+		s.dst = dst
+	}
+
+	dstPC, err := s.dialUDP("udp", s.key)
 
 	if err != nil {
 		errChan <- err
@@ -58,22 +155,20 @@ func (s *Session) Serve(ctx context.Context, errChan chan error) {
 	defer dstPC.Close()
 
 	go func() {
-		s.copyUDP(s.srcPC, nil, dstPC, 2*time.Minute, 5*time.Second)
+		s.copyUDP(s.srcPC, dstPC, s.idleTimeout)
 
 		close(s.finCh)
 	}()
 
+	dstBatch := newBatchConn(dstPC)
+	batch := make([]Message, 0, UDPBatchSize)
+	out := make([]packetMessage, 0, UDPBatchSize)
+
 	for {
 		select {
 		case msg := <-s.msgCh:
-			_, err = dstPC.WriteTo(msg.Msg, msg.Dst)
-
-			if err != nil {
-				fmt.Println(err)
-			}
-
-			pool.PutBuffer(msg.Msg)
-			msg.Msg = nil
+			batch = s.queued(append(batch[:0], msg))
+			out = s.send(dstBatch, batch, out[:0])
 		case <-s.finCh:
 			errChan <- nil
 
@@ -85,6 +180,157 @@ func (s *Session) Serve(ctx context.Context, errChan chan error) {
 	}
 }
 
+// queued appends the messages waiting in the queue to batch, up to its
+// capacity.
+func (s *Session) queued(batch []Message) []Message {
+	for len(batch) < cap(batch) {
+		select {
+		case msg := <-s.msgCh:
+			batch = append(batch, msg)
+		default:
+			return batch
+		}
+	}
+
+	return batch
+}
+
+// send writes batch to the destinations in one call where batched I/O is
+// available and releases its buffers. out is the scratch for the batch.
+func (s *Session) send(conn batchConn, batch []Message, out []packetMessage) []packetMessage {
+	sent := batch[:0]
+
+	for _, msg := range batch {
+		dst, resolving := s.messageDst(msg)
+
+		switch {
+		case resolving:
+			// the lookup queues msg again
+		case dst == nil:
+			msg.release()
+		default:
+			s.filter.sent(dst)
+			out = append(out, packetMessage{Buf: msg.Msg, Addr: dst})
+			sent = append(sent, msg)
+		}
+	}
+
+	if len(out) > 0 {
+		s.touch()
+	}
+
+	s.writeBatch(conn, out)
+
+	for _, msg := range sent {
+		msg.release()
+	}
+
+	return out
+}
+
+// writeBatch sends msgs, a datagram failing to send is skipped and the
+// rest still go out.
+func (s *Session) writeBatch(conn batchConn, msgs []packetMessage) {
+	for len(msgs) > 0 {
+		n, err := conn.WriteBatch(msgs)
+
+		if err != nil {
+			fmt.Println(time.Now().Unix(), "udp send failed", err)
+
+			if s.stats != nil {
+				s.stats.sendErrors.Add(1)
+			}
+
+			n++
+		}
+
+		msgs = msgs[n:]
+	}
+}
+
+// messageDst returns the destination of msg. Domains of a shared session
+// are looked up off the Serve loop, resolving reports that msg waits for
+// one.
+func (s *Session) messageDst(msg Message) (dst net.Addr, resolving bool) {
+	if msg.Dst != nil {
+		return msg.Dst, false
+	}
+
+	if msg.target == nil || !s.filter.mode.shared() {
+		return s.dst, false
+	}
+
+	if msg.target[0] != AddressFqdn {
+		return msg.target.udpAddr(), false
+	}
+
+	key := msg.target.String()
+
+	s.resolveMu.Lock()
+	defer s.resolveMu.Unlock()
+
+	if dst, ok := s.resolved[key]; ok {
+		return dst, false
+	}
+
+	waiting, ok := s.pending[key]
+
+	if len(waiting) >= cap(s.msgCh) {
+		if s.stats != nil {
+			s.stats.queueDropped.Add(1)
+		}
+
+		return nil, false
+	}
+
+	if s.pending == nil {
+		s.pending = map[string][]Message{}
+	}
+
+	s.pending[key] = append(waiting, msg)
+
+	if !ok {
+		go s.lookup(key)
+	}
+
+	return nil, true
+}
+
+// lookup resolves key and queues the messages waiting for it again.
+func (s *Session) lookup(key string) {
+	dst, err := net.ResolveUDPAddr("udp", key)
+
+	s.resolveMu.Lock()
+	waiting := s.pending[key]
+	delete(s.pending, key)
+
+	if err == nil {
+		// bounded, an association talking to many domains starts over
+		if s.resolved == nil || len(s.resolved) >= 256 {
+			s.resolved = map[string]*net.UDPAddr{}
+		}
+
+		s.resolved[key] = dst
+	}
+
+	s.resolveMu.Unlock()
+
+	if err != nil && s.stats != nil {
+		s.stats.sessionErrors.Add(1)
+	}
+
+	for _, msg := range waiting {
+		if err != nil {
+			msg.release()
+
+			continue
+		}
+
+		msg.Dst = dst
+		s.ProcessMessage(msg)
+	}
+}
+
 func (s *Session) dialUDP(network, addr string) (pc net.PacketConn, err error) {
 	var la string
 
@@ -97,38 +343,90 @@ func (s *Session) dialUDP(network, addr string) (pc net.PacketConn, err error) {
 	return lc.ListenPacket(context.Background(), network, la)
 }
 
+// copyUDP relays datagrams from src back to the client of dst a batch at a
+// time, tagged with the address they came from. The headers are added in
+// place in the room left in front of each datagram. It returns once the
+// session saw no traffic either way for idleTimeout.
 func (s *Session) copyUDP(
-	dst net.PacketConn,
-	writeTo net.Addr,
+	dst *PktConn,
 	src net.PacketConn,
-	timeout time.Duration,
-	step time.Duration,
+	idleTimeout time.Duration,
 ) error {
-	buf := pool.GetBuffer(UDPBufSize)
-	defer pool.PutBuffer(buf)
+	srcBatch := newBatchConn(src)
+	dstBatch := newBatchConn(dst.PacketConn)
+	bufs := make([][]byte, UDPBatchSize)
+	in := make([]packetMessage, UDPBatchSize)
+	out := make([]packetMessage, 0, UDPBatchSize)
 
-	var t time.Duration
+	for i := range bufs {
+		bufs[i] = pool.GetBuffer(maxUDPHeaderSize + UDPBufSize)
+		defer pool.PutBuffer(bufs[i])
+	}
 
 	for {
-		if t += step; t == 0 || t > timeout {
-			t = timeout
+		deadline := time.Unix(0, s.lastActive.Load()).Add(idleTimeout)
+
+		if !deadline.After(time.Now()) {
+			return nil
+		}
+
+		for i := range in {
+			in[i] = packetMessage{Buf: bufs[i][maxUDPHeaderSize:]}
 		}
 
-		src.SetReadDeadline(time.Now().Add(t))
-		n, addr, err := src.ReadFrom(buf)
+		src.SetReadDeadline(deadline)
+		n, err := srcBatch.ReadBatch(in)
+
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			continue
+		}
 
 		if err != nil {
 			return err
 		}
 
-		if writeTo != nil {
-			addr = writeTo
-		}
+		s.touch()
 
-		_, err = dst.WriteTo(buf[:n], addr)
+		out = out[:0]
 
-		if err != nil {
-			return err
+		for i := 0; i < n; i++ {
+			if !s.filter.accepts(in[i].Addr, s.dst) {
+				if s.stats != nil {
+					s.stats.natFiltered.Add(1)
+				}
+
+				continue
+			}
+
+			if s.limiter != nil && !s.limiter.allow(in[i].N) {
+				if s.stats != nil {
+					s.stats.rateLimited.Add(1)
+				}
+
+				continue
+			}
+
+			if s.fragmentSize > 0 && in[i].N > s.fragmentSize {
+				payload := bufs[i][maxUDPHeaderSize : maxUDPHeaderSize+in[i].N]
+
+				// a reply failing to send is skipped like any lost datagram
+				if err := writeFragments(dst.PacketConn, dst.writeTo, in[i].Addr, payload, s.fragmentSize); err != nil && s.stats != nil {
+					s.stats.sendErrors.Add(1)
+				}
+
+				continue
+			}
+
+			end := maxUDPHeaderSize + in[i].N
+			start := putUDPHeader(bufs[i][:end], maxUDPHeaderSize, in[i].Addr)
+
+			if start < 0 {
+				continue
+			}
+
+			out = append(out, packetMessage{Buf: bufs[i][start:end], Addr: dst.writeTo})
 		}
+
+		s.writeBatch(dstBatch, out)
 	}
 }
@@ -7,6 +7,9 @@ const (
 const (
 	AuthNoAuth       = uint8(0)
 	AuthUserPass     = uint8(2)
+	AuthAssignedLast = uint8(0x09)
+	AuthPrivateFirst = uint8(0x80)
+	AuthPrivateLast  = uint8(0xfe)
 	AuthVersion      = uint8(1)
 	AuthNoAcceptable = uint8(255)
 	AuthSuccess      = uint8(0)
@@ -0,0 +1,102 @@
+package final_socks
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+type SourceAuthRule struct {
+	Network *net.IPNet
+	Methods []uint8
+	// Identity is used as Request.User when the client is let in without
+	// credentials.
+	Identity *Identity
+}
+
+// SourceAuthPolicy restricts the auth methods a client may negotiate by its
+// source address. The most specific matching rule wins, clients outside all
+// rules get the default methods.
+type SourceAuthPolicy struct {
+	Rules          []SourceAuthRule
+	DefaultMethods []uint8
+}
+
+func NewSourceAuthPolicy(defaultMethods ...uint8) *SourceAuthPolicy {
+	return &SourceAuthPolicy{
+		DefaultMethods: defaultMethods,
+	}
+}
+
+// Add allows methods for clients in cidr, e.g.
+// Add("10.0.0.0/8", &Identity{Name: "internal"}, AuthNoAuth, AuthUserPass).
+func (p *SourceAuthPolicy) Add(cidr string, identity *Identity, methods ...uint8) error {
+	_, network, err := net.ParseCIDR(cidr)
+
+	if err != nil {
+		return errors.Wrap(err, "invalid source network")
+	}
+
+	p.Rules = append(p.Rules, SourceAuthRule{
+		Network:  network,
+		Methods:  methods,
+		Identity: identity,
+	})
+
+	return nil
+}
+
+// Match returns the auth methods and the synthetic identity for ip.
+func (p *SourceAuthPolicy) Match(ip net.IP) ([]uint8, *Identity) {
+	var match *SourceAuthRule
+	matchBits := -1
+
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+
+		if ip == nil || !rule.Network.Contains(ip) {
+			continue
+		}
+
+		if bits, _ := rule.Network.Mask.Size(); bits > matchBits {
+			match = rule
+			matchBits = bits
+		}
+	}
+
+	if match == nil {
+		return p.DefaultMethods, nil
+	}
+
+	return match.Methods, match.Identity
+}
+
+func (p *SourceAuthPolicy) allowsMethod(method uint8) bool {
+	for _, m := range p.DefaultMethods {
+		if m == method {
+			return true
+		}
+	}
+
+	for _, rule := range p.Rules {
+		for _, m := range rule.Methods {
+			if m == method {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func connIP(conn net.Conn) net.IP {
+	if conn == nil {
+		return nil
+	}
+
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+
+	return nil
+}
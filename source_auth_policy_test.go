@@ -0,0 +1,117 @@
+package final_socks
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSourceAuthPolicyMatch(t *testing.T) {
+	internal := &Identity{Name: "internal"}
+	office := &Identity{Name: "office"}
+	v6 := &Identity{Name: "v6"}
+
+	policy := NewSourceAuthPolicy(AuthUserPass)
+
+	for _, rule := range []struct {
+		cidr     string
+		identity *Identity
+		methods  []uint8
+	}{
+		{"10.0.0.0/8", internal, []uint8{AuthNoAuth, AuthUserPass}},
+		{"10.1.0.0/16", office, []uint8{AuthNoAuth}},
+		{"10.1.2.0/24", nil, []uint8{AuthUserPass}},
+		{"2001:db8::/32", v6, []uint8{AuthNoAuth}},
+	} {
+		if err := policy.Add(rule.cidr, rule.identity, rule.methods...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := policy.Add("10.0.0.0/33", nil, AuthNoAuth); err == nil {
+		t.Fatal("accepted an invalid network")
+	}
+
+	tests := []struct {
+		ip       string
+		methods  []uint8
+		identity *Identity
+	}{
+		{"10.9.9.9", []uint8{AuthNoAuth, AuthUserPass}, internal},
+		// the most specific network wins whatever the rule order
+		{"10.1.9.9", []uint8{AuthNoAuth}, office},
+		{"10.1.2.3", []uint8{AuthUserPass}, nil},
+		{"192.0.2.1", []uint8{AuthUserPass}, nil},
+		{"2001:db8::1", []uint8{AuthNoAuth}, v6},
+		{"2001:db9::1", []uint8{AuthUserPass}, nil},
+		// IPv4 mapped addresses match the IPv4 rules
+		{"::ffff:10.9.9.9", []uint8{AuthNoAuth, AuthUserPass}, internal},
+		{"", []uint8{AuthUserPass}, nil},
+	}
+
+	for _, test := range tests {
+		methods, identity := policy.Match(net.ParseIP(test.ip))
+
+		if string(methods) != string(test.methods) || identity != test.identity {
+			t.Errorf("%q: got %v %+v, want %v %+v", test.ip, methods, identity, test.methods, test.identity)
+		}
+	}
+}
+
+func TestServerSourceAuthPolicy(t *testing.T) {
+	users := make(chan interface{}, 1)
+	server := NewServer("", func(w ResponseWriter, r *Request) {
+		users <- r.User
+		_ = w.SendSucceeded(r.DestAddr)
+	})
+
+	loopback := &Identity{Name: "loopback"}
+	policy := NewSourceAuthPolicy(AuthUserPass)
+
+	if err := policy.Add("127.0.0.0/8", loopback, AuthNoAuth); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.SetOption(UserPassAuth("alice", "secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.SetOption(SourceAuth(policy)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a loopback client may only skip auth, user/pass is not offered to it
+	client, conn := tcpPair(t)
+	defer client.Close()
+
+	if selected := negotiate(t, server, client, conn, AuthUserPass); selected != AuthNoAcceptable {
+		t.Fatalf("loopback offering user/pass: selected %#x", selected)
+	}
+
+	client, conn = tcpPair(t)
+	defer client.Close()
+
+	if selected := negotiate(t, server, client, conn, AuthUserPass, AuthNoAuth); selected != AuthNoAuth {
+		t.Fatalf("loopback: selected %#x", selected)
+	}
+
+	if _, err := client.Write([]byte{VersionSocks5, CommandConnect, 0, AddressIpv4, 127, 0, 0, 1, 0, 80}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(client, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	if user := <-users; user != loopback {
+		t.Fatalf("got user %+v, want the network identity", user)
+	}
+
+	// a client without an IP gets the default methods
+	pipeClient, pipeConn := net.Pipe()
+	defer pipeClient.Close()
+
+	if selected := negotiate(t, server, pipeClient, pipeConn, AuthNoAuth); selected != AuthNoAcceptable {
+		t.Fatalf("no IP offering no auth: selected %#x", selected)
+	}
+}
@@ -0,0 +1,362 @@
+package final_socks
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var DefaultTLSReloadInterval = 10 * time.Second
+
+type TLSCertificateFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// SNICertificates are picked over CertFile when the client SNI matches
+	// their names.
+	SNICertificates []TLSCertificateFiles
+	// MinVersion defaults to TLS 1.2.
+	MinVersion uint16
+	NextProtos []string
+	// ClientCAFile enables mutual TLS, client certificates have to chain to
+	// one of its CAs. Clients without a certificate have to use another
+	// auth method.
+	ClientCAFile string
+	// CRLFile holds PEM or DER revocation lists signed by the client CAs.
+	CRLFile string
+	// ReloadInterval polls the files for changes, zero disables polling.
+	ReloadInterval time.Duration
+	ReloadOnSIGHUP bool
+}
+
+type tlsState struct {
+	certificates []tls.Certificate
+	clientCAs    *x509.CertPool
+	revoked      map[string]struct{}
+	modTimes     map[string]time.Time
+}
+
+// TLSReloader serves TLS configuration loaded from files and swaps it in
+// when the files change, established connections are not affected.
+type TLSReloader struct {
+	config TLSConfig
+	mu     sync.RWMutex
+	state  *tlsState
+	done   chan struct{}
+	once   sync.Once
+}
+
+func NewTLSReloader(config TLSConfig) (*TLSReloader, error) {
+	r := &TLSReloader{
+		config: config,
+		done:   make(chan struct{}),
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	if config.ReloadInterval > 0 || config.ReloadOnSIGHUP {
+		go r.watch(config.ReloadInterval, config.ReloadOnSIGHUP)
+	}
+
+	return r, nil
+}
+
+func (r *TLSReloader) Reload() error {
+	state := &tlsState{
+		modTimes: map[string]time.Time{},
+	}
+
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+
+		if err != nil {
+			return errors.Wrap(err, "failed to stat tls file")
+		}
+
+		state.modTimes[file] = info.ModTime()
+	}
+
+	pairs := append([]TLSCertificateFiles{{r.config.CertFile, r.config.KeyFile}}, r.config.SNICertificates...)
+
+	for _, pair := range pairs {
+		certificate, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+
+		if err != nil {
+			return errors.Wrapf(err, "failed to load tls certificate %v", pair.CertFile)
+		}
+
+		state.certificates = append(state.certificates, certificate)
+	}
+
+	if r.config.ClientCAFile != "" {
+		cas, err := loadCertificates(r.config.ClientCAFile)
+
+		if err != nil {
+			return err
+		}
+
+		state.clientCAs = x509.NewCertPool()
+
+		for _, ca := range cas {
+			state.clientCAs.AddCert(ca)
+		}
+
+		if r.config.CRLFile != "" {
+			if state.revoked, err = loadRevoked(r.config.CRLFile, cas); err != nil {
+				return err
+			}
+		}
+	}
+
+	r.mu.Lock()
+	r.state = state
+	r.mu.Unlock()
+
+	return nil
+}
+
+// Config returns a tls.Config that always uses the latest loaded files.
+func (r *TLSReloader) Config() *tls.Config {
+	minVersion := r.config.MinVersion
+
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+
+	return &tls.Config{
+		MinVersion: minVersion,
+		NextProtos: r.config.NextProtos,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			state := r.state
+			r.mu.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   minVersion,
+				NextProtos:   r.config.NextProtos,
+				Certificates: state.certificates,
+			}
+
+			if state.clientCAs != nil {
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+				config.ClientCAs = state.clientCAs
+				config.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+					return checkRevoked(state.revoked, chains)
+				}
+			}
+
+			return config, nil
+		},
+	}
+}
+
+func (r *TLSReloader) Close() error {
+	r.once.Do(func() {
+		close(r.done)
+	})
+
+	return nil
+}
+
+func (r *TLSReloader) files() []string {
+	files := []string{r.config.CertFile, r.config.KeyFile}
+
+	for _, pair := range r.config.SNICertificates {
+		files = append(files, pair.CertFile, pair.KeyFile)
+	}
+
+	if r.config.ClientCAFile != "" {
+		files = append(files, r.config.ClientCAFile)
+	}
+
+	if r.config.ClientCAFile != "" && r.config.CRLFile != "" {
+		files = append(files, r.config.CRLFile)
+	}
+
+	return files
+}
+
+func (r *TLSReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+
+		if err == nil && !info.ModTime().Equal(r.state.modTimes[file]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *TLSReloader) watch(interval time.Duration, sighup bool) {
+	var tick <-chan time.Time
+	var hup chan os.Signal
+
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	if sighup {
+		hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+	}
+
+	for {
+		select {
+		case <-tick:
+			if !r.changed() {
+				continue
+			}
+		case <-hup:
+		case <-r.done:
+			return
+		}
+
+		if err := r.Reload(); err != nil {
+			fmt.Println(time.Now().Unix(), "tls reload failed", err)
+		}
+	}
+}
+
+func loadCertificates(file string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read certificates")
+	}
+
+	var certificates []*x509.Certificate
+
+	for _, block := range pemBlocks(data, "CERTIFICATE") {
+		certificate, err := x509.ParseCertificate(block)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse certificate")
+		}
+
+		certificates = append(certificates, certificate)
+	}
+
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("no certificates in %v", file)
+	}
+
+	return certificates, nil
+}
+
+// loadRevoked reads the revocation lists in file, each has to be signed by
+// one of cas. Revoked certificates are keyed by issuer and serial.
+func loadRevoked(file string, cas []*x509.Certificate) (map[string]struct{}, error) {
+	data, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read crl")
+	}
+
+	blocks := pemBlocks(data, "X509 CRL")
+
+	if len(blocks) == 0 {
+		blocks = [][]byte{data}
+	}
+
+	revoked := map[string]struct{}{}
+
+	for _, block := range blocks {
+		crl, err := x509.ParseRevocationList(block)
+
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse crl")
+		}
+
+		if err := checkCRLSignature(crl, cas); err != nil {
+			return nil, err
+		}
+
+		for _, entry := range crl.RevokedCertificates {
+			revoked[revokedKey(crl.RawIssuer, entry.SerialNumber.String())] = struct{}{}
+		}
+	}
+
+	return revoked, nil
+}
+
+func checkCRLSignature(crl *x509.RevocationList, cas []*x509.Certificate) error {
+	for _, ca := range cas {
+		if string(ca.RawSubject) == string(crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+			return nil
+		}
+	}
+
+	return errors.New("crl is not signed by a client ca")
+}
+
+func checkRevoked(revoked map[string]struct{}, chains [][]*x509.Certificate) error {
+	if len(revoked) == 0 {
+		return nil
+	}
+
+	for _, chain := range chains {
+		for _, certificate := range chain {
+			if _, ok := revoked[revokedKey(certificate.RawIssuer, certificate.SerialNumber.String())]; ok {
+				return fmt.Errorf("certificate %v is revoked", certificate.SerialNumber)
+			}
+		}
+	}
+
+	return nil
+}
+
+func revokedKey(issuer []byte, serial string) string {
+	return string(issuer) + "/" + serial
+}
+
+func pemBlocks(data []byte, blockType string) [][]byte {
+	var blocks [][]byte
+
+	for {
+		var block *pem.Block
+
+		if block, data = pem.Decode(data); block == nil {
+			return blocks
+		}
+
+		if block.Type == blockType {
+			blocks = append(blocks, block.Bytes)
+		}
+	}
+}
+
+// tlsConnectionState unwraps conn to the TLS connection it is served over.
+func tlsConnectionState(conn net.Conn) (tls.ConnectionState, bool) {
+	if stats, ok := conn.(*statsConn); ok {
+		conn = stats.Conn
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		return tlsConn.ConnectionState(), true
+	}
+
+	return tls.ConnectionState{}, false
+}
@@ -0,0 +1,444 @@
+package final_socks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+	dir  string
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	ca.file = filepath.Join(ca.dir, name+".pem")
+	writePEM(t, ca.file, "CERTIFICATE", der)
+
+	return ca
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	return pool
+}
+
+// issue writes a leaf certificate for cn and returns its cert and key files.
+// Server certificates are valid for 127.0.0.1 and names.
+func (ca *testCA) issue(t *testing.T, cn string, serial int64, client bool, names ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:     names,
+	}
+
+	if client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		template.IPAddresses = nil
+		template.URIs = []*url.URL{{Scheme: "spiffe", Host: "example.org", Path: "/" + cn}}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := filepath.Join(ca.dir, strings.ReplaceAll(cn, "/", "_"))
+	writePEM(t, base+".crt", "CERTIFICATE", der)
+	writePEM(t, base+".key", "PRIVATE KEY", keyDER)
+
+	return base + ".crt", base + ".key"
+}
+
+func (ca *testCA) writeCRL(t *testing.T, serials ...int64) string {
+	var revoked []pkix.RevokedCertificate
+
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(time.Now().UnixNano()),
+		RevokedCertificates: revoked,
+		ThisUpdate:          time.Now(),
+		NextUpdate:          time.Now().Add(time.Hour),
+	}, ca.cert, ca.key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(ca.dir, "crl.pem")
+	writePEM(t, path, "X509 CRL", der)
+
+	return path
+}
+
+func (ca *testCA) clientCertificate(t *testing.T, cn string, serial int64) tls.Certificate {
+	certificate, err := tls.LoadX509KeyPair(ca.issue(t, cn, serial, true))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certificate
+}
+
+// serveTLSTest serves a server answering CONNECT with success on a local
+// listener, the users of the requests are sent to the returned channel.
+func serveTLSTest(t *testing.T, options ...Option) (string, chan interface{}) {
+	users := make(chan interface{}, 16)
+	server := NewServer("", func(w ResponseWriter, r *Request) {
+		users <- r.User
+		_ = w.SendSucceeded(r.DestAddr)
+	})
+
+	for _, option := range options {
+		if err := server.SetOption(option); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	t.Cleanup(func() { _ = server.Close() })
+
+	return listener.Addr().String(), users
+}
+
+func TestTLSCRL(t *testing.T) {
+	serverCA := newTestCA(t, "server-ca")
+	clientCA := newTestCA(t, "client-ca")
+	otherCA := newTestCA(t, "other-ca")
+	certFile, keyFile := serverCA.issue(t, "proxy", 2, false)
+	alice := clientCA.clientCertificate(t, "alice", 10)
+	bob := clientCA.clientCertificate(t, "bob", 11)
+
+	addr, _ := serveTLSTest(t, MutualTLSAuth(TLSConfig{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: clientCA.file,
+		CRLFile:      clientCA.writeCRL(t, 11),
+	}))
+
+	dial := func(certificate tls.Certificate) error {
+		dialer := &Dialer{
+			ProxyAddr: addr,
+			TLSConfig: &tls.Config{RootCAs: serverCA.pool(), Certificates: []tls.Certificate{certificate}},
+		}
+
+		conn, err := dialer.Dial("tcp", "127.0.0.1:80")
+
+		if err == nil {
+			_ = conn.Close()
+		}
+
+		return err
+	}
+
+	if err := dial(alice); err != nil {
+		t.Fatalf("valid certificate refused: %v", err)
+	}
+
+	if err := dial(bob); err == nil {
+		t.Fatal("revoked certificate accepted")
+	}
+
+	// a revocation list has to come from one of the client CAs
+	_, err := NewTLSReloader(TLSConfig{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: clientCA.file,
+		CRLFile:      otherCA.writeCRL(t, 10),
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "not signed by a client ca") {
+		t.Fatalf("crl of another ca: %v", err)
+	}
+}
+
+// leafSerial returns the serial of the certificate the server presents for
+// serverName.
+func leafSerial(t *testing.T, addr, serverName string, roots *x509.CertPool) int64 {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, RootCAs: roots})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestTLSReload(t *testing.T) {
+	ca := newTestCA(t, "server-ca")
+	certFile, keyFile := ca.issue(t, "proxy", 2, false, "proxy.example")
+
+	addr, _ := serveTLSTest(t, TLSListener(TLSConfig{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		ReloadInterval: 10 * time.Millisecond,
+	}))
+
+	if serial := leafSerial(t, addr, "proxy.example", ca.pool()); serial != 2 {
+		t.Fatalf("serial %d, want 2", serial)
+	}
+
+	// rewrite the files in place, a later mtime marks them changed
+	ca.issue(t, "proxy", 3, false, "proxy.example")
+	later := time.Now().Add(time.Minute)
+
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+
+	for leafSerial(t, addr, "proxy.example", ca.pool()) != 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("new certificate not served after the files changed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTLSReloadKeepsStateOnError(t *testing.T) {
+	ca := newTestCA(t, "server-ca")
+	certFile, keyFile := ca.issue(t, "proxy", 2, false)
+
+	reloader, err := NewTLSReloader(TLSConfig{CertFile: certFile, KeyFile: keyFile})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer reloader.Close()
+
+	if err := os.WriteFile(keyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reloader.Reload(); err == nil {
+		t.Fatal("Reload accepted a broken key")
+	}
+
+	config, err := reloader.Config().GetConfigForClient(&tls.ClientHelloInfo{})
+
+	if err != nil || len(config.Certificates) != 1 {
+		t.Fatalf("previous certificate dropped: %v", err)
+	}
+}
+
+func TestTLSSNICertificates(t *testing.T) {
+	ca := newTestCA(t, "server-ca")
+	certFile, keyFile := ca.issue(t, "default", 2, false, "default.example")
+	sniCert, sniKey := ca.issue(t, "sni", 3, false, "sni.example", "*.sni.example")
+
+	addr, _ := serveTLSTest(t, TLSListener(TLSConfig{
+		CertFile:        certFile,
+		KeyFile:         keyFile,
+		SNICertificates: []TLSCertificateFiles{{CertFile: sniCert, KeyFile: sniKey}},
+	}))
+
+	tests := []struct {
+		serverName string
+		serial     int64
+	}{
+		{"default.example", 2},
+		{"sni.example", 3},
+		{"www.sni.example", 3},
+	}
+
+	for _, test := range tests {
+		if serial := leafSerial(t, addr, test.serverName, ca.pool()); serial != test.serial {
+			t.Errorf("%s: serial %d, want %d", test.serverName, serial, test.serial)
+		}
+	}
+}
+
+func TestTLSMinVersionAndALPN(t *testing.T) {
+	ca := newTestCA(t, "server-ca")
+	certFile, keyFile := ca.issue(t, "proxy", 2, false)
+
+	addr, _ := serveTLSTest(t, TLSListener(TLSConfig{
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		MinVersion: tls.VersionTLS13,
+		NextProtos: []string{"socks5"},
+	}))
+
+	if _, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool(), MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Fatal("TLS 1.2 accepted")
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: ca.pool(), NextProtos: []string{"socks5"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if protocol := conn.ConnectionState().NegotiatedProtocol; protocol != "socks5" {
+		t.Fatalf("negotiated %q, want socks5", protocol)
+	}
+}
+
+func TestDialerListenAndServeTLS(t *testing.T) {
+	ca := newTestCA(t, "server-ca")
+	certFile, keyFile := ca.issue(t, "proxy", 2, false)
+
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := probe.Addr().String()
+	_ = probe.Close()
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer target.Close()
+
+	go func() {
+		conn, err := target.Accept()
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	server := NewServer(addr, DefaultHandler)
+
+	if err := server.SetOption(UserPassAuth("alice", "secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_ = server.ListenAndServeTLS(certFile, keyFile)
+	}()
+
+	defer server.Close()
+
+	dialer := &Dialer{
+		ProxyAddr: addr,
+		Username:  "alice",
+		Password:  "secret",
+		TLSConfig: &tls.Config{RootCAs: ca.pool()},
+	}
+
+	var conn net.Conn
+	deadline := time.Now().Add(2 * time.Second)
+
+	// wait for the listener
+	for conn, err = dialer.Dial("tcp", target.Addr().String()); err != nil; conn, err = dialer.Dial("tcp", target.Addr().String()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Dial: %v", err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, 4)
+
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("echo: %q %v", reply, err)
+	}
+}
@@ -0,0 +1,241 @@
+package final_socks
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TokenKey signs or verifies tokens. Exactly one of HMACSecret and the
+// Ed25519 keys is set, PrivateKey is only needed to mint tokens.
+type TokenKey struct {
+	ID         string
+	HMACSecret []byte
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+}
+
+// TokenClaims are kept short since a token has to fit the 255 byte RFC 1929
+// password field.
+type TokenClaims struct {
+	User           string   `json:"u"`
+	ExpiresAt      int64    `json:"exp"`
+	Destinations   []string `json:"dst,omitempty"`
+	BandwidthLimit int64    `json:"bw,omitempty"`
+}
+
+// TokenAuth is a CredentialVerifier accepting "<kid>.<claims>.<signature>"
+// tokens as password, verified offline with the key named by kid. The
+// username has to match the user claim.
+type TokenAuth struct {
+	mu   sync.RWMutex
+	keys map[string]TokenKey
+}
+
+func NewTokenAuth(keys ...TokenKey) *TokenAuth {
+	a := &TokenAuth{
+		keys: map[string]TokenKey{},
+	}
+
+	for _, key := range keys {
+		a.AddKey(key)
+	}
+
+	return a
+}
+
+// AddKey adds or replaces a key, old keys stay valid until removed so
+// tokens can be rotated.
+func (a *TokenAuth) AddKey(key TokenKey) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.keys[key.ID] = key
+}
+
+func (a *TokenAuth) RemoveKey(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.keys, id)
+}
+
+func (a *TokenAuth) Verify(conn net.Conn, username, password string) (interface{}, error) {
+	claims, err := a.ParseToken(password)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.User != username {
+		return nil, errors.New("token user mismatch")
+	}
+
+	return &Identity{
+		Name:                claims.User,
+		RateLimit:           claims.BandwidthLimit,
+		AllowedDestinations: claims.Destinations,
+		ExpiresAt:           time.Unix(claims.ExpiresAt, 0),
+	}, nil
+}
+
+// ParseToken checks the signature and expiry of token and returns its claims.
+func (a *TokenAuth) ParseToken(token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	a.mu.RLock()
+	key, ok := a.keys[parts[0]]
+	a.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown token key: %q", parts[0])
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed token signature")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+
+	switch {
+	case key.HMACSecret != nil:
+		if !hmac.Equal(sig, tokenHMAC(key.HMACSecret, signed)) {
+			return nil, errors.New("invalid token signature")
+		}
+	case key.PublicKey != nil:
+		if !ed25519.Verify(key.PublicKey, signed, sig) {
+			return nil, errors.New("invalid token signature")
+		}
+	default:
+		return nil, fmt.Errorf("token key %q can not verify", key.ID)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed token claims")
+	}
+
+	claims := &TokenClaims{}
+
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, errors.Wrap(err, "malformed token claims")
+	}
+
+	if claims.ExpiresAt == 0 || time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errors.New("token expired")
+	}
+
+	return claims, nil
+}
+
+func MintToken(key TokenKey, claims TokenClaims) (string, error) {
+	if strings.Contains(key.ID, ".") {
+		return "", errors.New("token key id can not contain dots")
+	}
+
+	payload, err := json.Marshal(claims)
+
+	if err != nil {
+		return "", err
+	}
+
+	signed := key.ID + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+
+	switch {
+	case key.HMACSecret != nil:
+		sig = tokenHMAC(key.HMACSecret, []byte(signed))
+	case key.PrivateKey != nil:
+		sig = ed25519.Sign(key.PrivateKey, []byte(signed))
+	default:
+		return "", fmt.Errorf("token key %q can not sign", key.ID)
+	}
+
+	token := signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+
+	if len(token) > 255 {
+		return "", fmt.Errorf("token is %d bytes, at most 255 fit the password field", len(token))
+	}
+
+	return token, nil
+}
+
+// ParseTokenKey reads a key from PEM encoded Ed25519 PKCS#8 private or PKIX
+// public key data, anything else is used as HMAC secret.
+func ParseTokenKey(id string, data []byte) (TokenKey, error) {
+	key := TokenKey{ID: id}
+	block, _ := pem.Decode(data)
+
+	if block == nil {
+		key.HMACSecret = bytes.TrimSpace(data)
+
+		if len(key.HMACSecret) == 0 {
+			return key, errors.New("empty hmac secret")
+		}
+
+		return key, nil
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+		if err != nil {
+			return key, errors.Wrap(err, "failed to parse private key")
+		}
+
+		private, ok := parsed.(ed25519.PrivateKey)
+
+		if !ok {
+			return key, errors.New("private key is not ed25519")
+		}
+
+		key.PrivateKey = private
+		key.PublicKey = private.Public().(ed25519.PublicKey)
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+
+		if err != nil {
+			return key, errors.Wrap(err, "failed to parse public key")
+		}
+
+		public, ok := parsed.(ed25519.PublicKey)
+
+		if !ok {
+			return key, errors.New("public key is not ed25519")
+		}
+
+		key.PublicKey = public
+	default:
+		return key, fmt.Errorf("unsupported pem block: %v", block.Type)
+	}
+
+	return key, nil
+}
+
+func tokenHMAC(secret, data []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,166 @@
+package final_socks
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newEd25519TokenKey(t *testing.T, id string) TokenKey {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return TokenKey{ID: id, PublicKey: public, PrivateKey: private}
+}
+
+func TestTokenAuthVerify(t *testing.T) {
+	hmacKey := TokenKey{ID: "ci", HMACSecret: []byte("secret")}
+	edKey := newEd25519TokenKey(t, "ed")
+
+	// the verifying side only holds the public key
+	auth := NewTokenAuth(hmacKey, TokenKey{ID: edKey.ID, PublicKey: edKey.PublicKey})
+
+	claims := TokenClaims{
+		User:           "job-42",
+		ExpiresAt:      time.Now().Add(time.Hour).Unix(),
+		Destinations:   []string{"*.example.com:443"},
+		BandwidthLimit: 1024,
+	}
+
+	for _, key := range []TokenKey{hmacKey, edKey} {
+		t.Run(key.ID, func(t *testing.T) {
+			token, err := MintToken(key, claims)
+
+			if err != nil {
+				t.Fatalf("MintToken: %v", err)
+			}
+
+			user, err := auth.Verify(nil, "job-42", token)
+
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+
+			identity := user.(*Identity)
+
+			if identity.Name != "job-42" || identity.RateLimit != 1024 || identity.ExpiresAt.Unix() != claims.ExpiresAt {
+				t.Fatalf("unexpected identity: %+v", identity)
+			}
+
+			if !identity.AllowsDestination(&AddrSpec{FQDN: "api.example.com", Port: 443}) {
+				t.Fatal("allowed destination refused")
+			}
+
+			if identity.AllowsDestination(&AddrSpec{FQDN: "api.example.com", Port: 80}) ||
+				identity.AllowsDestination(&AddrSpec{IP: net.IPv4(192, 0, 2, 1), Port: 443}) {
+				t.Fatal("destination outside the token allowed")
+			}
+
+			if _, err := auth.Verify(nil, "other", token); err == nil {
+				t.Fatal("token accepted for another user")
+			}
+		})
+	}
+}
+
+func TestTokenAuthRejects(t *testing.T) {
+	hmacKey := TokenKey{ID: "ci", HMACSecret: []byte("secret")}
+	edKey := newEd25519TokenKey(t, "ed")
+	auth := NewTokenAuth(hmacKey, TokenKey{ID: edKey.ID, PublicKey: edKey.PublicKey})
+
+	valid := TokenClaims{User: "job-42", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+
+	mint := func(key TokenKey, claims TokenClaims) string {
+		token, err := MintToken(key, claims)
+
+		if err != nil {
+			t.Fatalf("MintToken: %v", err)
+		}
+
+		return token
+	}
+
+	tamper := func(token string) string {
+		parts := strings.Split(token, ".")
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		sig[0] ^= 1
+
+		return parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{name: "hmac bad signature", token: tamper(mint(hmacKey, valid))},
+		{name: "ed25519 bad signature", token: tamper(mint(edKey, valid))},
+		{name: "wrong hmac secret", token: mint(TokenKey{ID: "ci", HMACSecret: []byte("other")}, valid)},
+		{name: "other ed25519 key", token: mint(newEd25519TokenKey(t, "ed"), valid)},
+		{name: "unknown key", token: mint(TokenKey{ID: "gone", HMACSecret: []byte("secret")}, valid)},
+		{name: "expired", token: mint(hmacKey, TokenClaims{User: "job-42", ExpiresAt: time.Now().Add(-time.Second).Unix()})},
+		{name: "no expiry", token: mint(hmacKey, TokenClaims{User: "job-42"})},
+		{name: "malformed", token: "ci.only"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := auth.Verify(nil, "job-42", test.token); err == nil {
+				t.Fatal("token accepted")
+			}
+		})
+	}
+
+	// a removed key stops verifying its tokens
+	token := mint(hmacKey, valid)
+	auth.RemoveKey("ci")
+
+	if _, err := auth.Verify(nil, "job-42", token); err == nil {
+		t.Fatal("token of a removed key accepted")
+	}
+}
+
+func TestParseTokenKey(t *testing.T) {
+	edKey := newEd25519TokenKey(t, "ed")
+	private, err := x509.MarshalPKCS8PrivateKey(edKey.PrivateKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public, err := x509.MarshalPKIXPublicKey(edKey.PublicKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ParseTokenKey("ed", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private}))
+
+	if err != nil || !key.PrivateKey.Equal(edKey.PrivateKey) || !key.PublicKey.Equal(edKey.PublicKey) {
+		t.Fatalf("private key: %+v, %v", key, err)
+	}
+
+	key, err = ParseTokenKey("ed", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}))
+
+	if err != nil || key.PrivateKey != nil || !key.PublicKey.Equal(edKey.PublicKey) {
+		t.Fatalf("public key: %+v, %v", key, err)
+	}
+
+	key, err = ParseTokenKey("ci", []byte("secret\n"))
+
+	if err != nil || string(key.HMACSecret) != "secret" {
+		t.Fatalf("hmac secret: %+v, %v", key, err)
+	}
+
+	if _, err := ParseTokenKey("ci", []byte("\n")); err == nil {
+		t.Fatal("accepted an empty hmac secret")
+	}
+}
@@ -50,28 +50,33 @@ func (pc *PktConn) GetTarget() string {
 	return pc.target.String()
 }
 
-// ReadFrom overrides the original function from net.PacketConn.
+// ReadFrom overrides the original function from net.PacketConn. The payload
+// is moved to the start of b, ReadPacket leaves it in place.
 func (pc *PktConn) ReadFrom(b []byte) (int, net.Addr, error) {
-	n, _, target, err := pc.readFrom(b)
-	return n, target, err
+	payload, _, target, err := pc.ReadPacket(b)
+	return copy(b, payload), target, err
 }
 
 // ReadFrom overrides the original function from net.PacketConn.
 func (pc *PktConn) ReadFrom2(b []byte) (int, net.Addr, net.Addr, error) {
-	return pc.readFrom(b)
+	payload, raddr, target, err := pc.ReadPacket(b)
+	return copy(b, payload), raddr, target, err
 }
 
-func (pc *PktConn) readFrom(b []byte) (int, net.Addr, net.Addr, error) {
-	buf := pool.GetBuffer(len(b))
-	defer pool.PutBuffer(buf)
-
-	n, raddr, err := pc.PacketConn.ReadFrom(buf)
+// ReadPacket reads a datagram into b and returns its payload, the part of b
+// after the header, with the sender and the destination.
+func (pc *PktConn) ReadPacket(b []byte) ([]byte, net.Addr, net.Addr, error) {
+	n, raddr, err := pc.PacketConn.ReadFrom(b)
 	if err != nil {
-		return n, raddr, nil, err
+		return nil, raddr, nil, err
 	}
 
 	if n < 3 {
-		return n, raddr, nil, errors.New("not enough size to get addr")
+		return nil, raddr, nil, errors.New("not enough size to get addr")
+	}
+
+	if b[2] != 0 {
+		return nil, raddr, nil, errors.New("fragmented datagrams are not supported")
 	}
 
 	// https://www.rfc-editor.org/rfc/rfc1928#section-7
@@ -80,14 +85,14 @@ func (pc *PktConn) readFrom(b []byte) (int, net.Addr, net.Addr, error) {
 	// +----+------+------+----------+----------+----------+
 	// | 2  |  1   |  1   | Variable |    2     | Variable |
 	// +----+------+------+----------+----------+----------+
-	tgtAddr := SplitAddr(buf[3:n])
+	tgtAddr := SplitAddr(b[3:n])
 	if tgtAddr == nil {
-		return n, raddr, nil, errors.New("can not get target addr")
+		return nil, raddr, nil, errors.New("can not get target addr")
 	}
 
 	target, err := net.ResolveUDPAddr("udp", tgtAddr.String())
 	if err != nil {
-		return n, raddr, nil, errors.New("wrong target addr")
+		return nil, raddr, nil, errors.New("wrong target addr")
 	}
 
 	if pc.writeTo == nil {
@@ -99,8 +104,7 @@ func (pc *PktConn) readFrom(b []byte) (int, net.Addr, net.Addr, error) {
 		copy(pc.target, tgtAddr)
 	}
 
-	n = copy(b, buf[3+len(tgtAddr):n])
-	return n, raddr, target, err
+	return b[3+len(tgtAddr) : n], raddr, target, nil
 }
 
 // WriteTo overrides the original function from net.PacketConn.
@@ -160,6 +164,33 @@ func (a Addr) String() string {
 	return net.JoinHostPort(host, port)
 }
 
+// spec returns a as AddrSpec, an IP shares the memory of a.
+func (a Addr) spec() AddrSpec {
+	n := len(a)
+	port := int(a[n-2])<<8 | int(a[n-1])
+
+	switch a[0] {
+	case AddressFqdn:
+		return AddrSpec{FQDN: string(a[2 : 2+int(a[1])]), Port: port}
+	case AddressIpv4:
+		return AddrSpec{IP: net.IP(a[1 : 1+net.IPv4len]), Port: port}
+	default:
+		return AddrSpec{IP: net.IP(a[1 : 1+net.IPv6len]), Port: port}
+	}
+}
+
+// udpAddr returns an IP address as *net.UDPAddr without a lookup, nil for a
+// domain.
+func (a Addr) udpAddr() *net.UDPAddr {
+	if a[0] == AddressFqdn {
+		return nil
+	}
+
+	spec := a.spec()
+
+	return &net.UDPAddr{IP: append(net.IP(nil), spec.IP...), Port: spec.Port}
+}
+
 // SplitAddr slices a SOCKS address from beginning of b. Returns nil if failed.
 func SplitAddr(b []byte) Addr {
 	addrLen := 1
@@ -224,3 +255,51 @@ func ParseAddr(s string) Addr {
 
 	return addr
 }
+
+// maxUDPHeaderSize is the room left in front of a datagram read from a
+// destination so its header can be added in place.
+const maxUDPHeaderSize = 3 + 1 + net.IPv6len + 2
+
+// putUDPHeader writes the header for a datagram from addr in front of
+// b[end:] and returns where it starts, or -1 if there is no room.
+func putUDPHeader(b []byte, end int, addr net.Addr) int {
+	var ip net.IP
+	var port int
+
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	default:
+		tgtAddr := ParseAddr(addr.String())
+
+		if tgtAddr == nil || end < 3+len(tgtAddr) {
+			return -1
+		}
+
+		start := end - 3 - len(tgtAddr)
+		copy(b[start:], []byte{0, 0, 0})
+		copy(b[start+3:], tgtAddr)
+
+		return start
+	}
+
+	atyp := AddressIpv6
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, atyp = ip4, AddressIpv4
+	} else if ip = ip.To16(); ip == nil {
+		return -1
+	}
+
+	start := end - 3 - 1 - len(ip) - 2
+
+	if start < 0 {
+		return -1
+	}
+
+	b[start], b[start+1], b[start+2], b[start+3] = 0, 0, 0, atyp
+	copy(b[start+4:], ip)
+	b[end-2], b[end-1] = byte(port>>8), byte(port)
+
+	return start
+}
@@ -0,0 +1,60 @@
+package final_socks
+
+import (
+	"net"
+)
+
+// UDPBatchSize is the number of datagrams moved per syscall where batched
+// I/O is available.
+var UDPBatchSize = 32
+
+// packetMessage is a datagram of a batch. Reads fill Buf up to N and set
+// Addr to the sender, writes send Buf to Addr.
+type packetMessage struct {
+	Buf  []byte
+	N    int
+	Addr net.Addr
+}
+
+// batchConn moves several datagrams per call, recvmmsg/sendmmsg on Linux
+// and one datagram per call elsewhere.
+type batchConn interface {
+	ReadBatch(msgs []packetMessage) (int, error)
+	WriteBatch(msgs []packetMessage) (int, error)
+}
+
+func newBatchConn(c net.PacketConn) batchConn {
+	if udpConn, ok := c.(*net.UDPConn); ok {
+		if bc := newPlatformBatchConn(udpConn); bc != nil {
+			return bc
+		}
+	}
+
+	return &singlePacketConn{PacketConn: c}
+}
+
+type singlePacketConn struct {
+	net.PacketConn
+}
+
+func (c *singlePacketConn) ReadBatch(msgs []packetMessage) (int, error) {
+	n, addr, err := c.ReadFrom(msgs[0].Buf)
+
+	if err != nil {
+		return 0, err
+	}
+
+	msgs[0].N, msgs[0].Addr = n, addr
+
+	return 1, nil
+}
+
+func (c *singlePacketConn) WriteBatch(msgs []packetMessage) (int, error) {
+	for i := range msgs {
+		if _, err := c.WriteTo(msgs[i].Buf, msgs[i].Addr); err != nil {
+			return i, err
+		}
+	}
+
+	return len(msgs), nil
+}
@@ -0,0 +1,125 @@
+package final_socks
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// xBatchConn is implemented by both ipv4.PacketConn and ipv6.PacketConn,
+// their Message types are the same.
+type xBatchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+type mmsgConn struct {
+	conn *net.UDPConn
+	x    xBatchConn
+	ipv6 bool
+	// read and write scratch, reused so a batch does not allocate
+	rms   []ipv4.Message
+	wms   []ipv4.Message
+	rbufs [][1][]byte
+	wbufs [][1][]byte
+}
+
+func newPlatformBatchConn(c *net.UDPConn) batchConn {
+	addr, ok := c.LocalAddr().(*net.UDPAddr)
+
+	if !ok {
+		return nil
+	}
+
+	bc := &mmsgConn{conn: c}
+
+	if addr.IP.To4() != nil {
+		bc.x = ipv4.NewPacketConn(c)
+	} else {
+		bc.x = ipv6.NewPacketConn(c)
+		bc.ipv6 = true
+	}
+
+	return bc
+}
+
+func (c *mmsgConn) messages(ms []ipv4.Message, bufs [][1][]byte, n int) ([]ipv4.Message, [][1][]byte) {
+	for len(ms) < n {
+		bufs = append(bufs, [1][]byte{})
+		ms = append(ms, ipv4.Message{})
+	}
+
+	for i := range ms {
+		ms[i].Buffers = bufs[i][:]
+	}
+
+	return ms, bufs
+}
+
+func (c *mmsgConn) ReadBatch(msgs []packetMessage) (int, error) {
+	c.rms, c.rbufs = c.messages(c.rms, c.rbufs, len(msgs))
+	ms := c.rms[:len(msgs)]
+
+	for i := range ms {
+		ms[i].Buffers[0] = msgs[i].Buf
+		ms[i].Addr = nil
+	}
+
+	n, err := c.x.ReadBatch(ms, 0)
+
+	for i := 0; i < n; i++ {
+		msgs[i].N, msgs[i].Addr = ms[i].N, ms[i].Addr
+	}
+
+	return n, err
+}
+
+// WriteBatch sends IPv4 destinations of an IPv6 socket one by one, x/net
+// marshals them as AF_INET addresses the socket rejects.
+func (c *mmsgConn) WriteBatch(msgs []packetMessage) (int, error) {
+	c.wms, c.wbufs = c.messages(c.wms, c.wbufs, len(msgs))
+	sent := 0
+
+	for sent < len(msgs) {
+		if c.ipv6 && isIPv4Addr(msgs[sent].Addr) {
+			if _, err := c.conn.WriteTo(msgs[sent].Buf, msgs[sent].Addr); err != nil {
+				return sent, err
+			}
+
+			sent++
+
+			continue
+		}
+
+		ms := c.wms[:0]
+
+		for i := sent; i < len(msgs) && !(c.ipv6 && isIPv4Addr(msgs[i].Addr)); i++ {
+			m := c.wms[len(ms)]
+			m.Buffers[0] = msgs[i].Buf
+			m.Addr = msgs[i].Addr
+			ms = append(ms, m)
+		}
+
+		n, err := c.x.WriteBatch(ms, 0)
+
+		if err != nil {
+			// a failed sendmmsg reports -1
+			if n > 0 {
+				sent += n
+			}
+
+			return sent, err
+		}
+
+		sent += n
+	}
+
+	return sent, nil
+}
+
+func isIPv4Addr(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+
+	return ok && udpAddr.IP.To4() != nil
+}
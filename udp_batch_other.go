@@ -0,0 +1,11 @@
+//go:build !linux
+
+package final_socks
+
+import (
+	"net"
+)
+
+func newPlatformBatchConn(c *net.UDPConn) batchConn {
+	return nil
+}
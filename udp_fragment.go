@@ -0,0 +1,170 @@
+package final_socks
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/lunelabs/final-socks/pool"
+)
+
+// MinUDPReassemblyTimeout is the shortest reassembly timer RFC 1928 allows.
+const MinUDPReassemblyTimeout = 5 * time.Second
+
+// maxUDPDatagramSize is the largest reassembled datagram, the largest UDP
+// payload over IPv4.
+const maxUDPDatagramSize = 65507
+
+// UDPFragmentConfig enables RFC 1928 section 7 fragmentation on the UDP
+// relay. Without it client datagrams with a non-zero FRAG are dropped.
+type UDPFragmentConfig struct {
+	// Reassemble fragmented client datagrams before relaying them.
+	Reassemble bool
+	// ReassemblyTimeout abandons an incomplete datagram, at least
+	// MinUDPReassemblyTimeout.
+	ReassemblyTimeout time.Duration
+	// FragmentSize splits replies with a larger payload into fragments,
+	// 0 never splits. Clients must support reassembly.
+	FragmentSize int
+}
+
+// udpReassembly is the reassembly queue of an association, used by its
+// read loop only. Fragments must arrive in order, anything else abandons
+// the queue, as does its timer running out. The read loop wakes up for
+// the timer at deadline.
+type udpReassembly struct {
+	timeout time.Duration
+	stats   *udpCounters
+	started time.Time
+	last    byte
+	target  []byte
+	buf     []byte
+	data    []byte
+}
+
+// add queues the fragment frag of a datagram to target and returns the
+// datagram once its last fragment arrived.
+func (q *udpReassembly) add(frag byte, target Addr, payload []byte) (Message, bool) {
+	position, end := frag&0x7f, frag&0x80 != 0
+
+	q.expire()
+
+	// a lower position starts over, as do the gaps of a lost fragment
+	if q.buf != nil && (position != q.last+1 || !bytes.Equal(target, q.target)) {
+		q.abandon()
+	}
+
+	if q.buf == nil {
+		if position != 1 {
+			q.dropped(1)
+
+			return Message{}, false
+		}
+
+		q.started = time.Now()
+		q.target = append(q.target[:0], target...)
+		q.buf = pool.GetBuffer(maxUDPDatagramSize)
+		q.data = q.buf[:0]
+	}
+
+	if len(q.data)+len(payload) > maxUDPDatagramSize {
+		q.abandon()
+		q.dropped(1)
+
+		return Message{}, false
+	}
+
+	q.data = append(q.data, payload...)
+	q.last = position
+
+	if !end {
+		return Message{}, false
+	}
+
+	// the session owns the buffer and the target from here on
+	message := Message{Msg: q.data, buf: q.buf, target: q.target}
+	q.buf, q.data, q.target, q.last = nil, nil, nil, 0
+
+	if q.stats != nil {
+		q.stats.reassembled.Add(1)
+	}
+
+	return message, true
+}
+
+// deadline is when the queued datagram expires, zero without one.
+func (q *udpReassembly) deadline() time.Time {
+	if q.buf == nil {
+		return time.Time{}
+	}
+
+	return q.started.Add(q.timeout)
+}
+
+// expire abandons the queued datagram once its timer ran out.
+func (q *udpReassembly) expire() {
+	if q.buf != nil && !time.Now().Before(q.deadline()) {
+		q.abandon()
+	}
+}
+
+func (q *udpReassembly) abandon() {
+	if q.buf == nil {
+		return
+	}
+
+	q.dropped(int(q.last))
+	pool.PutBuffer(q.buf)
+	q.buf, q.data, q.last = nil, nil, 0
+}
+
+func (q *udpReassembly) dropped(n int) {
+	if q.stats != nil {
+		q.stats.fragmentsDropped.Add(uint64(n))
+	}
+}
+
+// writeFragments sends payload from src to the client in fragments of at
+// most size bytes, a payload needing more than 127 fragments is sent
+// whole.
+func writeFragments(conn net.PacketConn, client net.Addr, src net.Addr, payload []byte, size int) error {
+	buf := pool.GetBuffer(maxUDPHeaderSize + size)
+	defer pool.PutBuffer(buf)
+
+	count := (len(payload) + size - 1) / size
+
+	if count > 0x7f {
+		count, size = 1, len(payload)
+		buf = pool.GetBuffer(maxUDPHeaderSize + size)
+		defer pool.PutBuffer(buf)
+	}
+
+	for i := 0; i < count; i++ {
+		chunk := payload[i*size:]
+
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+
+		n := copy(buf[maxUDPHeaderSize:], chunk)
+		start := putUDPHeader(buf, maxUDPHeaderSize, src)
+
+		if start < 0 {
+			return nil
+		}
+
+		if count > 1 {
+			buf[start+2] = byte(i + 1)
+
+			if i == count-1 {
+				buf[start+2] |= 0x80
+			}
+		}
+
+		if _, err := conn.WriteTo(buf[start:maxUDPHeaderSize+n], client); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
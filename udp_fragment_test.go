@@ -0,0 +1,160 @@
+package final_socks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPReassembly(t *testing.T) {
+	target := ParseAddr("192.0.2.1:53")
+	other := ParseAddr("192.0.2.2:53")
+
+	tests := []struct {
+		name      string
+		frags     []byte
+		targets   []Addr
+		want      string
+		dropped   uint64
+		assembled uint64
+	}{
+		{
+			name:      "in order",
+			frags:     []byte{1, 2, 0x83},
+			want:      "123",
+			assembled: 1,
+		},
+		{
+			name:    "out of order",
+			frags:   []byte{1, 3, 0x82},
+			dropped: 3,
+		},
+		{
+			name:    "repeated position",
+			frags:   []byte{1, 1, 0x82},
+			want:    "12",
+			dropped: 1,
+			// the second 1 starts over
+			assembled: 1,
+		},
+		{
+			name:    "target changes",
+			frags:   []byte{1, 0x82},
+			targets: []Addr{target, other},
+			dropped: 2,
+		},
+		{
+			name:    "no first fragment",
+			frags:   []byte{2, 0x83},
+			dropped: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stats := &udpCounters{}
+			q := &udpReassembly{timeout: time.Minute, stats: stats}
+			got := ""
+
+			for i, frag := range test.frags {
+				to := target
+
+				if test.targets != nil {
+					to = test.targets[i]
+				}
+
+				payload := []byte{'0' + frag&0x7f}
+
+				if message, ok := q.add(frag, to, payload); ok {
+					got += string(message.Msg)
+
+					if message.target.String() != to.String() {
+						t.Fatalf("datagram to %v, want %v", message.target, to)
+					}
+
+					message.release()
+				}
+			}
+
+			q.abandon()
+
+			if got != test.want {
+				t.Fatalf("reassembled %q, want %q", got, test.want)
+			}
+
+			if dropped := stats.fragmentsDropped.Load(); dropped != test.dropped {
+				t.Fatalf("FragmentsDropped = %d, want %d", dropped, test.dropped)
+			}
+
+			if assembled := stats.reassembled.Load(); assembled != test.assembled {
+				t.Fatalf("Reassembled = %d, want %d", assembled, test.assembled)
+			}
+		})
+	}
+}
+
+func TestUDPRelayReassembly(t *testing.T) {
+	relay, relayAddr := startRelay(t, func(r *udpRelay) {
+		r.enableFragmentation(UDPFragmentConfig{Reassemble: true})
+	})
+	client, target := listenUDP(t), listenUDP(t)
+	targetAddr := target.LocalAddr().(*net.UDPAddr)
+
+	_, _ = client.WriteToUDP(clientDatagram(1, targetAddr, []byte("hello ")), relayAddr)
+	_, _ = client.WriteToUDP(clientDatagram(0x82, targetAddr, []byte("world")), relayAddr)
+
+	if got, _ := readUDP(t, target, time.Second); string(got) != "hello world" {
+		t.Fatalf("target read %q, want %q", got, "hello world")
+	}
+
+	if assembled := relay.stats.reassembled.Load(); assembled != 1 {
+		t.Fatalf("Reassembled = %d, want 1", assembled)
+	}
+}
+
+func TestUDPRelayReassemblyTimeout(t *testing.T) {
+	relay, relayAddr := startRelay(t, func(r *udpRelay) {
+		r.enableFragmentation(UDPFragmentConfig{Reassemble: true})
+		r.reassembly.timeout = 50 * time.Millisecond
+	})
+	client, target := listenUDP(t), listenUDP(t)
+	targetAddr := target.LocalAddr().(*net.UDPAddr)
+
+	_, _ = client.WriteToUDP(clientDatagram(1, targetAddr, []byte("hello ")), relayAddr)
+	_, _ = client.WriteToUDP(clientDatagram(2, targetAddr, []byte("big ")), relayAddr)
+
+	// the queue expires without another datagram to notice it
+	deadline := time.Now().Add(time.Second)
+
+	for relay.stats.fragmentsDropped.Load() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("FragmentsDropped = %d, want 2", relay.stats.fragmentsDropped.Load())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the last fragment alone completes nothing
+	_, _ = client.WriteToUDP(clientDatagram(0x83, targetAddr, []byte("world")), relayAddr)
+
+	if got, _ := readUDP(t, target, 100*time.Millisecond); got != nil {
+		t.Fatalf("target read %q from an expired datagram", got)
+	}
+}
+
+func TestUDPRelayRejectsFragments(t *testing.T) {
+	relay, relayAddr := startRelay(t, nil)
+	client, target := listenUDP(t), listenUDP(t)
+	targetAddr := target.LocalAddr().(*net.UDPAddr)
+
+	_, _ = client.WriteToUDP(clientDatagram(1, targetAddr, []byte("fragment")), relayAddr)
+	_, _ = client.WriteToUDP(clientDatagram(0, targetAddr, []byte("whole")), relayAddr)
+
+	if got, _ := readUDP(t, target, time.Second); string(got) != "whole" {
+		t.Fatalf("target read %q, want %q", got, "whole")
+	}
+
+	if dropped := relay.stats.fragmentsDropped.Load(); dropped != 1 {
+		t.Fatalf("FragmentsDropped = %d, want 1", dropped)
+	}
+}
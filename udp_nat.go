@@ -0,0 +1,122 @@
+package final_socks
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// UDPNATMode is the NAT behavior of the UDP relay, per server with the
+// UDPNAT option or per user with Identity.UDPNAT.
+type UDPNATMode string
+
+const (
+	// UDPNATSymmetric uses a socket per destination, only the destination
+	// can reply. It is the default.
+	UDPNATSymmetric UDPNATMode = "symmetric"
+	// UDPNATFullCone uses one socket per association, any host can reply.
+	UDPNATFullCone UDPNATMode = "full-cone"
+	// UDPNATAddressRestricted uses one socket per association, hosts the
+	// client sent to can reply from any port.
+	UDPNATAddressRestricted UDPNATMode = "address-restricted"
+	// UDPNATPortRestricted uses one socket per association, only the
+	// host and port pairs the client sent to can reply.
+	UDPNATPortRestricted UDPNATMode = "port-restricted"
+)
+
+func (m UDPNATMode) valid() bool {
+	switch m {
+	case "", UDPNATSymmetric, UDPNATFullCone, UDPNATAddressRestricted, UDPNATPortRestricted:
+		return true
+	}
+
+	return false
+}
+
+// shared reports whether all destinations go through one socket.
+func (m UDPNATMode) shared() bool {
+	return m == UDPNATFullCone || m == UDPNATAddressRestricted || m == UDPNATPortRestricted
+}
+
+// udpNATMode is the mode of the user if set, the server mode otherwise.
+func (r *Request) udpNATMode() UDPNATMode {
+	if identity, ok := r.User.(*Identity); ok && identity.UDPNAT.valid() && identity.UDPNAT != "" {
+		return identity.UDPNAT
+	}
+
+	return r.udpNAT
+}
+
+// natFilter tracks the peers a session sent to, replies from others are
+// dropped depending on the mode.
+type natFilter struct {
+	mode      UDPNATMode
+	mu        sync.Mutex
+	peerIPs   map[netip.Addr]struct{}
+	peerAddrs map[netip.AddrPort]struct{}
+}
+
+func newNATFilter(mode UDPNATMode) *natFilter {
+	return &natFilter{
+		mode:      mode,
+		peerIPs:   map[netip.Addr]struct{}{},
+		peerAddrs: map[netip.AddrPort]struct{}{},
+	}
+}
+
+func (f *natFilter) sent(addr net.Addr) {
+	if f.mode != UDPNATAddressRestricted && f.mode != UDPNATPortRestricted {
+		return
+	}
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+
+	if !ok {
+		return
+	}
+
+	addrPort := unmapAddrPort(udpAddr)
+
+	f.mu.Lock()
+	f.peerIPs[addrPort.Addr()] = struct{}{}
+	f.peerAddrs[addrPort] = struct{}{}
+	f.mu.Unlock()
+}
+
+// accepts reports whether a reply from addr reaches the client, dst is the
+// destination of a symmetric session.
+func (f *natFilter) accepts(addr net.Addr, dst net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+
+	if !ok {
+		return false
+	}
+
+	switch f.mode {
+	case UDPNATFullCone:
+		return true
+	case UDPNATAddressRestricted, UDPNATPortRestricted:
+		addrPort := unmapAddrPort(udpAddr)
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if f.mode == UDPNATAddressRestricted {
+			_, ok = f.peerIPs[addrPort.Addr()]
+		} else {
+			_, ok = f.peerAddrs[addrPort]
+		}
+
+		return ok
+	}
+
+	dstAddr, ok := dst.(*net.UDPAddr)
+
+	return ok && unmapAddrPort(udpAddr) == unmapAddrPort(dstAddr)
+}
+
+func unmapAddrPort(addr *net.UDPAddr) netip.AddrPort {
+	addrPort := addr.AddrPort()
+
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+}
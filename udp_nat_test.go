@@ -0,0 +1,108 @@
+package final_socks
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUDPNATModes(t *testing.T) {
+	tests := []struct {
+		mode UDPNATMode
+		// whether a reply reaches the client from the destination, another
+		// port of its host and another host
+		destination, otherPort, otherHost bool
+	}{
+		{mode: UDPNATSymmetric, destination: true},
+		{mode: UDPNATFullCone, destination: true, otherPort: true, otherHost: true},
+		{mode: UDPNATAddressRestricted, destination: true, otherPort: true},
+		{mode: UDPNATPortRestricted, destination: true},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.mode), func(t *testing.T) {
+			relay, relayAddr := startRelay(t, func(r *udpRelay) {
+				r.natMode = test.mode
+			})
+			client, destination, otherPort := listenUDP(t), listenUDP(t), listenUDP(t)
+			otherHost, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+
+			if err != nil {
+				t.Skip("no second loopback address:", err)
+			}
+
+			defer otherHost.Close()
+
+			_, _ = client.WriteToUDP(clientDatagram(0, destination.LocalAddr().(*net.UDPAddr), []byte("request")), relayAddr)
+			got, session := readUDP(t, destination, time.Second)
+
+			if string(got) != "request" {
+				t.Fatalf("destination read %q, want %q", got, "request")
+			}
+
+			filtered := uint64(0)
+
+			for _, peer := range []struct {
+				name      string
+				conn      *net.UDPConn
+				delivered bool
+			}{
+				{"destination", destination, test.destination},
+				{"other port", otherPort, test.otherPort},
+				{"other host", otherHost, test.otherHost},
+			} {
+				_, _ = peer.conn.WriteToUDP([]byte("reply from "+peer.name), session)
+
+				timeout := time.Second
+
+				if !peer.delivered {
+					filtered++
+					timeout = 100 * time.Millisecond
+				}
+
+				got, _ := readUDP(t, client, timeout)
+
+				if !peer.delivered {
+					if got != nil {
+						t.Fatalf("reply from %s reached the client: %q", peer.name, got)
+					}
+
+					continue
+				}
+
+				source := SplitAddr(got[3:])
+
+				if source == nil || source.String() != peer.conn.LocalAddr().String() {
+					t.Fatalf("reply from %s tagged %v", peer.name, source)
+				}
+
+				if payload := string(got[3+len(source):]); payload != "reply from "+peer.name {
+					t.Fatalf("reply from %s read %q", peer.name, payload)
+				}
+			}
+
+			if got := relay.stats.natFiltered.Load(); got != filtered {
+				t.Fatalf("NATFiltered = %d, want %d", got, filtered)
+			}
+		})
+	}
+}
+
+func TestSharedSessionResolvesDomains(t *testing.T) {
+	_, relayAddr := startRelay(t, func(r *udpRelay) {
+		r.natMode = UDPNATFullCone
+	})
+	client, destination := listenUDP(t), listenUDP(t)
+	port := destination.LocalAddr().(*net.UDPAddr).Port
+	target := ParseAddr(net.JoinHostPort("localhost", strconv.Itoa(port)))
+
+	for _, payload := range []string{"first", "second"} {
+		msg := append([]byte{0, 0, 0}, target...)
+		_, _ = client.WriteToUDP(append(msg, payload...), relayAddr)
+
+		if got, _ := readUDP(t, destination, time.Second); string(got) != payload {
+			t.Fatalf("destination read %q, want %q", got, payload)
+		}
+	}
+}
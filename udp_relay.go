@@ -0,0 +1,355 @@
+package final_socks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lunelabs/final-socks/pool"
+)
+
+// UDPSourceMode selects the client datagrams a UDP association accepts.
+// Associations over control connections without an IP are refused unless
+// the client declared its address in strict mode.
+type UDPSourceMode uint8
+
+const (
+	// UDPSourceStrict accepts the address the client declared in the
+	// ASSOCIATE request, the IP of the TCP connection where it declared
+	// none.
+	UDPSourceStrict UDPSourceMode = iota
+	// UDPSourceRelaxed accepts any port of the IP of the TCP connection,
+	// for clients behind NAT declaring their private address.
+	UDPSourceRelaxed
+)
+
+// UDPIdleTimeout ends a destination of a UDP association after this long
+// without traffic in either direction.
+var UDPIdleTimeout = 2 * time.Minute
+
+// UDPMaxSessions caps the destinations a UDP association relays to at
+// once, datagrams to further ones are dropped until one goes idle.
+var UDPMaxSessions = 1024
+
+// udpRelay is the relay of a UDP association. Client datagrams are routed
+// through a NAT table with a Session per destination, each with its own
+// outbound socket.
+type udpRelay struct {
+	conn     net.PacketConn
+	clientPC *PktConn
+	exitIP   net.IP
+
+	// the client datagrams must come from, nil allows any
+	clientIP   net.IP
+	clientPort int
+	// identity limits the destinations and the bandwidth when set
+	identity   *Identity
+	limiter    *rateLimiter
+	stats      *udpCounters
+	natMode    UDPNATMode
+	fragment   UDPFragmentConfig
+	reassembly udpReassembly
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+	wg       sync.WaitGroup
+}
+
+func newUDPRelay(conn net.PacketConn, exitIP net.IP) *udpRelay {
+	return &udpRelay{
+		conn:     conn,
+		clientPC: NewPktConn(conn, nil, nil, nil),
+		exitIP:   exitIP,
+		sessions: map[string]*Session{},
+	}
+}
+
+// serve reads client datagrams a batch at a time until the socket is
+// closed, then waits for the sessions to end with ctx.
+func (r *udpRelay) serve(ctx context.Context) error {
+	defer r.wg.Wait()
+	defer r.reassembly.abandon()
+
+	batch := newBatchConn(r.conn)
+	msgs := make([]packetMessage, UDPBatchSize)
+	bufs := make([][]byte, UDPBatchSize)
+
+	for i := range bufs {
+		bufs[i] = pool.GetBuffer(UDPBufSize)
+	}
+
+	defer func() {
+		for _, buf := range bufs {
+			pool.PutBuffer(buf)
+		}
+	}()
+
+	var deadline time.Time
+
+	for {
+		for i := range msgs {
+			msgs[i] = packetMessage{Buf: bufs[i]}
+		}
+
+		// the read returns when the reassembly timer runs out
+		if next := r.reassembly.deadline(); !next.Equal(deadline) {
+			deadline = next
+			_ = r.conn.SetReadDeadline(deadline)
+		}
+
+		n, err := batch.ReadBatch(msgs)
+
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			r.reassembly.expire()
+
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < n; i++ {
+			if r.handle(ctx, bufs[i][:msgs[i].N], msgs[i].Addr) {
+				// the session owns the buffer now
+				bufs[i] = pool.GetBuffer(UDPBufSize)
+			}
+		}
+	}
+}
+
+// handle routes a client datagram to its destination session, the header
+// is stripped without copying. It reports whether b was handed over.
+func (r *udpRelay) handle(ctx context.Context, b []byte, src net.Addr) bool {
+	// https://www.rfc-editor.org/rfc/rfc1928#section-7
+	if len(b) < 3 {
+		return false
+	}
+
+	tgtAddr := SplitAddr(b[3:])
+
+	if tgtAddr == nil {
+		return false
+	}
+
+	if !r.acceptsClient(src) {
+		if r.stats != nil {
+			r.stats.spoofedDropped.Add(1)
+		}
+
+		return false
+	}
+
+	if r.identity != nil && len(r.identity.AllowedDestinations) > 0 {
+		if spec := tgtAddr.spec(); !r.identity.AllowsDestination(&spec) {
+			if r.stats != nil {
+				r.stats.notAllowed.Add(1)
+			}
+
+			return false
+		}
+	}
+
+	if r.limiter != nil && !r.limiter.allow(len(b)) {
+		if r.stats != nil {
+			r.stats.rateLimited.Add(1)
+		}
+
+		return false
+	}
+
+	if r.clientPC.writeTo == nil {
+		r.clientPC.writeTo = src
+	}
+
+	if frag := b[2]; frag != 0 {
+		if !r.fragment.Reassemble {
+			r.reassembly.dropped(1)
+
+			return false
+		}
+
+		// fragments are copied into the queue, b stays with the caller
+		if message, ok := r.reassembly.add(frag, tgtAddr, b[3+len(tgtAddr):]); ok {
+			if !r.route(ctx, message, message.target) {
+				message.release()
+			}
+		}
+
+		return false
+	}
+
+	return r.route(ctx, Message{Msg: b[3+len(tgtAddr):], buf: b, target: tgtAddr}, tgtAddr)
+}
+
+// route hands message to the session of tgtAddr and reports whether it
+// took it.
+func (r *udpRelay) route(ctx context.Context, message Message, tgtAddr Addr) bool {
+	key := tgtAddr
+
+	if r.natMode.shared() {
+		key = nil
+	}
+
+	// retry once when the session expired right after the lookup
+	for i := 0; i < 2; i++ {
+		session := r.session(ctx, key)
+
+		if session == nil {
+			if r.stats != nil {
+				r.stats.sessionsRefused.Add(1)
+			}
+
+			return false
+		}
+
+		if session.deliver(message) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// session returns the NAT table entry of tgtAddr, creating it if needed.
+// A nil tgtAddr is the session shared by all destinations. It returns nil
+// when the table holds UDPMaxSessions entries already.
+func (r *udpRelay) session(ctx context.Context, tgtAddr Addr) *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if session, ok := r.sessions[string(tgtAddr)]; ok {
+		return session
+	}
+
+	if len(r.sessions) >= UDPMaxSessions {
+		return nil
+	}
+
+	var key string
+	var dst net.Addr
+
+	// domains are resolved by the session, off the read loop
+	if tgtAddr != nil {
+		key = tgtAddr.String()
+
+		if tgtAddr[0] != AddressFqdn {
+			dst = tgtAddr.udpAddr()
+		}
+	}
+
+	session := NewSession(key, r.clientPC.writeTo, dst, r.clientPC, r.exitIP)
+	session.stats = r.stats
+	session.limiter = r.limiter
+	session.fragmentSize = r.fragment.FragmentSize
+
+	if r.natMode.shared() {
+		session.filter = newNATFilter(r.natMode)
+	}
+
+	tableKey := string(tgtAddr)
+	r.sessions[tableKey] = session
+	r.wg.Add(1)
+
+	go func() {
+		defer r.wg.Done()
+
+		errChan := make(chan error, 1)
+		session.Serve(ctx, errChan)
+
+		select {
+		case err := <-errChan:
+			if err != nil {
+				fmt.Println(time.Now().Unix(), "udp session failed", err)
+
+				if r.stats != nil {
+					r.stats.sessionErrors.Add(1)
+				}
+			}
+		default:
+		}
+
+		r.mu.Lock()
+		if r.sessions[tableKey] == session {
+			delete(r.sessions, tableKey)
+		}
+		r.mu.Unlock()
+	}()
+
+	return session
+}
+
+// restrictClient limits the association to the client of r, see
+// UDPSourceMode.
+func (r *udpRelay) restrictClient(req *Request) {
+	r.stats = req.udpStats
+	r.reassembly.stats = req.udpStats
+	r.clientIP = req.RemoteAddr.IP
+
+	if req.udpSourceMode != UDPSourceStrict || req.DestAddr == nil {
+		return
+	}
+
+	if ip := req.DestAddr.IP; ip != nil && !ip.IsUnspecified() {
+		r.clientIP = append(net.IP(nil), ip...)
+	}
+
+	r.clientPort = req.DestAddr.Port
+}
+
+// udpClientKnown reports whether the client datagrams of an association
+// requested by req can be restricted to an IP. Unix and WebSocket control
+// connections have no IP, their clients must declare their address.
+func (r *Request) udpClientKnown() bool {
+	if r.RemoteAddr.IP != nil {
+		return true
+	}
+
+	if r.udpSourceMode != UDPSourceStrict || r.DestAddr == nil {
+		return false
+	}
+
+	return r.DestAddr.IP != nil && !r.DestAddr.IP.IsUnspecified()
+}
+
+// restrictUser applies the destinations and the rate limit of identity,
+// nil leaves the association unrestricted.
+func (r *udpRelay) restrictUser(identity *Identity) {
+	r.identity = identity
+
+	if identity != nil && identity.RateLimit > 0 {
+		r.limiter = newRateLimiter(identity.RateLimit)
+	}
+}
+
+// acceptsClient checks src against the client restriction, the first
+// accepted address is the only one accepted afterwards.
+func (r *udpRelay) acceptsClient(src net.Addr) bool {
+	addr, ok := src.(*net.UDPAddr)
+
+	if !ok {
+		return false
+	}
+
+	if client, ok := r.clientPC.writeTo.(*net.UDPAddr); ok {
+		return addr.Port == client.Port && addr.IP.Equal(client.IP)
+	}
+
+	if r.clientIP != nil && !addr.IP.Equal(r.clientIP) {
+		return false
+	}
+
+	return r.clientPort == 0 || addr.Port == r.clientPort
+}
+
+// enableFragmentation applies config to the association.
+func (r *udpRelay) enableFragmentation(config UDPFragmentConfig) {
+	r.fragment = config
+	r.reassembly.timeout = config.ReassemblyTimeout
+
+	if r.reassembly.timeout < MinUDPReassemblyTimeout {
+		r.reassembly.timeout = MinUDPReassemblyTimeout
+	}
+}
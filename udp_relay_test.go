@@ -0,0 +1,347 @@
+package final_socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// listenUDP returns a loopback UDP socket closed with the test.
+func listenUDP(t testing.TB) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+// startRelay serves relay on a loopback socket until the test ends and
+// returns the address clients send to. configure runs before serving.
+func startRelay(t testing.TB, configure func(r *udpRelay)) (*udpRelay, *net.UDPAddr) {
+	conn := listenUDP(t)
+	relay := newUDPRelay(conn, nil)
+	relay.stats = &udpCounters{}
+	relay.reassembly.stats = relay.stats
+
+	if configure != nil {
+		configure(relay)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		_ = relay.serve(ctx)
+
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		_ = conn.Close()
+		<-done
+	})
+
+	return relay, conn.LocalAddr().(*net.UDPAddr)
+}
+
+// clientDatagram is payload for target with the header of fragment frag.
+func clientDatagram(frag byte, target *net.UDPAddr, payload []byte) []byte {
+	b := []byte{0, 0, frag}
+	b = append(b, ParseAddr(target.String())...)
+
+	return append(b, payload...)
+}
+
+// readUDP reads a datagram, nil when none arrives within timeout.
+func readUDP(t testing.TB, conn *net.UDPConn, timeout time.Duration) ([]byte, *net.UDPAddr) {
+	buf := make([]byte, 64*1024)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	n, addr, err := conn.ReadFromUDP(buf)
+
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return nil, nil
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf[:n], addr
+}
+
+// pumpUDP sends n datagrams with send in bursts of burst, reading each
+// burst from conn before the next so the benchmarks measure the relay
+// rather than the socket buffers overflowing. It returns how many arrived.
+func pumpUDP(n, burst int, send func(), conn *net.UDPConn) int {
+	buf := make([]byte, 64*1024)
+	received := 0
+
+	for sent := 0; sent < n; {
+		for i := 0; i < burst && sent < n; i++ {
+			send()
+			sent++
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+		for received < sent {
+			if _, _, err := conn.ReadFromUDP(buf); err != nil {
+				break
+			}
+
+			received++
+		}
+	}
+
+	return received
+}
+
+// reportPackets reports the delivered packets per second, datagrams the
+// sockets drop under load are not counted.
+func reportPackets(b *testing.B, start time.Time, sent, received int) {
+	b.StopTimer()
+	b.ReportMetric(float64(received)/time.Since(start).Seconds(), "pkts/s")
+	b.ReportMetric(100*float64(sent-received)/float64(sent), "%lost")
+}
+
+func BenchmarkUDPRelayToTarget(b *testing.B) {
+	_, relayAddr := startRelay(b, nil)
+	client, target := listenUDP(b), listenUDP(b)
+	msg := clientDatagram(0, target.LocalAddr().(*net.UDPAddr), make([]byte, 64))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+
+	received := pumpUDP(b.N, UDPBatchSize, func() { _, _ = client.WriteToUDP(msg, relayAddr) }, target)
+	reportPackets(b, start, b.N, received)
+}
+
+func BenchmarkUDPRelayToClient(b *testing.B) {
+	_, relayAddr := startRelay(b, nil)
+	client, target := listenUDP(b), listenUDP(b)
+
+	// the first datagram opens the session the replies come back through
+	_, _ = client.WriteToUDP(clientDatagram(0, target.LocalAddr().(*net.UDPAddr), []byte("open")), relayAddr)
+	_, session := readUDP(b, target, time.Second)
+
+	if session == nil {
+		b.Fatal("no datagram reached the target")
+	}
+
+	reply := make([]byte, 64)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+
+	received := pumpUDP(b.N, UDPBatchSize, func() { _, _ = target.WriteToUDP(reply, session) }, client)
+	reportPackets(b, start, b.N, received)
+}
+
+func TestSessionQueueDropped(t *testing.T) {
+	stats := &udpCounters{}
+	session := NewSession("", nil, nil, nil, nil)
+	session.stats = stats
+
+	for i := 0; i < cap(session.msgCh)+3; i++ {
+		session.ProcessMessage(Message{Msg: make([]byte, 1)})
+	}
+
+	if dropped := stats.queueDropped.Load(); dropped != 3 {
+		t.Fatalf("QueueDropped = %d, want 3", dropped)
+	}
+}
+
+func TestUDPRelaySessionErrors(t *testing.T) {
+	// binding the outbound socket fails, the address is not local
+	relay, relayAddr := startRelay(t, func(r *udpRelay) {
+		r.exitIP = net.IPv4(192, 0, 2, 1)
+	})
+	client, target := listenUDP(t), listenUDP(t)
+
+	_, _ = client.WriteToUDP(clientDatagram(0, target.LocalAddr().(*net.UDPAddr), []byte("x")), relayAddr)
+
+	deadline := time.Now().Add(time.Second)
+
+	for relay.stats.sessionErrors.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("SessionErrors not counted")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUDPRelaySessionLimit(t *testing.T) {
+	defer func(max int) { UDPMaxSessions = max }(UDPMaxSessions)
+	UDPMaxSessions = 2
+
+	relay, relayAddr := startRelay(t, nil)
+	client := listenUDP(t)
+	targets := []*net.UDPConn{listenUDP(t), listenUDP(t), listenUDP(t)}
+
+	for _, target := range targets {
+		_, _ = client.WriteToUDP(clientDatagram(0, target.LocalAddr().(*net.UDPAddr), []byte("x")), relayAddr)
+	}
+
+	for i, target := range targets[:2] {
+		if got, _ := readUDP(t, target, time.Second); string(got) != "x" {
+			t.Fatalf("target %d read %q, want %q", i, got, "x")
+		}
+	}
+
+	if got, _ := readUDP(t, targets[2], 100*time.Millisecond); got != nil {
+		t.Fatalf("target over the session limit read %q", got)
+	}
+
+	if refused := relay.stats.sessionsRefused.Load(); refused != 1 {
+		t.Fatalf("SessionsRefused = %d, want 1", refused)
+	}
+
+	// destinations with a session keep working
+	_, _ = client.WriteToUDP(clientDatagram(0, targets[0].LocalAddr().(*net.UDPAddr), []byte("y")), relayAddr)
+
+	if got, _ := readUDP(t, targets[0], time.Second); string(got) != "y" {
+		t.Fatalf("target read %q, want %q", got, "y")
+	}
+}
+
+func TestSessionReplySendErrors(t *testing.T) {
+	relayConn, target := listenUDP(t), listenUDP(t)
+	targetAddr := target.LocalAddr().(*net.UDPAddr)
+
+	// an IPv6 client cannot be reached from the IPv4 relay socket
+	clientPC := NewPktConn(relayConn, &net.UDPAddr{IP: net.IPv6loopback, Port: 9}, nil, nil)
+	session := NewSession(targetAddr.String(), nil, targetAddr, clientPC, nil)
+	session.stats = &udpCounters{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go session.Serve(ctx, make(chan error, 1))
+
+	session.ProcessMessage(Message{Msg: []byte("ping")})
+
+	_, outbound := readUDP(t, target, time.Second)
+
+	if outbound == nil {
+		t.Fatal("target read nothing")
+	}
+
+	for i := 0; i < 2; i++ {
+		_, _ = target.WriteToUDP([]byte("pong"), outbound)
+	}
+
+	deadline := time.Now().Add(time.Second)
+
+	for session.stats.sendErrors.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("SendErrors = %d, want 2", session.stats.sendErrors.Load())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the failed replies are skipped, the session keeps relaying
+	select {
+	case <-session.done:
+		t.Fatal("session ended after a failed reply")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestUDPRelaySpoofedSource(t *testing.T) {
+	client, spoofer, target := listenUDP(t), listenUDP(t), listenUDP(t)
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	req := &Request{
+		DestAddr:   &AddrSpec{IP: clientAddr.IP, Port: clientAddr.Port},
+		RemoteAddr: net.TCPAddr{IP: clientAddr.IP},
+	}
+	relay, relayAddr := startRelay(t, func(r *udpRelay) {
+		req.udpStats = r.stats
+		r.restrictClient(req)
+	})
+	targetAddr := target.LocalAddr().(*net.UDPAddr)
+
+	_, _ = spoofer.WriteToUDP(clientDatagram(0, targetAddr, []byte("spoofed")), relayAddr)
+	_, _ = client.WriteToUDP(clientDatagram(0, targetAddr, []byte("client")), relayAddr)
+
+	if got, _ := readUDP(t, target, time.Second); string(got) != "client" {
+		t.Fatalf("target read %q, want %q", got, "client")
+	}
+
+	if got, _ := readUDP(t, target, 100*time.Millisecond); got != nil {
+		t.Fatalf("target read %q from the spoofed source", got)
+	}
+
+	if dropped := relay.stats.spoofedDropped.Load(); dropped != 1 {
+		t.Fatalf("SpoofedDropped = %d, want 1", dropped)
+	}
+}
+
+func TestUDPClientKnown(t *testing.T) {
+	tests := []struct {
+		name  string
+		req   Request
+		known bool
+	}{
+		{
+			name:  "tcp client",
+			req:   Request{RemoteAddr: net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}, DestAddr: &AddrSpec{IP: net.IPv4zero}},
+			known: true,
+		},
+		{
+			name: "no ip, nothing declared",
+			req:  Request{DestAddr: &AddrSpec{IP: net.IPv4zero}},
+		},
+		{
+			name:  "no ip, address declared",
+			req:   Request{DestAddr: &AddrSpec{IP: net.IPv4(192, 0, 2, 1), Port: 5000}},
+			known: true,
+		},
+		{
+			name: "no ip, address declared, relaxed",
+			req:  Request{DestAddr: &AddrSpec{IP: net.IPv4(192, 0, 2, 1), Port: 5000}, udpSourceMode: UDPSourceRelaxed},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if known := test.req.udpClientKnown(); known != test.known {
+				t.Fatalf("udpClientKnown = %v, want %v", known, test.known)
+			}
+		})
+	}
+}
+
+func TestDefaultHandlerRefusesUnknownUDPClient(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		DefaultHandler(NewResponseWriter(conn), &Request{
+			Command:  CommandAssociate,
+			DestAddr: &AddrSpec{IP: net.IPv4zero},
+		})
+
+		_ = conn.Close()
+	}()
+
+	reply := make([]byte, 10)
+
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply[1] != ReplyConnectionNotAllowedByRuleset {
+		t.Fatalf("reply %d, want %d", reply[1], ReplyConnectionNotAllowedByRuleset)
+	}
+}
@@ -0,0 +1,64 @@
+package final_socks
+
+import (
+	"sync/atomic"
+)
+
+// UDPStats are the UDP relay counters of a Server.
+type UDPStats struct {
+	// SpoofedDropped counts client datagrams dropped for not coming from
+	// the client of the association.
+	SpoofedDropped uint64
+	// NATFiltered counts replies dropped by the NAT mode.
+	NATFiltered uint64
+	// FragmentsDropped counts client fragments dropped, all of them
+	// unless reassembly is enabled.
+	FragmentsDropped uint64
+	// Reassembled counts datagrams reassembled from fragments.
+	Reassembled uint64
+	// NotAllowed counts client datagrams to destinations the user is not
+	// allowed to reach.
+	NotAllowed uint64
+	// RateLimited counts datagrams dropped over the rate limit of the user.
+	RateLimited uint64
+	// QueueDropped counts client datagrams dropped for a full destination
+	// queue.
+	QueueDropped uint64
+	// SessionErrors counts destinations that could not be resolved or
+	// dialed.
+	SessionErrors uint64
+	// SessionsRefused counts client datagrams dropped for a destination
+	// over UDPMaxSessions.
+	SessionsRefused uint64
+	// SendErrors counts datagrams the relay failed to send either way.
+	SendErrors uint64
+}
+
+type udpCounters struct {
+	spoofedDropped   atomic.Uint64
+	natFiltered      atomic.Uint64
+	fragmentsDropped atomic.Uint64
+	reassembled      atomic.Uint64
+	notAllowed       atomic.Uint64
+	rateLimited      atomic.Uint64
+	queueDropped     atomic.Uint64
+	sessionErrors    atomic.Uint64
+	sessionsRefused  atomic.Uint64
+	sendErrors       atomic.Uint64
+}
+
+// UDPStats returns the counters of all associations served so far.
+func (s *Server) UDPStats() UDPStats {
+	return UDPStats{
+		SpoofedDropped:   s.state.udp.spoofedDropped.Load(),
+		NATFiltered:      s.state.udp.natFiltered.Load(),
+		FragmentsDropped: s.state.udp.fragmentsDropped.Load(),
+		Reassembled:      s.state.udp.reassembled.Load(),
+		NotAllowed:       s.state.udp.notAllowed.Load(),
+		RateLimited:      s.state.udp.rateLimited.Load(),
+		QueueDropped:     s.state.udp.queueDropped.Load(),
+		SessionErrors:    s.state.udp.sessionErrors.Load(),
+		SessionsRefused:  s.state.udp.sessionsRefused.Load(),
+		SendErrors:       s.state.udp.sendErrors.Load(),
+	}
+}
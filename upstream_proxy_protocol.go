@@ -0,0 +1,113 @@
+package final_socks
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// ProxyTLVUser is the default TLV carrying the authenticated user, taken
+// from the custom range of the PROXY protocol spec.
+const ProxyTLVUser = uint8(0xe0)
+
+// UpstreamProxyProtocolRule prepends a PROXY protocol header to CONNECT
+// streams to the matching Destinations, see AddrSpec.Matches for the
+// pattern syntax.
+type UpstreamProxyProtocolRule struct {
+	Destinations []string
+	// Version is 1 or 2, defaults to 2.
+	Version uint8
+	// SendUser adds the authenticated user as a UserTLV, v2 only.
+	SendUser bool
+	// UserTLV defaults to ProxyTLVUser.
+	UserTLV uint8
+}
+
+func (r *UpstreamProxyProtocolRule) matches(addr *AddrSpec) bool {
+	for _, pattern := range r.Destinations {
+		if addr.Matches(pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WriteProxyHeader writes a PROXY protocol header to target when an
+// upstream rule matches the request destination. The header carries the
+// client address and the address of target, or is a LOCAL (v2) or UNKNOWN
+// (v1) header when the client has no TCP address, unix and WebSocket
+// clients for instance.
+func (r *Request) WriteProxyHeader(target net.Conn) error {
+	rule := r.upstreamProxyProtocolRule()
+
+	if rule == nil {
+		return nil
+	}
+
+	destination, ok := target.RemoteAddr().(*net.TCPAddr)
+
+	if !ok {
+		return fmt.Errorf("unsupported upstream address: %v", target.RemoteAddr())
+	}
+
+	source := r.RemoteAddr
+	header := &ProxyHeader{
+		Version:     rule.Version,
+		Local:       source.IP == nil,
+		Source:      &source,
+		Destination: destination,
+	}
+
+	if header.Version == 0 {
+		header.Version = 2
+	}
+
+	if user := requestUserName(r.User); rule.SendUser && user != "" {
+		tlvType := rule.UserTLV
+
+		if tlvType == 0 {
+			tlvType = ProxyTLVUser
+		}
+
+		header.TLVs = append(header.TLVs, ProxyTLV{Type: tlvType, Value: []byte(user)})
+	}
+
+	data, err := header.Encode()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = target.Write(data)
+
+	return errors.Wrap(err, "failed to write proxy header")
+}
+
+func (r *Request) upstreamProxyProtocolRule() *UpstreamProxyProtocolRule {
+	if r.DestAddr == nil {
+		return nil
+	}
+
+	for i := range r.upstreamProxyProtocol {
+		if r.upstreamProxyProtocol[i].matches(r.DestAddr) {
+			return &r.upstreamProxyProtocol[i]
+		}
+	}
+
+	return nil
+}
+
+func requestUserName(user interface{}) string {
+	switch u := user.(type) {
+	case *Identity:
+		return u.Name
+	case string:
+		return u
+	case fmt.Stringer:
+		return u.String()
+	}
+
+	return ""
+}
@@ -0,0 +1,87 @@
+package final_socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestWriteProxyHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		version uint8
+		source  net.TCPAddr
+		want    []byte
+	}{
+		{
+			name:    "v1",
+			version: 1,
+			source:  net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000},
+			want:    []byte("PROXY TCP4 192.0.2.1 127.0.0.1 4000 "),
+		},
+		{
+			name:    "v1 unknown source",
+			version: 1,
+			want:    []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			name:    "v2",
+			version: 2,
+			source:  net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000},
+			want:    append(append([]byte{}, proxyProtocolV2Signature...), 0x21, 0x11),
+		},
+		{
+			name:    "v2 unknown source",
+			version: 2,
+			want:    append(append([]byte{}, proxyProtocolV2Signature...), 0x20, 0x00, 0x00, 0x00),
+		},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target, err := net.Dial("tcp", listener.Addr().String())
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			peer, err := listener.Accept()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer peer.Close()
+
+			r := &Request{
+				DestAddr:              &AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 80},
+				RemoteAddr:            test.source,
+				upstreamProxyProtocol: []UpstreamProxyProtocolRule{{Destinations: []string{"127.0.0.1"}, Version: test.version}},
+			}
+
+			if err := r.WriteProxyHeader(target); err != nil {
+				t.Fatal(err)
+			}
+
+			_ = target.Close()
+			got, err := io.ReadAll(peer)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.HasPrefix(got, test.want) {
+				t.Fatalf("header %q, want prefix %q", got, test.want)
+			}
+		})
+	}
+}
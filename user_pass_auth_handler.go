@@ -2,9 +2,10 @@ package final_socks
 
 import (
 	"bufio"
-	"fmt"
-	"io"
+	"crypto/subtle"
 	"net"
+
+	"github.com/pkg/errors"
 )
 
 type UserPassAuthHandler struct {
@@ -20,48 +21,15 @@ func NewUserPassAuthHandler(username, password string) *UserPassAuthHandler {
 }
 
 func (h *UserPassAuthHandler) Authenticate(conn net.Conn, bufConn *bufio.Reader, rw ResponseWriter) (interface{}, error) {
-	if err := rw.SendUserPassAuth(); err != nil {
-		return nil, err
-	}
-
-	header := []byte{0, 0}
-
-	if _, err := io.ReadAtLeast(bufConn, header, 2); err != nil {
-		return nil, err
-	}
-
-	if header[0] != AuthVersion {
-		return nil, fmt.Errorf("unsupported auth version: %v", header[0])
-	}
-
-	userLen := int(header[1])
-	user := make([]byte, userLen)
-
-	if _, err := io.ReadAtLeast(bufConn, user, userLen); err != nil {
-		return nil, err
-	}
-
-	if _, err := bufConn.Read(header[:1]); err != nil {
-		return nil, err
-	}
-
-	passLen := int(header[0])
-	pass := make([]byte, passLen)
-
-	if _, err := io.ReadAtLeast(bufConn, pass, passLen); err != nil {
-		return nil, err
-	}
-
-	if h.username == string(user) && h.password == string(pass) {
-		if err := rw.SendAuthSuccess(); err != nil {
-			return nil, err
-		}
+	return NewCredentialAuthHandler(h).Authenticate(conn, bufConn, rw)
+}
 
-		return nil, nil
-	}
+func (h *UserPassAuthHandler) Verify(conn net.Conn, username, password string) (interface{}, error) {
+	userMatch := subtle.ConstantTimeCompare([]byte(h.username), []byte(username))
+	passMatch := subtle.ConstantTimeCompare([]byte(h.password), []byte(password))
 
-	if err := rw.SendAuthFailure(); err != nil {
-		return nil, err
+	if userMatch&passMatch != 1 {
+		return nil, errors.New("invalid username or password")
 	}
 
 	return nil, nil
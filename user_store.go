@@ -0,0 +1,244 @@
+package final_socks
+
+import (
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrUserExists    = errors.New("user already exists")
+	ErrUserNotFound  = errors.New("user not found")
+	ErrUserDisabled  = errors.New("user disabled")
+	ErrEmptyPassword = errors.New("password is required")
+)
+
+// UserInfo is the public view of a UserStore entry.
+type UserInfo struct {
+	Username string `json:"username"`
+	Disabled bool   `json:"disabled"`
+	Sessions int    `json:"sessions"`
+}
+
+type storeUser struct {
+	// hash is a bcrypt hash
+	hash     []byte
+	disabled bool
+}
+
+// UserStore is an in-memory CredentialVerifier whose users can be changed at
+// runtime. Changes apply to new connections immediately.
+type UserStore struct {
+	mu       sync.RWMutex
+	users    map[string]*storeUser
+	sessions map[string]map[net.Conn]struct{}
+	conns    map[net.Conn]string
+}
+
+func NewUserStore() *UserStore {
+	return &UserStore{
+		users:    map[string]*storeUser{},
+		sessions: map[string]map[net.Conn]struct{}{},
+		conns:    map[net.Conn]string{},
+	}
+}
+
+func (s *UserStore) Add(username, password string) error {
+	user, err := newStoreUser(password)
+
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[username]; ok {
+		return ErrUserExists
+	}
+
+	s.users[username] = user
+
+	return nil
+}
+
+// Remove deletes the user. With closeSessions set, connections the user
+// already authenticated are closed as well.
+func (s *UserStore) Remove(username string, closeSessions bool) error {
+	s.mu.Lock()
+
+	if _, ok := s.users[username]; !ok {
+		s.mu.Unlock()
+
+		return ErrUserNotFound
+	}
+
+	delete(s.users, username)
+
+	var conns []net.Conn
+
+	for conn := range s.sessions[username] {
+		delete(s.conns, conn)
+
+		if closeSessions {
+			conns = append(conns, conn)
+		}
+	}
+
+	delete(s.sessions, username)
+
+	s.mu.Unlock()
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+
+	return nil
+}
+
+func (s *UserStore) SetPassword(username, password string) error {
+	user, err := newStoreUser(password)
+
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.users[username]
+
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	user.disabled = old.disabled
+	s.users[username] = user
+
+	return nil
+}
+
+func (s *UserStore) Disable(username string) error {
+	return s.setDisabled(username, true)
+}
+
+func (s *UserStore) Enable(username string) error {
+	return s.setDisabled(username, false)
+}
+
+func (s *UserStore) setDisabled(username string, disabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[username]
+
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	user.disabled = disabled
+
+	return nil
+}
+
+func (s *UserStore) Users() []UserInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]UserInfo, 0, len(s.users))
+
+	for username, user := range s.users {
+		users = append(users, UserInfo{
+			Username: username,
+			Disabled: user.disabled,
+			Sessions: len(s.sessions[username]),
+		})
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+
+	return users
+}
+
+func (s *UserStore) Verify(conn net.Conn, username, password string) (interface{}, error) {
+	s.mu.RLock()
+	user, ok := s.users[username]
+	s.mu.RUnlock()
+
+	if !ok {
+		// spend the same time as for a wrong password so response timing
+		// does not tell which usernames exist
+		_, _ = CheckPasswordHash(dummyPasswordHash(), password)
+
+		return nil, ErrUserNotFound
+	}
+
+	// compared outside the lock, bcrypt is slow on purpose
+	if !user.check(password) {
+		return nil, errors.New("invalid password")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// removed or disabled while the password was compared
+	if s.users[username] != user {
+		return nil, ErrUserNotFound
+	}
+
+	if user.disabled {
+		return nil, ErrUserDisabled
+	}
+
+	if conn != nil {
+		if s.sessions[username] == nil {
+			s.sessions[username] = map[net.Conn]struct{}{}
+		}
+
+		s.sessions[username][conn] = struct{}{}
+		s.conns[conn] = username
+	}
+
+	return &Identity{Name: username}, nil
+}
+
+func (s *UserStore) Release(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	username, ok := s.conns[conn]
+
+	if !ok {
+		return
+	}
+
+	delete(s.conns, conn)
+	delete(s.sessions[username], conn)
+
+	if len(s.sessions[username]) == 0 {
+		delete(s.sessions, username)
+	}
+}
+
+func newStoreUser(password string) (*storeUser, error) {
+	if password == "" {
+		return nil, ErrEmptyPassword
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to hash password")
+	}
+
+	return &storeUser{
+		hash: hash,
+	}, nil
+}
+
+func (u *storeUser) check(password string) bool {
+	return bcrypt.CompareHashAndPassword(u.hash, []byte(password)) == nil
+}
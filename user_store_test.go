@@ -0,0 +1,134 @@
+package final_socks
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUserStoreVerify(t *testing.T) {
+	store := NewUserStore()
+
+	if err := store.Add("alice", "secret"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	if err := store.Add("alice", "other"); err != ErrUserExists {
+		t.Fatalf("Add duplicate: got %v, want %v", err, ErrUserExists)
+	}
+
+	if err := store.Add("bob", ""); err != ErrEmptyPassword {
+		t.Fatalf("Add empty password: got %v, want %v", err, ErrEmptyPassword)
+	}
+
+	user, err := store.Verify(nil, "alice", "secret")
+
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	if user.(*Identity).Name != "alice" {
+		t.Fatalf("unexpected identity: %+v", user)
+	}
+
+	if _, err := store.Verify(nil, "alice", "wrong"); err == nil {
+		t.Fatal("Verify accepted a wrong password")
+	}
+
+	if _, err := store.Verify(nil, "mallory", "secret"); err != ErrUserNotFound {
+		t.Fatalf("Verify unknown user: got %v, want %v", err, ErrUserNotFound)
+	}
+
+	if err := store.Disable("alice"); err != nil {
+		t.Fatalf("Disable: %v", err)
+	}
+
+	if _, err := store.Verify(nil, "alice", "secret"); err != ErrUserDisabled {
+		t.Fatalf("Verify disabled user: got %v, want %v", err, ErrUserDisabled)
+	}
+
+	if err := store.Enable("alice"); err != nil {
+		t.Fatalf("Enable: %v", err)
+	}
+
+	if err := store.SetPassword("alice", "changed"); err != nil {
+		t.Fatalf("SetPassword: %v", err)
+	}
+
+	if _, err := store.Verify(nil, "alice", "secret"); err == nil {
+		t.Fatal("Verify accepted the old password")
+	}
+
+	if _, err := store.Verify(nil, "alice", "changed"); err != nil {
+		t.Fatalf("Verify new password: %v", err)
+	}
+
+	if err := store.SetPassword("alice", ""); err != ErrEmptyPassword {
+		t.Fatalf("SetPassword empty: got %v, want %v", err, ErrEmptyPassword)
+	}
+}
+
+func TestUserStoreRemove(t *testing.T) {
+	for _, closeSessions := range []bool{false, true} {
+		store := NewUserStore()
+
+		if err := store.Add("alice", "secret"); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+
+		client, server := net.Pipe()
+
+		if _, err := store.Verify(server, "alice", "secret"); err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+
+		if users := store.Users(); len(users) != 1 || users[0].Sessions != 1 {
+			t.Fatalf("unexpected users: %+v", users)
+		}
+
+		if err := store.Remove("alice", closeSessions); err != nil {
+			t.Fatalf("Remove: %v", err)
+		}
+
+		if err := store.Remove("alice", closeSessions); err != ErrUserNotFound {
+			t.Fatalf("Remove twice: got %v, want %v", err, ErrUserNotFound)
+		}
+
+		if _, err := store.Verify(nil, "alice", "secret"); err != ErrUserNotFound {
+			t.Fatalf("Verify removed user: got %v, want %v", err, ErrUserNotFound)
+		}
+
+		_ = client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := client.Read(make([]byte, 1))
+		closed := err == io.EOF
+
+		if closed != closeSessions {
+			t.Fatalf("close_sessions=%v: session closed=%v", closeSessions, closed)
+		}
+
+		_ = client.Close()
+		_ = server.Close()
+	}
+}
+
+func TestUserStoreRelease(t *testing.T) {
+	store := NewUserStore()
+
+	if err := store.Add("alice", "secret"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	_, conn := net.Pipe()
+	defer conn.Close()
+
+	if _, err := store.Verify(conn, "alice", "secret"); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	store.Release(conn)
+
+	if users := store.Users(); users[0].Sessions != 0 {
+		t.Fatalf("session not released: %+v", users)
+	}
+}
@@ -0,0 +1,173 @@
+package final_socks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type WebhookAuthConfig struct {
+	URL     string
+	Timeout time.Duration
+	// CacheTTL keeps webhook decisions for the same credentials and client IP,
+	// zero disables caching.
+	CacheTTL time.Duration
+	// FailOpen lets users in when the webhook is unreachable or answers with
+	// a 5xx status, otherwise they are rejected. Any other answer, e.g. a
+	// 401 or an invalid response, always rejects.
+	FailOpen bool
+	Client   *http.Client
+}
+
+type webhookRequest struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	ClientIP   string `json:"client_ip"`
+	ServerAddr string `json:"server_addr"`
+}
+
+type webhookResponse struct {
+	Allow     bool     `json:"allow"`
+	UserID    string   `json:"user_id"`
+	RateLimit int64    `json:"rate_limit"`
+	EgressIP  string   `json:"egress_ip"`
+	ACLTags   []string `json:"acl_tags"`
+}
+
+// WebhookAuth is a CredentialVerifier that asks an HTTP endpoint whether
+// the credentials are valid.
+type WebhookAuth struct {
+	config WebhookAuthConfig
+	client *http.Client
+	cache  *credentialCache
+}
+
+func NewWebhookAuth(config WebhookAuthConfig) *WebhookAuth {
+	client := config.Client
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 5 * time.Second
+	}
+
+	return &WebhookAuth{
+		config: config,
+		client: client,
+		cache:  newCredentialCache(config.CacheTTL),
+	}
+}
+
+func (a *WebhookAuth) Verify(conn net.Conn, username, password string) (interface{}, error) {
+	req := webhookRequest{
+		Username: username,
+		Password: password,
+	}
+
+	if conn != nil {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			req.ClientIP = addr.IP.String()
+		}
+
+		req.ServerAddr = conn.LocalAddr().String()
+	}
+
+	key := credentialCacheKey(req.Username, req.Password, req.ClientIP)
+
+	if identity, ok := a.cache.get(key); ok {
+		return allowedIdentity(identity)
+	}
+
+	identity, unavailable, err := a.call(req)
+
+	if err != nil {
+		if unavailable && a.config.FailOpen {
+			return &Identity{Name: username}, nil
+		}
+
+		return nil, err
+	}
+
+	a.cache.put(key, identity)
+
+	return allowedIdentity(identity)
+}
+
+// call reports unavailable for transport errors and 5xx responses, the
+// failures FailOpen applies to.
+func (a *WebhookAuth) call(req webhookRequest) (identity *Identity, unavailable bool, err error) {
+	body, err := json.Marshal(req)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.config.Timeout)
+	defer cancel()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.config.URL, bytes.NewReader(body))
+
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to create webhook request")
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(httpReq)
+
+	if err != nil {
+		return nil, true, errors.Wrap(err, "webhook request failed")
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode >= 500, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+
+	var decision webhookResponse
+
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return nil, false, errors.Wrap(err, "failed to decode webhook response")
+	}
+
+	if !decision.Allow {
+		return nil, false, nil
+	}
+
+	identity = &Identity{
+		Name:      decision.UserID,
+		RateLimit: decision.RateLimit,
+		Tags:      decision.ACLTags,
+	}
+
+	if identity.Name == "" {
+		identity.Name = req.Username
+	}
+
+	if decision.EgressIP != "" {
+		if identity.EgressIP = net.ParseIP(decision.EgressIP); identity.EgressIP == nil {
+			return nil, false, fmt.Errorf("invalid egress ip from webhook: %v", decision.EgressIP)
+		}
+	}
+
+	return identity, false, nil
+}
+
+// allowedIdentity turns a cached or fresh decision into a Verify result,
+// a nil identity means the webhook denied access.
+func allowedIdentity(identity *Identity) (interface{}, error) {
+	if identity == nil {
+		return nil, errors.New("denied by webhook")
+	}
+
+	return identity, nil
+}
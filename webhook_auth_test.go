@@ -0,0 +1,173 @@
+package final_socks
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newWebhookServer(t *testing.T, handler func(w http.ResponseWriter, req webhookRequest)) (*httptest.Server, *atomic.Int64) {
+	calls := &atomic.Int64{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+
+		var req webhookRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode webhook request: %v", err)
+		}
+
+		handler(w, req)
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server, calls
+}
+
+func allowAlice(w http.ResponseWriter, req webhookRequest) {
+	_ = json.NewEncoder(w).Encode(webhookResponse{
+		Allow:     req.Username == "alice" && req.Password == "secret",
+		UserID:    "user-1",
+		RateLimit: 1024,
+		EgressIP:  "192.0.2.1",
+		ACLTags:   []string{"staff"},
+	})
+}
+
+func TestWebhookAuthAllow(t *testing.T) {
+	server, _ := newWebhookServer(t, allowAlice)
+	auth := NewWebhookAuth(WebhookAuthConfig{URL: server.URL})
+
+	user, err := auth.Verify(nil, "alice", "secret")
+
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	identity := user.(*Identity)
+
+	if identity.Name != "user-1" || identity.RateLimit != 1024 || identity.EgressIP.String() != "192.0.2.1" {
+		t.Fatalf("unexpected identity: %+v", identity)
+	}
+
+	if len(identity.Tags) != 1 || identity.Tags[0] != "staff" {
+		t.Fatalf("unexpected tags: %v", identity.Tags)
+	}
+}
+
+func TestWebhookAuthDeny(t *testing.T) {
+	server, _ := newWebhookServer(t, allowAlice)
+	auth := NewWebhookAuth(WebhookAuthConfig{URL: server.URL})
+
+	if _, err := auth.Verify(nil, "alice", "wrong"); err == nil {
+		t.Fatal("expected wrong password to be denied")
+	}
+}
+
+func TestWebhookAuthCacheTTL(t *testing.T) {
+	server, calls := newWebhookServer(t, allowAlice)
+	auth := NewWebhookAuth(WebhookAuthConfig{URL: server.URL, CacheTTL: 100 * time.Millisecond})
+
+	for i := 0; i < 3; i++ {
+		if _, err := auth.Verify(nil, "alice", "secret"); err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+
+		// denials are cached too
+		if _, err := auth.Verify(nil, "alice", "wrong"); err == nil {
+			t.Fatal("expected wrong password to be denied")
+		}
+	}
+
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("expected 2 webhook calls within the TTL, got %d", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if _, err := auth.Verify(nil, "alice", "secret"); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("expected the webhook to be called again after the TTL, got %d calls", n)
+	}
+}
+
+func TestWebhookAuthTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	server, _ := newWebhookServer(t, func(w http.ResponseWriter, req webhookRequest) {
+		<-release
+		allowAlice(w, req)
+	})
+
+	auth := NewWebhookAuth(WebhookAuthConfig{URL: server.URL, Timeout: 50 * time.Millisecond})
+	start := time.Now()
+
+	if _, err := auth.Verify(nil, "alice", "secret"); err == nil {
+		t.Fatal("expected a timeout error")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Verify took %v, the timeout was not applied", elapsed)
+	}
+}
+
+func TestWebhookAuthFailOpen(t *testing.T) {
+	invalidEgress := func(w http.ResponseWriter, req webhookRequest) {
+		_ = json.NewEncoder(w).Encode(webhookResponse{Allow: true, EgressIP: "not an ip"})
+	}
+
+	status := func(code int) func(w http.ResponseWriter, req webhookRequest) {
+		return func(w http.ResponseWriter, req webhookRequest) {
+			w.WriteHeader(code)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		handler  func(w http.ResponseWriter, req webhookRequest)
+		failOpen bool
+		allowed  bool
+	}{
+		{name: "5xx fail closed", handler: status(http.StatusInternalServerError), failOpen: false, allowed: false},
+		{name: "5xx fail open", handler: status(http.StatusBadGateway), failOpen: true, allowed: true},
+		{name: "unreachable fail open", handler: nil, failOpen: true, allowed: true},
+		{name: "401 fail open", handler: status(http.StatusUnauthorized), failOpen: true, allowed: false},
+		{name: "403 fail open", handler: status(http.StatusForbidden), failOpen: true, allowed: false},
+		{name: "invalid egress ip fail open", handler: invalidEgress, failOpen: true, allowed: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var url string
+
+			if test.handler != nil {
+				server, _ := newWebhookServer(t, test.handler)
+				url = server.URL
+			} else {
+				server, _ := newWebhookServer(t, allowAlice)
+				url = server.URL
+				server.Close()
+			}
+
+			auth := NewWebhookAuth(WebhookAuthConfig{URL: url, FailOpen: test.failOpen})
+			user, err := auth.Verify(nil, "bob", "anything")
+
+			if allowed := err == nil; allowed != test.allowed {
+				t.Fatalf("allowed = %v, want %v (err %v)", allowed, test.allowed, err)
+			}
+
+			if test.allowed && user.(*Identity).Name != "bob" {
+				t.Fatalf("unexpected identity: %+v", user)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package final_socks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// WebSocketHandler upgrades HTTP requests to WebSocket and serves SOCKS
+// over the binary message stream, routed to a Server by request path.
+type WebSocketHandler struct {
+	// AllowedOrigins lists the accepted Origin hosts, e.g. "example.com".
+	// Requests without Origin header (non browser clients) are always
+	// accepted, with an empty list only same host origins are.
+	AllowedOrigins []string
+	mu             sync.RWMutex
+	servers        map[string]*Server
+	upgrader       websocket.Upgrader
+}
+
+func NewWebSocketHandler() *WebSocketHandler {
+	h := &WebSocketHandler{
+		servers: map[string]*Server{},
+	}
+
+	h.upgrader = websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		CheckOrigin:     h.checkOrigin,
+	}
+
+	return h
+}
+
+func (h *WebSocketHandler) Handle(path string, server *Server) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.servers[path] = server
+}
+
+func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	server, ok := h.servers[r.URL.Path]
+	h.mu.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	ws, err := h.upgrader.Upgrade(w, r, nil)
+
+	if err != nil {
+		return
+	}
+
+	_ = server.ServeConn(newWebSocketConn(ws))
+}
+
+func (h *WebSocketHandler) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+
+	if err != nil {
+		return false
+	}
+
+	if len(h.AllowedOrigins) == 0 {
+		return strings.EqualFold(u.Host, r.Host)
+	}
+
+	for _, allowed := range h.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, u.Host) || strings.EqualFold(allowed, u.Hostname()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DialWebSocket opens a SOCKS stream to a WebSocketHandler, usable as
+// Dialer.DialProxy.
+func DialWebSocket(ctx context.Context, url string, header http.Header) (net.Conn, error) {
+	ws, resp, err := websocket.DefaultDialer.DialContext(ctx, url, header)
+
+	if err != nil {
+		if resp != nil {
+			return nil, errors.Wrapf(err, "websocket handshake failed with status %d", resp.StatusCode)
+		}
+
+		return nil, errors.Wrap(err, "websocket dial failed")
+	}
+
+	return newWebSocketConn(ws), nil
+}
+
+// ServeWebSocketTunnel forwards every connection accepted on listener, e.g. a
+// local SOCKS port, through its own WebSocket to url.
+func ServeWebSocketTunnel(listener net.Listener, url string, header http.Header) error {
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+
+			ws, err := DialWebSocket(context.Background(), url, header)
+
+			if err != nil {
+				fmt.Println(time.Now().Unix(), "websocket tunnel dial failed", err)
+
+				return
+			}
+
+			defer ws.Close()
+
+			_ = NewResponseWriter(conn).Proxy(ws, conn)
+		}()
+	}
+}
+
+// webSocketConn is a net.Conn over the binary messages of a WebSocket. A
+// close frame is its half-close, the peer reads EOF and may keep writing
+// until it sends its own close frame.
+type webSocketConn struct {
+	ws      *websocket.Conn
+	reader  io.Reader
+	readMu  sync.Mutex
+	writeMu sync.Mutex
+}
+
+func newWebSocketConn(ws *websocket.Conn) *webSocketConn {
+	// answering a close frame right away, the default, would end the
+	// direction the peer still reads
+	ws.SetCloseHandler(func(int, string) error {
+		return nil
+	})
+
+	return &webSocketConn{
+		ws: ws,
+	}
+}
+
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for {
+		if c.reader == nil {
+			messageType, reader, err := c.ws.NextReader()
+
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					return 0, io.EOF
+				}
+
+				return 0, err
+			}
+
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(b)
+
+		if err == io.EOF {
+			c.reader = nil
+
+			if n == 0 {
+				continue
+			}
+
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (c *webSocketConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// CloseWrite sends a close frame, see webSocketConn.
+func (c *webSocketConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	err := c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+
+	if err == websocket.ErrCloseSent {
+		return nil
+	}
+
+	return err
+}
+
+func (c *webSocketConn) Close() error {
+	_ = c.CloseWrite()
+
+	return c.ws.Close()
+}
+
+func (c *webSocketConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *webSocketConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *webSocketConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
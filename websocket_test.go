@@ -0,0 +1,233 @@
+package final_socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// echoAfterEOF accepts one connection, reads it to EOF and writes back what
+// it read, so the reply depends on the half-close reaching it.
+func echoAfterEOF(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				data, _ := io.ReadAll(conn)
+				_, _ = conn.Write(data)
+			}()
+		}
+	}()
+
+	return listener
+}
+
+func newWebSocketTestServer(t *testing.T, allowedOrigins ...string) (*httptest.Server, string) {
+	server := NewServer("", DefaultHandler)
+
+	if err := server.SetOption(NoAuthOption()); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewWebSocketHandler()
+	handler.AllowedOrigins = allowedOrigins
+	handler.Handle("/socks", server)
+
+	httpServer := httptest.NewServer(handler)
+
+	t.Cleanup(httpServer.Close)
+	t.Cleanup(func() { _ = server.Close() })
+
+	return httpServer, "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/socks"
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	tests := []struct {
+		name     string
+		allowed  []string
+		origin   string
+		accepted bool
+	}{
+		{name: "no origin", origin: "", accepted: true},
+		{name: "same host", origin: "http://{host}", accepted: true},
+		{name: "other host", origin: "https://evil.example", accepted: false},
+		{name: "listed", allowed: []string{"app.example"}, origin: "https://app.example", accepted: true},
+		{name: "listed with port", allowed: []string{"app.example:8443"}, origin: "https://app.example:8443", accepted: true},
+		{name: "not listed", allowed: []string{"app.example"}, origin: "https://evil.example", accepted: false},
+		{name: "listed excludes same host", allowed: []string{"app.example"}, origin: "http://{host}", accepted: false},
+		{name: "wildcard", allowed: []string{"*"}, origin: "https://evil.example", accepted: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			httpServer, url := newWebSocketTestServer(t, test.allowed...)
+			header := http.Header{}
+
+			if test.origin != "" {
+				header.Set("Origin", strings.Replace(test.origin, "{host}", strings.TrimPrefix(httpServer.URL, "http://"), 1))
+			}
+
+			conn, err := DialWebSocket(context.Background(), url, header)
+
+			if accepted := err == nil; accepted != test.accepted {
+				t.Fatalf("accepted = %v, want %v (err %v)", accepted, test.accepted, err)
+			}
+
+			if err == nil {
+				_ = conn.Close()
+			} else if !strings.Contains(err.Error(), "status 403") {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestWebSocketUnknownPath(t *testing.T) {
+	httpServer, _ := newWebSocketTestServer(t)
+
+	resp, err := http.Get(httpServer.URL + "/other")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+// testHalfClose writes through conn, closes the write side and expects the
+// echo to come back.
+func testHalfClose(t *testing.T, conn net.Conn) {
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	reply, err := io.ReadAll(conn)
+
+	if err != nil || string(reply) != "ping" {
+		t.Fatalf("reply %q, err %v", reply, err)
+	}
+}
+
+func TestWebSocketConnect(t *testing.T) {
+	_, url := newWebSocketTestServer(t)
+	target := echoAfterEOF(t)
+
+	dialer := &Dialer{
+		ProxyAddr: "websocket",
+		DialProxy: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return DialWebSocket(ctx, url, nil)
+		},
+	}
+
+	conn, err := dialer.Dial("tcp", target.Addr().String())
+
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	defer conn.Close()
+
+	// the close frame is the half-close of the tunnel
+	testHalfClose(t, conn.(*clientConn).Conn)
+}
+
+func TestWebSocketTunnel(t *testing.T) {
+	_, url := newWebSocketTestServer(t)
+	target := echoAfterEOF(t)
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer local.Close()
+
+	go func() {
+		_ = ServeWebSocketTunnel(local, url, nil)
+	}()
+
+	dialer := &Dialer{ProxyAddr: local.Addr().String()}
+	conn, err := dialer.Dial("tcp", target.Addr().String())
+
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	defer conn.Close()
+
+	testHalfClose(t, conn.(*clientConn).Conn)
+}
+
+func TestWebSocketConnSkipsTextFrames(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			return
+		}
+
+		defer ws.Close()
+
+		_ = ws.WriteMessage(websocket.TextMessage, []byte("ignored"))
+		_ = ws.WriteMessage(websocket.BinaryMessage, []byte("da"))
+		_ = ws.WriteMessage(websocket.TextMessage, []byte("ignored"))
+		_ = ws.WriteMessage(websocket.BinaryMessage, []byte("ta"))
+		_ = ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+
+		// wait for the client to close
+		_, _, _ = ws.ReadMessage()
+	}))
+
+	defer httpServer.Close()
+
+	conn, err := DialWebSocket(context.Background(), "ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	data, err := io.ReadAll(conn)
+
+	if err != nil || string(data) != "data" {
+		t.Fatalf("read %q, err %v", data, err)
+	}
+}